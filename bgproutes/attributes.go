@@ -0,0 +1,348 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	routing "github.com/arsonistgopher/junos-jet-demo-apps/proto/bgp_route"
+)
+
+// Attributes are the BGP path attributes sent with a route. They are pointers
+// (or nil slices) so that "not set" can be told apart from zero when layering
+// a route's attributes over a profile and [basics]. Optional ones are left off
+// the route when they are not set anywhere. The JSON names are the TOML keys.
+type Attributes struct {
+	LocalPref        *uint32  `toml:"localPref" json:"localPref,omitempty" yaml:"localPref,omitempty"`
+	RoutePref        *uint32  `toml:"routePref" json:"routePref,omitempty" yaml:"routePref,omitempty"`
+	AsPathStr        *string  `toml:"asPathStr" json:"asPathStr,omitempty" yaml:"asPathStr,omitempty"`
+	Originator       *string  `toml:"originator" json:"originator,omitempty" yaml:"originator,omitempty"`                   // Originator ID, an IPv4 address
+	Cluster          *string  `toml:"cluster" json:"cluster,omitempty" yaml:"cluster,omitempty"`                            // Cluster ID, an IPv4 address
+	ClusterList      []string `toml:"clusterList" json:"clusterList,omitempty" yaml:"clusterList,omitempty"`                // Cluster IDs the route has been reflected through
+	MED              *uint32  `toml:"med" json:"med,omitempty" yaml:"med,omitempty"`                                        // Multi-exit discriminator
+	AIGP             *uint64  `toml:"aigp" json:"aigp,omitempty" yaml:"aigp,omitempty"`                                     // Accumulated IGP metric
+	Communities      []string `toml:"communities" json:"communities,omitempty" yaml:"communities,omitempty"`                // e.g. 64512:100 or no-export
+	ExtCommunities   []string `toml:"extCommunities" json:"extCommunities,omitempty" yaml:"extCommunities,omitempty"`       // e.g. target:64512:100 or origin:10.0.0.1:5
+	LargeCommunities []string `toml:"largeCommunities" json:"largeCommunities,omitempty" yaml:"largeCommunities,omitempty"` // e.g. 64512:1:2
+	RouteType        *string  `toml:"routeType" json:"routeType,omitempty" yaml:"routeType,omitempty"`                      // internal (the default) or external
+}
+
+// Merge returns a with every attribute that is set in o replacing a's. A list
+// replaces the whole list, so communities = [] on a route clears them.
+func (a Attributes) Merge(o *Attributes) Attributes {
+	if o.LocalPref != nil {
+		a.LocalPref = o.LocalPref
+	}
+	if o.RoutePref != nil {
+		a.RoutePref = o.RoutePref
+	}
+	if o.AsPathStr != nil {
+		a.AsPathStr = o.AsPathStr
+	}
+	if o.Originator != nil {
+		a.Originator = o.Originator
+	}
+	if o.Cluster != nil {
+		a.Cluster = o.Cluster
+	}
+	if o.ClusterList != nil {
+		a.ClusterList = o.ClusterList
+	}
+	if o.MED != nil {
+		a.MED = o.MED
+	}
+	if o.AIGP != nil {
+		a.AIGP = o.AIGP
+	}
+	if o.Communities != nil {
+		a.Communities = o.Communities
+	}
+	if o.ExtCommunities != nil {
+		a.ExtCommunities = o.ExtCommunities
+	}
+	if o.LargeCommunities != nil {
+		a.LargeCommunities = o.LargeCommunities
+	}
+	if o.RouteType != nil {
+		a.RouteType = o.RouteType
+	}
+	return a
+}
+
+// unsupportedKeys are BGP attributes people ask for that the bgp_route API has no field for.
+var unsupportedKeys = map[string]bool{"origin": true, "atomicAggregate": true, "aggregator": true}
+
+// wellKnown are the standard communities Junos accepts by name.
+var wellKnown = map[string]bool{
+	"no-export":           true,
+	"no-advertise":        true,
+	"no-export-subconfed": true,
+	"llgr-stale":          true,
+	"no-llgr":             true,
+}
+
+// routeTypes maps routeType on to the IDL.
+var routeTypes = map[string]routing.BgpPeerType{
+	"":         routing.BgpPeerType_BGP_INTERNAL,
+	"internal": routing.BgpPeerType_BGP_INTERNAL,
+	"external": routing.BgpPeerType_BGP_EXTERNAL,
+}
+
+// Validate checks the attributes without sending anything.
+func (a *Attributes) Validate() error {
+	if a.Originator != nil {
+		if _, err := ipv4ID(*a.Originator); err != nil {
+			return fmt.Errorf("originator: %v", err)
+		}
+	}
+	if a.Cluster != nil {
+		if _, err := ipv4ID(*a.Cluster); err != nil {
+			return fmt.Errorf("cluster: %v", err)
+		}
+	}
+	for _, c := range a.ClusterList {
+		if _, err := ipv4ID(c); err != nil {
+			return fmt.Errorf("clusterList: %v", err)
+		}
+	}
+	for _, c := range a.Communities {
+		if err := checkCommunity(c); err != nil {
+			return fmt.Errorf("communities: %v", err)
+		}
+	}
+	for _, c := range a.ExtCommunities {
+		if err := checkExtCommunity(c); err != nil {
+			return fmt.Errorf("extCommunities: %v", err)
+		}
+	}
+	for _, c := range a.LargeCommunities {
+		if err := checkLargeCommunity(c); err != nil {
+			return fmt.Errorf("largeCommunities: %v", err)
+		}
+	}
+	if a.RouteType != nil {
+		if _, ok := routeTypes[*a.RouteType]; !ok {
+			return fmt.Errorf("routeType: %q is not internal or external", *a.RouteType)
+		}
+	}
+	return nil
+}
+
+// apply encodes the attributes in to e. They must have been validated. Route
+// preference, local preference and the AS path are always sent, as zero or
+// empty if they are not set.
+func (a *Attributes) apply(e *routing.BgpRouteEntry) {
+	var routePref, localPref uint32
+	var asPath, routeType string
+	if a.RoutePref != nil {
+		routePref = *a.RoutePref
+	}
+	if a.LocalPref != nil {
+		localPref = *a.LocalPref
+	}
+	if a.AsPathStr != nil {
+		asPath = *a.AsPathStr
+	}
+	if a.RouteType != nil {
+		routeType = *a.RouteType
+	}
+
+	e.RoutePreference = &routing.BgpAttrib32{Value: routePref}
+	e.LocalPreference = &routing.BgpAttrib32{Value: localPref}
+	e.Aspath = &routing.AsPath{AspathString: asPath}
+	e.RouteType = routeTypes[routeType]
+
+	if a.MED != nil {
+		e.Med = &routing.BgpAttrib32{Value: *a.MED}
+	}
+	if a.AIGP != nil {
+		e.Aigp = &routing.BgpAttrib64{Value: *a.AIGP}
+	}
+	if a.Originator != nil {
+		id, _ := ipv4ID(*a.Originator)
+		e.OriginatorId = &routing.BgpAttrib32{Value: id}
+	}
+	if a.Cluster != nil {
+		id, _ := ipv4ID(*a.Cluster)
+		e.ClusterId = &routing.BgpAttrib32{Value: id}
+	}
+	if len(a.ClusterList) > 0 {
+		cl := &routing.ClusterList{}
+		for _, c := range a.ClusterList {
+			id, _ := ipv4ID(c)
+			cl.ClusterIds = append(cl.ClusterIds, id)
+		}
+		e.ClusterList = cl
+	}
+
+	// All three kinds of community travel as Junos community strings.
+	var coms []*routing.Community
+	for _, c := range a.Communities {
+		coms = append(coms, &routing.Community{CommunityString: c})
+	}
+	for _, c := range a.ExtCommunities {
+		coms = append(coms, &routing.Community{CommunityString: c})
+	}
+	for _, c := range a.LargeCommunities {
+		coms = append(coms, &routing.Community{CommunityString: "large:" + strings.TrimPrefix(c, "large:")})
+	}
+	if len(coms) > 0 {
+		e.Communities = &routing.Communities{ComList: coms}
+	}
+}
+
+// ipv4ID turns a dotted quad router or cluster ID in to its 32 bit value.
+func ipv4ID(s string) (uint32, error) {
+	ip := net.ParseIP(s)
+	if ip == nil || ip.To4() == nil || strings.Contains(s, ":") {
+		return 0, fmt.Errorf("%q is not an IPv4 address", s)
+	}
+	return binary.BigEndian.Uint32(ip.To4()), nil
+}
+
+// checkCommunity accepts a well-known name or asn:value with both halves 16 bit.
+func checkCommunity(c string) error {
+	if wellKnown[c] {
+		return nil
+	}
+	parts := strings.Split(c, ":")
+	if len(parts) != 2 {
+		return fmt.Errorf("%q is not a well-known community or asn:value", c)
+	}
+	for _, p := range parts {
+		if _, err := strconv.ParseUint(p, 10, 16); err != nil {
+			return fmt.Errorf("%q: %q is not a 16 bit number", c, p)
+		}
+	}
+	return nil
+}
+
+// checkExtCommunity accepts target: and origin: communities with an AS number
+// (4 byte ones with an L suffix) or an IPv4 address as the administrator.
+func checkExtCommunity(c string) error {
+	parts := strings.Split(c, ":")
+	if len(parts) != 3 || (parts[0] != "target" && parts[0] != "origin") {
+		return fmt.Errorf("%q is not target:admin:value or origin:admin:value", c)
+	}
+
+	admin, assigned := parts[1], parts[2]
+	switch {
+	case strings.Contains(admin, "."):
+		if _, err := ipv4ID(admin); err != nil {
+			return fmt.Errorf("%q: %v", c, err)
+		}
+		if _, err := strconv.ParseUint(assigned, 10, 16); err != nil {
+			return fmt.Errorf("%q: %q is not a 16 bit number", c, assigned)
+		}
+	case strings.HasSuffix(admin, "L"):
+		if _, err := strconv.ParseUint(strings.TrimSuffix(admin, "L"), 10, 32); err != nil {
+			return fmt.Errorf("%q: %q is not a 4 byte AS number", c, admin)
+		}
+		if _, err := strconv.ParseUint(assigned, 10, 16); err != nil {
+			return fmt.Errorf("%q: %q is not a 16 bit number", c, assigned)
+		}
+	default:
+		if _, err := strconv.ParseUint(admin, 10, 16); err != nil {
+			return fmt.Errorf("%q: %q is not a 2 byte AS number (use the L suffix for 4 byte ones)", c, admin)
+		}
+		if _, err := strconv.ParseUint(assigned, 10, 32); err != nil {
+			return fmt.Errorf("%q: %q is not a 32 bit number", c, assigned)
+		}
+	}
+	return nil
+}
+
+// checkLargeCommunity accepts global:local1:local2, all 32 bit, with or without a large: prefix.
+func checkLargeCommunity(c string) error {
+	parts := strings.Split(strings.TrimPrefix(c, "large:"), ":")
+	if len(parts) != 3 {
+		return fmt.Errorf("%q is not global:local1:local2", c)
+	}
+	for _, p := range parts {
+		if _, err := strconv.ParseUint(p, 10, 32); err != nil {
+			return fmt.Errorf("%q: %q is not a 32 bit number", c, p)
+		}
+	}
+	return nil
+}
+
+// attributesOf reads the attributes back out of a route entry, the reverse of
+// apply. Internal is the default route type, so only external is set.
+func attributesOf(e *routing.BgpRouteEntry) Attributes {
+	var a Attributes
+
+	if v := e.GetLocalPreference(); v != nil {
+		lp := v.GetValue()
+		a.LocalPref = &lp
+	}
+	if v := e.GetRoutePreference(); v != nil {
+		rp := v.GetValue()
+		a.RoutePref = &rp
+	}
+	if as := e.GetAspath().GetAspathString(); as != "" {
+		a.AsPathStr = &as
+	}
+	if v := e.GetMed(); v != nil {
+		med := v.GetValue()
+		a.MED = &med
+	}
+	if v := e.GetAigp(); v != nil {
+		aigp := v.GetValue()
+		a.AIGP = &aigp
+	}
+	if v := e.GetOriginatorId(); v != nil {
+		id := idString(v.GetValue())
+		a.Originator = &id
+	}
+	if v := e.GetClusterId(); v != nil {
+		id := idString(v.GetValue())
+		a.Cluster = &id
+	}
+	for _, id := range e.GetClusterList().GetClusterIds() {
+		a.ClusterList = append(a.ClusterList, idString(id))
+	}
+	if e.GetRouteType() == routing.BgpPeerType_BGP_EXTERNAL {
+		rt := "external"
+		a.RouteType = &rt
+	}
+
+	// Sort the community strings back in to the three kinds
+	for _, c := range e.GetCommunities().GetComList() {
+		cs := c.GetCommunityString()
+		switch {
+		case strings.HasPrefix(cs, "large:"):
+			a.LargeCommunities = append(a.LargeCommunities, strings.TrimPrefix(cs, "large:"))
+		case strings.HasPrefix(cs, "target:"), strings.HasPrefix(cs, "origin:"):
+			a.ExtCommunities = append(a.ExtCommunities, cs)
+		default:
+			a.Communities = append(a.Communities, cs)
+		}
+	}
+
+	return a
+}
+
+// idString is the dotted quad form of a 32 bit BGP ID.
+func idString(id uint32) string {
+	b := make(net.IP, 4)
+	binary.BigEndian.PutUint32(b, id)
+	return b.String()
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	routing "github.com/arsonistgopher/junos-jet-demo-apps/proto/bgp_route"
+)
+
+func str(s string) *string { return &s }
+
+func TestAttributesValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		a    Attributes
+		want string // Empty when the attributes are fine
+	}{
+		{name: "nothing set", a: Attributes{}},
+		{
+			name: "everything set",
+			a: Attributes{
+				Originator:       str("10.0.0.1"),
+				Cluster:          str("10.0.0.2"),
+				ClusterList:      []string{"10.0.0.3", "10.0.0.4"},
+				Communities:      []string{"64512:100", "65535:65535", "no-export", "llgr-stale"},
+				ExtCommunities:   []string{"target:64512:100", "target:4200000000L:7", "origin:10.0.0.1:5", "target:64512:4294967295"},
+				LargeCommunities: []string{"4200000000:1:2", "large:64512:0:4294967295"},
+				RouteType:        str("external"),
+			},
+		},
+		{name: "originator", a: Attributes{Originator: str("2001:db8::1")}, want: `originator: "2001:db8::1" is not an IPv4 address`},
+		{name: "mapped originator", a: Attributes{Originator: str("::ffff:10.0.0.1")}, want: `originator: "::ffff:10.0.0.1" is not an IPv4 address`},
+		{name: "cluster", a: Attributes{Cluster: str("cluster-1")}, want: `cluster: "cluster-1" is not an IPv4 address`},
+		{name: "cluster list", a: Attributes{ClusterList: []string{"10.0.0.3", "10.0.0"}}, want: `clusterList: "10.0.0" is not an IPv4 address`},
+		{name: "community name", a: Attributes{Communities: []string{"no-exports"}}, want: `communities: "no-exports" is not a well-known community or asn:value`},
+		{name: "community too big", a: Attributes{Communities: []string{"65536:1"}}, want: `communities: "65536:1": "65536" is not a 16 bit number`},
+		{name: "community halves", a: Attributes{Communities: []string{"64512:1:2"}}, want: `communities: "64512:1:2" is not a well-known community or asn:value`},
+		{name: "ext community kind", a: Attributes{ExtCommunities: []string{"color:64512:1"}}, want: `extCommunities: "color:64512:1" is not target:admin:value or origin:admin:value`},
+		{name: "ext community address", a: Attributes{ExtCommunities: []string{"target:10.0.0.256:1"}}, want: `extCommunities: "target:10.0.0.256:1": "10.0.0.256" is not an IPv4 address`},
+		{name: "ext community address value", a: Attributes{ExtCommunities: []string{"origin:10.0.0.1:65536"}}, want: `extCommunities: "origin:10.0.0.1:65536": "65536" is not a 16 bit number`},
+		{name: "ext community 4 byte AS", a: Attributes{ExtCommunities: []string{"target:4294967296L:1"}}, want: `extCommunities: "target:4294967296L:1": "4294967296L" is not a 4 byte AS number`},
+		{name: "ext community 4 byte AS value", a: Attributes{ExtCommunities: []string{"target:4200000000L:65536"}}, want: `extCommunities: "target:4200000000L:65536": "65536" is not a 16 bit number`},
+		{name: "ext community 2 byte AS", a: Attributes{ExtCommunities: []string{"target:4200000000:1"}}, want: `extCommunities: "target:4200000000:1": "4200000000" is not a 2 byte AS number (use the L suffix for 4 byte ones)`},
+		{name: "ext community 2 byte AS value", a: Attributes{ExtCommunities: []string{"target:64512:4294967296"}}, want: `extCommunities: "target:64512:4294967296": "4294967296" is not a 32 bit number`},
+		{name: "large community parts", a: Attributes{LargeCommunities: []string{"64512:1"}}, want: `largeCommunities: "64512:1" is not global:local1:local2`},
+		{name: "large community too big", a: Attributes{LargeCommunities: []string{"large:4294967296:1:2"}}, want: `largeCommunities: "large:4294967296:1:2": "4294967296" is not a 32 bit number`},
+		{name: "route type", a: Attributes{RouteType: str("confed")}, want: `routeType: "confed" is not internal or external`},
+	}
+
+	for _, tt := range tests {
+		err := tt.a.Validate()
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.want != "" && (err == nil || err.Error() != tt.want):
+			t.Errorf("%s: error %v, want %s", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestAttributesApply(t *testing.T) {
+	// What isn't set goes as zero or empty, except the route type, which is internal
+	var e routing.BgpRouteEntry
+	(&Attributes{}).apply(&e)
+	if e.GetLocalPreference() == nil || e.GetRoutePreference() == nil || e.GetAspath() == nil {
+		t.Error("local preference, route preference and AS path aren't always sent")
+	}
+	if e.GetMed() != nil || e.GetAigp() != nil || e.GetOriginatorId() != nil || e.GetCommunities() != nil {
+		t.Errorf("attributes that weren't set were sent: %v", e)
+	}
+	if e.GetRouteType() != routing.BgpPeerType_BGP_INTERNAL {
+		t.Errorf("route type %v, want internal", e.GetRouteType())
+	}
+
+	med, aigp := uint32(10), uint64(1)<<40
+	a := Attributes{
+		LocalPref:        u32(200),
+		RoutePref:        u32(170),
+		AsPathStr:        str("64512 64513"),
+		Originator:       str("10.0.0.1"),
+		Cluster:          str("192.0.2.1"),
+		ClusterList:      []string{"10.0.0.3", "10.0.0.4"},
+		MED:              &med,
+		AIGP:             &aigp,
+		Communities:      []string{"64512:100", "no-export"},
+		ExtCommunities:   []string{"target:64512:100", "origin:10.0.0.1:5"},
+		LargeCommunities: []string{"4200000000:1:2"},
+		RouteType:        str("external"),
+	}
+	e = routing.BgpRouteEntry{}
+	a.apply(&e)
+
+	if got := e.GetOriginatorId().GetValue(); got != 0x0a000001 {
+		t.Errorf("originator %#x, want 0x0a000001", got)
+	}
+	if got := e.GetClusterId().GetValue(); got != 0xc0000201 {
+		t.Errorf("cluster %#x, want 0xc0000201", got)
+	}
+	var coms []string
+	for _, c := range e.GetCommunities().GetComList() {
+		coms = append(coms, c.GetCommunityString())
+	}
+	if got, want := strings.Join(coms, " "), "64512:100 no-export target:64512:100 origin:10.0.0.1:5 large:4200000000:1:2"; got != want {
+		t.Errorf("communities %q, want %q", got, want)
+	}
+
+	// Reading them back gives what went in
+	if got := attributesOf(&e); !reflect.DeepEqual(got, a) {
+		t.Errorf("read back\n%+v\nwant\n%+v", got, a)
+	}
+}
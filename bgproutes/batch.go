@@ -0,0 +1,217 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetclient"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetlog"
+	routing "github.com/arsonistgopher/junos-jet-demo-apps/proto/bgp_route"
+)
+
+// Defaults for Batching.
+const (
+	DefaultBatchSize = 1000
+	DefaultInFlight  = 4
+)
+
+// errNotSent marks the changes held back because changes before them failed.
+var errNotSent = errors.New("not sent, earlier changes failed")
+
+// Batching says how a plan is cut in to requests and how many of them are
+// outstanding at once.
+type Batching struct {
+	Size     int // Changes per request. 0 sends each kind of change in one request
+	InFlight int // Requests outstanding at once. Less than 1 means 1
+}
+
+// RegisterFlags registers -batch-size and -max-in-flight on fs.
+func (bt *Batching) RegisterFlags(fs *flag.FlagSet) {
+	fs.IntVar(&bt.Size, "batch-size", DefaultBatchSize, "Routes per request. 0 sends each kind of change in one request")
+	fs.IntVar(&bt.InFlight, "max-in-flight", DefaultInFlight, "Requests to have outstanding at once")
+}
+
+// chunks cuts b in to batches of at most size changes.
+func (b *batch) chunks(size int) []batch {
+	if size <= 0 || b.len() <= size {
+		return []batch{*b}
+	}
+
+	var out []batch
+	for from := 0; from < b.len(); from += size {
+		to := from + size
+		if to > b.len() {
+			to = b.len()
+		}
+		out = append(out, b.slice(from, to))
+	}
+	return out
+}
+
+// len is the number of changes in the batch.
+func (b *batch) len() int {
+	return len(b.changes)
+}
+
+// slice is the changes from up to, but not including, to.
+func (b *batch) slice(from, to int) batch {
+	s := batch{verb: b.verb, orLonger: b.orLonger, changes: b.changes[from:to]}
+	if b.verb == Del {
+		s.matches = b.matches[from:to]
+	} else {
+		s.entries = b.entries[from:to]
+	}
+	return s
+}
+
+// apply sends the changes in the plan, kind by kind in the order batches puts
+// them. Each kind is cut up by bt.Size and up to bt.InFlight requests go at
+// once. Every change is marked with how it went. Once a kind has failures the
+// kinds after it are held back, so a sync that can't put the new paths in
+// doesn't take the old ones out either.
+func (p *Plan) apply(session *jetclient.Session, bt Batching, logger *jetlog.Logger) error {
+	for i := range p.Changes {
+		p.Changes[i].Err = nil
+	}
+
+	for _, b := range p.batches() {
+		if p.Failed() > 0 {
+			for _, i := range b.changes {
+				p.Changes[i].Err = errNotSent
+			}
+			continue
+		}
+		p.sendBatch(session, b, bt, logger)
+	}
+
+	if n := p.Failed(); n > 0 {
+		return fmt.Errorf("%d of %d changes failed", n, len(p.Changes))
+	}
+	return nil
+}
+
+// sendBatch sends one kind of change in chunks, with at most bt.InFlight requests
+// outstanding, and waits for them all.
+func (p *Plan) sendBatch(session *jetclient.Session, b batch, bt Batching, logger *jetlog.Logger) {
+	inFlight := bt.InFlight
+	if inFlight < 1 {
+		inFlight = 1
+	}
+
+	// The semaphore channel limits the number of requests outstanding.
+	sem := make(chan struct{}, inFlight)
+	var wg sync.WaitGroup
+
+	for _, c := range b.chunks(bt.Size) {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		// Each chunk marks its own changes, so they don't need a lock
+		go func(c batch) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			p.sendChunk(session, c, logger)
+		}(c)
+	}
+
+	wg.Wait()
+}
+
+// sendChunk sends one chunk. The router stops at the first change it can't make
+// and says how many it made before that, so that one is marked failed and the
+// rest go again in a new request until the chunk is done. An RPC that fails
+// outright fails everything in it.
+func (p *Plan) sendChunk(session *jetclient.Session, c batch, logger *jetlog.Logger) {
+	for c.len() > 0 {
+		reply, err := send(session, &c, logger)
+		if err != nil {
+			for _, i := range c.changes {
+				p.Changes[i].Err = err
+			}
+			return
+		}
+		if reply.GetStatus() == routing.BgpRouteOperReply_SUCCESS {
+			return
+		}
+
+		// A failure that claims to have done everything is blamed on the last one
+		done := int(reply.GetOperationsCompleted())
+		if done >= c.len() {
+			done = c.len() - 1
+		}
+
+		bad := &p.Changes[c.changes[done]]
+		bad.Err = errors.New(reply.GetStatus().String())
+		logger.Warn("Route failed", "verb", bad.Verb.String(), "table", bad.Table, "prefix", fmt.Sprintf("%s/%d", bad.Prefix, bad.Length),
+			"nexthop", bad.NextHop, "cookie", bad.Cookie, "status", reply.GetStatus().String())
+
+		c = c.slice(done+1, c.len())
+	}
+}
+
+// Failed returns the number of changes that failed or were held back.
+func (p *Plan) Failed() int {
+	n := 0
+	for _, c := range p.Changes {
+		if c.Err != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// PrintReport writes the changes that failed, and why, followed by a count of
+// how many went in, failed and were not sent. Call it after the plan is applied.
+func (p *Plan) PrintReport(w io.Writer) error {
+	var failed, held int
+	for _, c := range p.Changes {
+		switch {
+		case c.Err == errNotSent:
+			held++
+		case c.Err != nil:
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "FAILED\tTABLE\tPREFIX\tNEXT-HOP\tCOOKIE\tERROR")
+		for _, c := range p.Changes {
+			if c.Err == nil || c.Err == errNotSent {
+				continue
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s/%d\t%s\t%d\t%v\n", c.Verb, c.Table, c.Prefix, c.Length, c.NextHop, c.Cookie, c.Err)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	counts := []string{fmt.Sprintf("%d done", len(p.Changes)-failed-held), fmt.Sprintf("%d failed", failed)}
+	if held > 0 {
+		counts = append(counts, fmt.Sprintf("%d not sent", held))
+	}
+	_, err := fmt.Fprintln(w, strings.Join(counts, ", "))
+	return err
+}
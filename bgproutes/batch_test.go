@@ -0,0 +1,188 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const threeRoutes = `
+[[route]]
+prefix = "10.123.0.0"
+length = 24
+nexthops = ["10.0.0.1"]
+
+[[route]]
+prefix = "10.123.1.0"
+length = 24
+nexthops = ["10.0.0.1"]
+
+[[route]]
+prefix = "10.123.2.0"
+length = 24
+nexthops = ["10.0.0.1"]
+`
+
+// middleRoute is the second of threeRoutes on its own.
+const middleRoute = `
+[[route]]
+prefix = "10.123.1.0"
+length = 24
+nexthops = ["10.0.0.1"]
+`
+
+// errs is the error, or "ok", for each change in a plan.
+func errs(p *Plan) []string {
+	var out []string
+	for _, c := range p.Changes {
+		if c.Err == nil {
+			out = append(out, "ok")
+			continue
+		}
+		out = append(out, c.Err.Error())
+	}
+	return out
+}
+
+func TestChunks(t *testing.T) {
+	plan, err := routesOf(t, threeRoutes).planFor(Add, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := plan.batches()[0]
+
+	tests := []struct {
+		size int
+		want [][]int
+	}{
+		{size: 0, want: [][]int{{0, 1, 2}}},
+		{size: 1, want: [][]int{{0}, {1}, {2}}},
+		{size: 2, want: [][]int{{0, 1}, {2}}},
+		{size: 3, want: [][]int{{0, 1, 2}}},
+		{size: 10, want: [][]int{{0, 1, 2}}},
+	}
+
+	for _, tt := range tests {
+		var got [][]int
+		for _, c := range b.chunks(tt.size) {
+			if len(c.entries) != c.len() {
+				t.Errorf("size %d: %d entries for %d changes", tt.size, len(c.entries), c.len())
+			}
+			got = append(got, c.changes)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("size %d: chunks %v, want %v", tt.size, got, tt.want)
+		}
+	}
+
+	// An or-longer delete stays one when it is cut up
+	del := batch{verb: Del, orLonger: true}
+	for i := 0; i < 3; i++ {
+		del.matches = append(del.matches, nil)
+		del.changes = append(del.changes, i)
+	}
+	for _, c := range del.chunks(2) {
+		if !c.orLonger || c.verb != Del || len(c.matches) != c.len() {
+			t.Errorf("chunk %+v lost what kind of delete it is", c)
+		}
+	}
+}
+
+func TestApplyFailures(t *testing.T) {
+	// The middle path is on the router already with the cookie the add will use
+	tests := []struct {
+		name  string
+		batch Batching
+	}{
+		{name: "one request", batch: Batching{}},
+		{name: "a request each", batch: Batching{Size: 1, InFlight: 3}},
+		{name: "two per request", batch: Batching{Size: 2, InFlight: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, jet := device(t)
+			defer srv.Stop()
+			otherClient(t, jet, middleRoute, firstCookie+2)
+
+			plan, err := Program(jet, routesOf(t, threeRoutes), Add, tt.batch, "", quiet)
+			if err == nil || err.Error() != "1 of 3 changes failed" {
+				t.Errorf("error %v, want 1 of 3 changes failed", err)
+			}
+			if plan == nil {
+				t.Fatal("no plan")
+			}
+
+			// The router stopped at the middle one, and the last one went again
+			if got, want := errs(plan), []string{"ok", "ROUTE_EXISTS", "ok"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("changes %v, want %v", got, want)
+			}
+			if got := len(rib(srv)); got != 3 {
+				t.Errorf("%d paths on the router, want 3", got)
+			}
+		})
+	}
+}
+
+func TestApplyHoldsBackDeletes(t *testing.T) {
+	srv, jet := device(t)
+	defer srv.Stop()
+	program(t, jet, Add, v6Route)
+	otherClient(t, jet, middleRoute, firstCookie+2)
+
+	// A sync that can't put the new paths in mustn't take the old one out either
+	plan, err := routesOf(t, threeRoutes).planFor(Add, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	del, err := routesOf(t, v6Route).planFor(Del, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan.Changes = append(plan.Changes, del.Changes...)
+
+	session, err := dial(jet, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	if err := plan.apply(session, Batching{}, quiet); err == nil {
+		t.Error("apply: no error")
+	}
+	if got, want := errs(plan), []string{"ok", "ROUTE_EXISTS", "ok", errNotSent.Error()}; !reflect.DeepEqual(got, want) {
+		t.Errorf("changes %v, want %v", got, want)
+	}
+	if want := fmt.Sprintf("inet6.0 2001:db8:1::/48 2001:db8::1 %d lp 0", firstCookie+1); !strings.Contains(strings.Join(rib(srv), "\n"), want) {
+		t.Errorf("router lost %s:\n%s", want, strings.Join(rib(srv), "\n"))
+	}
+
+	var out bytes.Buffer
+	if err := plan.PrintReport(&out); err != nil {
+		t.Fatal(err)
+	}
+	report := out.String()
+	for _, want := range []string{"add  ", "10.123.1.0/24", "ROUTE_EXISTS", "2 done, 1 failed, 1 not sent\n"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report is missing %q:\n%s", want, report)
+		}
+	}
+}
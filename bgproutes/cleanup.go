@@ -0,0 +1,187 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetclient"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetlog"
+	routing "github.com/arsonistgopher/junos-jet-demo-apps/proto/bgp_route"
+	mng "github.com/arsonistgopher/junos-jet-demo-apps/proto/management"
+)
+
+// PurgeNever keeps a client's routes until it comes back, however long that takes.
+const PurgeNever = "never"
+
+// Withdraw connects to one device and withdraws every route programmed under
+// this client ID, whichever file or run put it there, with BgpRouteCleanup.
+// With a stateDir the device's State is emptied as well, as none of the paths
+// in it are on the router any more.
+func Withdraw(jet jetclient.Config, stateDir string, logger *jetlog.Logger) error {
+	st, err := openState(stateDir, jet, logger)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	// BgpRouteInitialize binds us to the routes the client ID already has
+	session, err := dial(jet, logger)
+	if err != nil {
+		return err
+	}
+	defer logger.Info("Closing connection")
+	defer session.Close()
+
+	ctx, cancel := session.Context()
+	defer cancel()
+
+	start := time.Now()
+	reply, err := session.BgpRoute().BgpRouteCleanup(ctx, &routing.BgpRouteCleanupRequest{})
+	if err != nil {
+		return fmt.Errorf("could not clean up routes: %v", err)
+	}
+	logger.Info("Result", jetlog.KeyRPC, "BgpRouteCleanup", "status", reply.GetStatus().String(), jetlog.KeyDuration, time.Since(start))
+
+	if reply.GetStatus() != routing.BgpRouteCleanupReply_SUCCESS {
+		return fmt.Errorf("could not clean up routes: %s", reply.GetStatus().String())
+	}
+
+	st.Clear()
+	return st.Save()
+}
+
+// checkPurgeTimeout catches a -purge-timeout the router would refuse before
+// anything is sent.
+func checkPurgeTimeout(s string) error {
+	if s == "" || s == PurgeNever {
+		return nil
+	}
+	if n, err := strconv.Atoi(s); err != nil || n < 1 {
+		return fmt.Errorf("bgproutes: -purge-timeout is a number of seconds or %s, not %q", PurgeNever, s)
+	}
+	return nil
+}
+
+// purgeTimeoutLine finds the setting in "show configuration" output.
+var purgeTimeoutLine = regexp.MustCompile(`(?m)^\s*purge-timeout\s+(\S+?);`)
+
+// SetPurgeTimeout connects to one device and commits how long the router keeps
+// the routes of a client that goes away without binding again: a number of
+// seconds, or PurgeNever. Routes outlive the session that added them for that
+// long, so a client that restarts in time picks them up where it left off and
+// one that doesn't come back has them withdrawn. It is
+// "routing-options programmable-rpd purge-timeout" in the configuration, and
+// applies to every client on the router, not just this one, so nothing is
+// committed if it is already set to timeout.
+func SetPurgeTimeout(jet jetclient.Config, timeout string, logger *jetlog.Logger) error {
+	if err := checkPurgeTimeout(timeout); err != nil {
+		return err
+	}
+
+	jet.Logger = logger
+	session, err := jetclient.Dial(jet)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	// Not being able to read it is no reason not to set it
+	was, err := purgeTimeout(session, logger)
+	if err != nil {
+		logger.Warn("Could not read the purge timeout, setting it anyway", jetlog.KeyError, err)
+	} else if was == timeout {
+		logger.Info("Purge timeout already set, nothing to commit", "purge-timeout", timeout)
+		return nil
+	}
+
+	return setPurgeTimeout(session, timeout, was, logger)
+}
+
+// purgeTimeout reads the purge timeout from the router's configuration. It is
+// empty if there isn't one.
+func purgeTimeout(session *jetclient.Session, logger *jetlog.Logger) (string, error) {
+	ctx, cancel := session.Context()
+	defer cancel()
+
+	req := &mng.ExecuteOpCommandRequest{
+		Command:   &mng.ExecuteOpCommandRequest_CliCommand{CliCommand: "show configuration routing-options programmable-rpd"},
+		OutFormat: mng.OperationFormatType_OPERATION_FORMAT_CLI,
+	}
+	stream, err := session.Management().ExecuteOpCommand(ctx, req)
+	if err != nil {
+		return "", err
+	}
+
+	var data string
+	for {
+		reply, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if reply.GetStatus() != mng.ReturnCode_SUCCESS {
+			return "", errors.New(reply.GetMessage())
+		}
+		data += reply.GetData()
+	}
+
+	m := purgeTimeoutLine.FindStringSubmatch(data)
+	if m == nil {
+		return "", nil
+	}
+	logger.Debug("Purge timeout", "purge-timeout", m[1])
+	return m[1], nil
+}
+
+// setPurgeTimeout commits the purge timeout on an open session. was is what it
+// is being changed from, for the commit comment.
+func setPurgeTimeout(session *jetclient.Session, timeout, was string, logger *jetlog.Logger) error {
+	ctx, cancel := session.Context()
+	defer cancel()
+
+	if was == "" {
+		was = "unset"
+	}
+	comment := fmt.Sprintf("programmable-rpd purge-timeout %s (was %s), by JET client %s", timeout, was, session.Config().ClientID)
+
+	cfg := "set routing-options programmable-rpd purge-timeout " + timeout
+	req := &mng.ExecuteCfgCommandRequest{
+		Config:   &mng.ExecuteCfgCommandRequest_TextConfig{TextConfig: cfg},
+		LoadType: mng.ConfigLoadType_CONFIG_LOAD_SET,
+		Commit:   &mng.ConfigCommit{CommitType: mng.ConfigCommitType_CONFIG_COMMIT, Comment: comment},
+	}
+
+	start := time.Now()
+	reply, err := session.Management().ExecuteCfgCommand(ctx, req)
+	if err != nil {
+		return fmt.Errorf("could not set the purge timeout: %v", err)
+	}
+	logger.Info("Result", jetlog.KeyRPC, "ExecuteCfgCommand", "purge-timeout", timeout, "was", was, "status", reply.GetStatus().String(), jetlog.KeyDuration, time.Since(start))
+
+	if reply.GetStatus() != mng.ReturnCode_SUCCESS {
+		return fmt.Errorf("could not set the purge timeout: %s", reply.GetMessage())
+	}
+	return nil
+}
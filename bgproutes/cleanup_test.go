@@ -0,0 +1,139 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/inventory"
+)
+
+const showPurge = "show configuration routing-options programmable-rpd"
+
+func TestSetPurgeTimeout(t *testing.T) {
+	srv, jet := device(t)
+	defer srv.Stop()
+
+	// Nothing to read it from is no reason not to set it
+	if err := SetPurgeTimeout(jet, "60", quiet); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"set routing-options programmable-rpd purge-timeout 60"}
+	if got := srv.Committed(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("committed %q, want %q", got, want)
+	}
+
+	// Already set, so nothing is committed
+	srv.SetOpResponse(showPurge, "purge-timeout 60;\n")
+	if err := SetPurgeTimeout(jet, "60", quiet); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.Committed(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("committed %q, want %q", got, want)
+	}
+
+	// Set to something else
+	srv.SetOpResponse(showPurge, "purge-timeout 20;\n")
+	if err := SetPurgeTimeout(jet, PurgeNever, quiet); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, "set routing-options programmable-rpd purge-timeout never")
+	if got := srv.Committed(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("committed %q, want %q", got, want)
+	}
+
+	if err := SetPurgeTimeout(jet, "0", quiet); err == nil {
+		t.Error("purge timeout 0 wasn't refused")
+	}
+}
+
+func TestPurgeTimeoutOnlyWithItsVerb(t *testing.T) {
+	srv, jet := device(t)
+	defer srv.Stop()
+
+	// Route verbs never touch the router's configuration
+	for _, verb := range []Verb{Add, Del, Sync, Cleanup, Get} {
+		o := Options{PurgeTimeout: "60"}
+		if err := o.Run(verb, jet, &inventory.Flags{}, quiet); err == nil {
+			t.Errorf("%v with -purge-timeout didn't fail", verb)
+		}
+	}
+	if got := srv.Committed(); len(got) != 0 {
+		t.Errorf("committed %q", got)
+	}
+
+	if err := (&Options{}).Run(Purge, jet, &inventory.Flags{}, quiet); err == nil {
+		t.Error("purge-timeout without -purge-timeout didn't fail")
+	}
+
+	o := Options{PurgeTimeout: "60"}
+	if err := o.Run(Purge, jet, &inventory.Flags{}, quiet); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.Committed(); len(got) != 1 {
+		t.Errorf("committed %q, want the one purge-timeout", got)
+	}
+}
+
+func TestWithdraw(t *testing.T) {
+	srv, jet := device(t)
+	defer srv.Stop()
+
+	dir, err := ioutil.TempDir("", "bgproutes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := Program(jet, routesOf(t, twoRoutes), Add, Batching{}, dir, quiet); err != nil {
+		t.Fatal(err)
+	}
+	if err := Withdraw(jet, dir, quiet); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := rib(srv); len(got) != 0 {
+		t.Errorf("router still has %q", got)
+	}
+	st, err := OpenState(dir, jet.Target(), quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if len(st.Tables) != 0 {
+		t.Errorf("state still has %v", st.Tables)
+	}
+}
+
+func TestWithdrawLeavesOtherClients(t *testing.T) {
+	srv, jet := device(t)
+	defer srv.Stop()
+
+	program(t, jet, Add, twoRoutes)
+	otherClient(t, jet, v6Route, firstCookie+9)
+	if err := Withdraw(jet, "", quiet); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"inet6.0 2001:db8:1::/48 2001:db8::1 12345687 lp 0"}
+	if got := rib(srv); !reflect.DeepEqual(got, want) {
+		t.Errorf("router has %q, want only client 43's %q", got, want)
+	}
+}
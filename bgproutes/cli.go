@@ -0,0 +1,273 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/inventory"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetclient"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetlog"
+)
+
+// Options are the command line options for programming routes. The connection,
+// inventory and logging flags are registered separately by the caller.
+type Options struct {
+	RoutesFile        string       // Location of file with routes, or Stdin
+	Format            string       // Format of the routes file. Empty goes by its extension
+	Query             Query        // Which routes to read back for Get
+	DryRun            bool         // Print the plan and requests instead of sending them
+	PlanAgainstDevice bool         // Dry run, but read the device to see what the plan would change
+	Watch             WatchOptions // Route daemon settings
+	Batch             Batching     // How the changes are cut in to requests
+	StateDir          string       // Where the path cookies for each device are kept. Empty means nowhere
+	Delete            DeleteFlags  // What del removes instead of the routes file
+	PurgeTimeout      string       // Seconds, or "never", for the purge-timeout verb to commit
+}
+
+// RegisterFlags registers -routesfile, the dry run, batching and state flags on fs.
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.RoutesFile, "routesfile", "routes.toml", "File containing routes, or - for stdin")
+	fs.StringVar(&o.Format, "format", "", "Format of -routesfile: "+formats()+". Empty goes by the extension, and TOML for stdin")
+	fs.BoolVar(&o.DryRun, "dry-run", false, "Print what would be sent, and the requests as JSON, without connecting")
+	fs.BoolVar(&o.PlanAgainstDevice, "plan-against-device", false, "Like -dry-run, but read the device to show what is installed now")
+	o.Batch.RegisterFlags(fs)
+	o.RegisterCleanupFlags(fs)
+}
+
+// RegisterCleanupFlags registers -state-dir on fs, which is all cleanup needs.
+// RegisterFlags registers it too.
+func (o *Options) RegisterCleanupFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.StateDir, "state-dir", "", "Directory to keep the path cookies handed out on each device in, e.g. ~/.jet/state. Empty keeps none")
+}
+
+// RegisterPurgeFlags registers -purge-timeout on fs, for the purge-timeout verb.
+func (o *Options) RegisterPurgeFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.PurgeTimeout, "purge-timeout", "", "For purge-timeout: seconds the router keeps a client's routes after it goes without binding again, or never")
+}
+
+// RegisterGetFlags registers the flags for reading routes back on fs.
+func (o *Options) RegisterGetFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Query.Prefix, "prefix", "", "Prefix to read back, e.g. 10.123.0.0/24. Empty means the whole table")
+	fs.BoolVar(&o.Query.OrLonger, "or-longer", false, "Read back the more specific routes of -prefix too")
+	fs.StringVar(&o.Query.Table, "table", "", "Routing table to read from. Empty means inet.0 or inet6.0; for monitor a comma separated list, empty means all")
+	fs.StringVar(&o.Query.Protocol, "protocol", "static", "Routes to read back or monitor: static, bgp or any")
+	fs.StringVar(&o.Query.Output, "output", OutputTable, "Print the routes as table, json or toml; monitor prints text lines for table, or JSON lines")
+}
+
+// Run loads the routes file and applies verb on one device, or on every device
+// chosen by inv. The per-device summary for an inventory run goes to stdout.
+func (o *Options) Run(verb Verb, jet jetclient.Config, inv *inventory.Flags, logger *jetlog.Logger) error {
+	// The purge-timeout is router configuration, so it is only ever committed when asked for by name
+	if verb == Purge {
+		return o.purge(jet, inv, logger)
+	}
+	if o.PurgeTimeout != "" {
+		return fmt.Errorf("bgproutes: -purge-timeout is for the purge-timeout verb, not %v", verb)
+	}
+
+	if verb == Get {
+		return o.get(jet, inv, logger)
+	}
+	if verb == Monitor {
+		return o.monitor(jet, inv, logger)
+	}
+	if verb == Daemon {
+		return errors.New("bgproutes: the daemon is started with RunDaemon")
+	}
+	if verb == Cleanup {
+		return o.cleanup(jet, inv, logger)
+	}
+
+	rts, err := o.routes(verb)
+	if err != nil {
+		return err
+	}
+
+	if o.DryRun || o.PlanAgainstDevice {
+		return o.dryRun(verb, rts, jet, inv, logger)
+	}
+
+	if verb == Sync {
+		return o.sync(rts, jet, inv, logger)
+	}
+
+	return inv.ForEachPrinted(jet, logger, os.Stdout, "Report", func(t inventory.Target, logger *jetlog.Logger) (inventory.Printer, error) {
+		plan, err := Program(t.Config, rts, verb, o.Batch, o.StateDir, logger)
+		if plan == nil {
+			return nil, err
+		}
+
+		return func(w io.Writer) error {
+			plan.PrintReport(w)
+			return nil
+		}, err
+	})
+}
+
+// routes is what verb works from: the routes file, or for del with the
+// -delete-* flags, just what they pick.
+func (o *Options) routes(verb Verb) (*Routes, error) {
+	if !o.Delete.Enabled() {
+		return LoadFormat(o.RoutesFile, o.Format)
+	}
+	if verb != Del {
+		return nil, fmt.Errorf("bgproutes: the -delete-* flags are for del, not %v", verb)
+	}
+	return o.Delete.Routes()
+}
+
+// purge commits -purge-timeout on one device, or every device chosen by inv,
+// unless it is set to that already.
+func (o *Options) purge(jet jetclient.Config, inv *inventory.Flags, logger *jetlog.Logger) error {
+	if o.PurgeTimeout == "" {
+		return fmt.Errorf("bgproutes: purge-timeout needs -purge-timeout, in seconds or %s", PurgeNever)
+	}
+	if err := checkPurgeTimeout(o.PurgeTimeout); err != nil {
+		return err
+	}
+	if o.DryRun || o.PlanAgainstDevice {
+		return errors.New("bgproutes: purge-timeout has no plan, it commits the one setting")
+	}
+
+	return inv.ForEach(jet, logger, os.Stdout, func(t inventory.Target, logger *jetlog.Logger) error {
+		return SetPurgeTimeout(t.Config, o.PurgeTimeout, logger)
+	})
+}
+
+// cleanup withdraws this client ID's routes from one device, or every device
+// chosen by inv.
+func (o *Options) cleanup(jet jetclient.Config, inv *inventory.Flags, logger *jetlog.Logger) error {
+	if o.DryRun || o.PlanAgainstDevice {
+		return errors.New("bgproutes: cleanup has no plan, it withdraws whatever the client ID has; use get to see that")
+	}
+
+	return inv.ForEach(jet, logger, os.Stdout, func(t inventory.Target, logger *jetlog.Logger) error {
+		return Withdraw(t.Config, o.StateDir, logger)
+	})
+}
+
+// get reads the routes back from one device, or every device chosen by inv, and
+// prints them to stdout. With more than one device each gets a heading.
+func (o *Options) get(jet jetclient.Config, inv *inventory.Flags, logger *jetlog.Logger) error {
+	// Catch a bad -output before connecting to anything
+	if err := WritePaths(ioutil.Discard, nil, o.Query.Output); err != nil {
+		return err
+	}
+
+	return inv.ForEachPrinted(jet, logger, os.Stdout, "Routes", func(t inventory.Target, logger *jetlog.Logger) (inventory.Printer, error) {
+		paths, err := Fetch(t.Config, &o.Query, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(w io.Writer) error {
+			return WritePaths(w, paths, o.Query.Output)
+		}, nil
+	})
+}
+
+// monitor prints route changes on one device to stdout until interrupted.
+// It runs until it is stopped, so it won't take an inventory.
+func (o *Options) monitor(jet jetclient.Config, inv *inventory.Flags, logger *jetlog.Logger) error {
+	if inv.Enabled() {
+		return errors.New("bgproutes: monitor watches one device, use -host rather than an inventory")
+	}
+
+	emit, err := EventWriter(os.Stdout, o.Query.Output)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		s := <-sigs
+		logger.Info("Stopping", "signal", s.String())
+		close(stop)
+	}()
+
+	return StreamChanges(jet, &o.Query, emit, stop, logger)
+}
+
+// sync makes one device, or every device chosen by inv, match the routes file
+// and prints what changed on each to stdout.
+func (o *Options) sync(rts *Routes, jet jetclient.Config, inv *inventory.Flags, logger *jetlog.Logger) error {
+	return inv.ForEachPrinted(jet, logger, os.Stdout, "Sync", func(t inventory.Target, logger *jetlog.Logger) (inventory.Printer, error) {
+		plan, err := Converge(t.Config, rts, o.Batch, o.StateDir, logger)
+		if plan == nil {
+			return nil, err
+		}
+
+		return func(w io.Writer) error {
+			plan.Print(w)
+			if len(plan.Changes) > 0 {
+				plan.PrintReport(w)
+			}
+			return nil
+		}, err
+	})
+}
+
+// dryRun prints the plan for verb and the requests that carry it out, without
+// changing anything. Only -plan-against-device connects to the devices.
+func (o *Options) dryRun(verb Verb, rts *Routes, jet jetclient.Config, inv *inventory.Flags, logger *jetlog.Logger) error {
+	if !o.PlanAgainstDevice {
+		// The state is per device, so it can only be used for one
+		var st *State
+		if !inv.Enabled() {
+			var err error
+			if st, err = openState(o.StateDir, jet, logger); err != nil {
+				return err
+			}
+			defer st.Close()
+		}
+
+		plan, err := DryRun(rts, verb, st)
+		if err != nil {
+			return err
+		}
+		logger.Info("Dry run, nothing is sent", "verb", verb.String(), "routesfile", o.RoutesFile)
+		if err := plan.Print(os.Stdout); err != nil {
+			return err
+		}
+		return plan.PrintRequests(os.Stdout, o.Batch)
+	}
+
+	return inv.ForEachPrinted(jet, logger, os.Stdout, "Plan", func(t inventory.Target, logger *jetlog.Logger) (inventory.Printer, error) {
+		plan, err := PlanAgainstDevice(t.Config, rts, verb, o.StateDir, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(w io.Writer) error {
+			if err := plan.Print(w); err != nil {
+				return err
+			}
+			return plan.PrintRequests(w, o.Batch)
+		}, nil
+	})
+}
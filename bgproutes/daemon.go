@@ -0,0 +1,249 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/inventory"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetclient"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetlog"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetmetrics"
+	routing "github.com/arsonistgopher/junos-jet-demo-apps/proto/bgp_route"
+	"github.com/sevlyar/go-daemon"
+)
+
+// WatchOptions are the settings for the route daemon.
+type WatchOptions struct {
+	WatchInterval  time.Duration // How often to look at the routes file when there is no inotify
+	ResyncInterval time.Duration // How often to check the device even if nothing has changed. 0 turns it off
+}
+
+// RegisterFlags registers -watch-interval and -resync-interval on fs.
+func (w *WatchOptions) RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&w.WatchInterval, "watch-interval", 5*time.Second, "How often to look at -routesfile for changes when inotify isn't available")
+	fs.DurationVar(&w.ResyncInterval, "resync-interval", 5*time.Minute, "How often the daemon checks the device even if the file hasn't changed. 0 turns it off")
+}
+
+// RunDaemon daemonises and keeps one device in line with the routes file until
+// SIGINT or SIGTERM. It syncs when it starts, when the file changes, on SIGHUP,
+// every -resync-interval and after the session had to log in again, and only
+// sends the differences each time. The parent process returns as soon as the
+// child has started, the same way the MQTT bridge does; logf and metf are only
+// used in the child.
+func (o *Options) RunDaemon(jet jetclient.Config, inv *inventory.Flags, logf *jetlog.Flags, metf *jetmetrics.Flags) error {
+	if inv.Enabled() {
+		return errors.New("bgproutes: the daemon works on one -host, not an inventory")
+	}
+	if o.DryRun || o.PlanAgainstDevice {
+		return errors.New("bgproutes: -dry-run and -plan-against-device don't go with the daemon")
+	}
+
+	// Check the flags and the routes file before forking, so mistakes show up on the terminal
+	if _, err := logf.New(os.Stderr); err != nil {
+		return err
+	}
+	if o.RoutesFile == Stdin {
+		return errors.New("bgproutes: the daemon watches -routesfile for changes, so it can't read stdin")
+	}
+	if _, err := LoadFormat(o.RoutesFile, o.Format); err != nil {
+		return err
+	}
+	if o.PurgeTimeout != "" {
+		return errors.New("bgproutes: -purge-timeout is for the purge-timeout verb; set it once before starting the daemon")
+	}
+
+	// The child has no terminal to prompt on, so find the password now and hand
+	// it over in the environment rather than on the command line.
+	if _, err := jet.ResolvePassword(); err != nil {
+		return err
+	}
+	if err := os.Setenv(jetclient.PasswordEnv, jet.Password); err != nil {
+		return err
+	}
+
+	cntxt := &daemon.Context{
+		PidFileName: "routes.pid",
+		PidFilePerm: 0644,
+		LogFileName: "routes.log",
+		LogFilePerm: 0640,
+		WorkDir:     "./",
+		Umask:       027,
+		Args:        os.Args,
+	}
+
+	d, err := cntxt.Reborn()
+	if err != nil {
+		return fmt.Errorf("bgproutes: unable to run: %v", err)
+	}
+	if d != nil {
+		return nil
+	}
+
+	// We get to here, we know we're the new child (from a forking point of view)
+	defer cntxt.Release()
+
+	lf, err := jetlog.NewLogFile(cntxt.LogFileName, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("bgproutes: unable to create log file: %v", err)
+	}
+	logger, _ := logf.New(lf)
+	log.SetOutput(logger)
+	logger = logger.With(jetlog.KeyDevice, jet.Target())
+
+	// Optional /metrics listener, so we can alert if syncing stops
+	if metf.Enabled() {
+		jetmetrics.RegisterRPC()
+		jetmetrics.RegisterRoutes()
+		jet.Interceptors = append(jet.Interceptors, jetmetrics.UnaryClientInterceptor)
+		jet.StreamInterceptors = append(jet.StreamInterceptors, jetmetrics.StreamClientInterceptor)
+		if err := metf.Serve(logger); err != nil {
+			return err
+		}
+	}
+
+	return o.watch(jet, lf, logger)
+}
+
+// watch holds the session open and syncs until it is told to stop.
+func (o *Options) watch(jet jetclient.Config, lf *jetlog.LogFile, logger *jetlog.Logger) error {
+	session, err := dial(jet, logger)
+	if err != nil {
+		return err
+	}
+	defer logger.Info("Closing connection")
+	defer session.Close()
+
+	// After a re-login the router may have forgotten our routes, so check them all
+	reinit := make(chan routing.BgpRouteInitializeReply_BgpRouteInitializeStatus, 1)
+	session.OnReinitialize(func(st routing.BgpRouteInitializeReply_BgpRouteInitializeStatus) {
+		select {
+		case reinit <- st:
+		default:
+		}
+	})
+
+	changed := make(chan struct{}, 1)
+	watchFile(o.RoutesFile, o.Watch.WatchInterval, changed, logger)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	var resync <-chan time.Time
+	if o.Watch.ResyncInterval > 0 {
+		resync = time.Tick(o.Watch.ResyncInterval)
+	}
+
+	// rotate log every 24 hours
+	rotateLogSignal := time.Tick(24 * time.Hour)
+
+	// The metrics are only served with -metrics-listen, but cost next to nothing to keep
+	sync := func(reason string) {
+		if err := o.syncOnce(session, reason, logger); err != nil {
+			jetmetrics.RouteSyncs.WithLabelValues(reason, "error").Inc()
+			return
+		}
+		jetmetrics.RouteSyncs.WithLabelValues(reason, "ok").Inc()
+		jetmetrics.RouteLastSync.Set(float64(time.Now().Unix()))
+	}
+
+	logger.Info("Route daemon started", "routesfile", o.RoutesFile, "pid", os.Getpid())
+	sync("start")
+
+	for {
+		select {
+		case <-changed:
+			sync("file")
+		case st := <-reinit:
+			logger.Warn("Session was re-initialized, checking every route", "status", st.String())
+			sync("reinit")
+		case <-resync:
+			sync("timer")
+		case <-rotateLogSignal:
+			// Keep writing to the old file rather than dying over it
+			if err := lf.Rotate(); err != nil {
+				logger.Error("Unable to rotate log", jetlog.KeyError, err)
+			}
+		case s := <-sigs:
+			if s == syscall.SIGHUP {
+				sync("sighup")
+				continue
+			}
+			logger.Info("Stopping", "signal", s.String())
+			return nil
+		}
+	}
+}
+
+// syncOnce loads the routes file and brings the device in line with it. A file
+// that doesn't load leaves the device alone; the daemon carries on and tries
+// again next time.
+func (o *Options) syncOnce(session *jetclient.Session, reason string, logger *jetlog.Logger) error {
+	rts, err := LoadFormat(o.RoutesFile, o.Format)
+	if err != nil {
+		logger.Error("Not syncing, the routes file has a problem", "reason", reason, jetlog.KeyError, err)
+		return err
+	}
+
+	st, err := openState(o.StateDir, session.Config(), logger)
+	if err != nil {
+		logger.Error("Not syncing, the state has a problem", "reason", reason, jetlog.KeyError, err)
+		return err
+	}
+	defer st.Close()
+
+	plan, err := rts.plan(session, st, logger)
+	if err != nil {
+		logger.Error("Unable to read the routes on the device", "reason", reason, jetlog.KeyError, err)
+		return err
+	}
+
+	if len(plan.Changes) == 0 {
+		logger.Debug("In sync", "reason", reason, "unchanged", plan.Unchanged)
+		if err := plan.record(st); err != nil {
+			logger.Error("Unable to save the state", jetlog.KeyError, err)
+		}
+		return nil
+	}
+
+	logger.Info("Syncing", "reason", reason, "add", plan.Count(Add), "modify", plan.Count(Mod), "delete", plan.Count(Del), "unchanged", plan.Unchanged)
+	err = plan.apply(session, o.Batch, logger)
+	if serr := plan.record(st); serr != nil {
+		logger.Error("Unable to save the state", jetlog.KeyError, serr)
+	}
+
+	// Only count what went in
+	for _, c := range plan.Changes {
+		if c.Err == nil {
+			jetmetrics.RouteChanges.WithLabelValues(c.Verb.String()).Inc()
+		}
+	}
+
+	if err != nil {
+		logger.Error("Sync failed", "reason", reason, jetlog.KeyError, err)
+		return err
+	}
+
+	return nil
+}
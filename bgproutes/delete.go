@@ -0,0 +1,221 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+
+	routing "github.com/arsonistgopher/junos-jet-demo-apps/proto/bgp_route"
+)
+
+// Selector is one [[delete]] in the routes file. It picks paths for del to
+// remove without listing them as routes:
+//
+//	prefix and length             every path of the prefix
+//	prefix, length and nexthop    just the path to that next hop, found by its cookie in the State
+//	prefix, length and orLonger   the prefix and everything more specific
+//	table on its own              everything in the table
+//
+// When a file has any of these, del removes what they pick and leaves the
+// [[route]]s alone. The other verbs ignore them.
+type Selector struct {
+	Prefix   string `toml:"prefix,omitempty" json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	Length   uint32 `toml:"length,omitempty" json:"length,omitempty" yaml:"length,omitempty"`
+	NextHop  string `toml:"nexthop,omitempty" json:"nexthop,omitempty" yaml:"nexthop,omitempty"`    // Just this path
+	OrLonger bool   `toml:"orLonger,omitempty" json:"orLonger,omitempty" yaml:"orLonger,omitempty"` // The more specific routes too
+	Table    string `toml:"table,omitempty" json:"table,omitempty" yaml:"table,omitempty"`          // Routing table. Defaults as for a route
+}
+
+// String describes the selector for error messages.
+func (s *Selector) String() string {
+	switch {
+	case s.Prefix == "":
+		return "delete table " + s.Table
+	case s.NextHop != "":
+		return fmt.Sprintf("delete %s/%d via %s", s.Prefix, s.Length, s.NextHop)
+	case s.OrLonger:
+		return fmt.Sprintf("delete %s/%d or longer", s.Prefix, s.Length)
+	default:
+		return fmt.Sprintf("delete %s/%d", s.Prefix, s.Length)
+	}
+}
+
+// selectorTable works out the table and family the selector is for.
+func (rts *Routes) selectorTable(s *Selector) (string, Family, error) {
+	if s.Prefix == "" {
+		if s.Table == "" {
+			return "", Inet, errors.New("delete: give a prefix, a table or both")
+		}
+		f, ok := tableFamily(s.Table)
+		if !ok {
+			return "", Inet, fmt.Errorf("%v: can't tell the family of the table, give a prefix too", s)
+		}
+		return s.Table, f, nil
+	}
+
+	r := Route{Prefix: s.Prefix, Length: s.Length, Table: s.Table}
+	if s.NextHop != "" {
+		r.NextHops = []string{s.NextHop}
+	}
+	f, err := r.Family()
+	if err != nil {
+		return "", f, err
+	}
+	return rts.Table(&r, f), f, nil
+}
+
+// validateSelector checks one [[delete]].
+func (rts *Routes) validateSelector(s *Selector) error {
+	if s.Prefix == "" && (s.NextHop != "" || s.OrLonger) {
+		return errors.New("delete: nexthop and orLonger need a prefix")
+	}
+	table, f, err := rts.selectorTable(s)
+	if err != nil {
+		return err
+	}
+	if tf, ok := tableFamily(table); ok && tf != f {
+		return fmt.Errorf("%v: %s route can't be in table %s", s, f, table)
+	}
+	if s.NextHop != "" && s.OrLonger {
+		return fmt.Errorf("%v: give nexthop or orLonger, not both", s)
+	}
+	return nil
+}
+
+// deletes turns the [[delete]]s in to changes. A next hop needs the cookie st
+// has for it, since that is the only way to pick out one path of a prefix.
+func (rts *Routes) deletes(st *State) ([]Change, error) {
+	var changes []Change
+	for i := range rts.Deletes {
+		s := &rts.Deletes[i]
+		table, f, err := rts.selectorTable(s)
+		if err != nil {
+			return nil, err
+		}
+
+		// The whole table is everything longer than the default route
+		prefix, length, orLonger := s.Prefix, s.Length, s.OrLonger
+		if prefix == "" {
+			prefix = "0.0.0.0"
+			if f == Inet6 {
+				prefix = "::"
+			}
+			length, orLonger = 0, true
+		}
+
+		m := &routing.BgpRouteMatch{DestPrefix: getPrefix(prefix, f), DestPrefixLen: length, Table: routeTable(table), Protocol: routing.RouteProtocol_PROTO_BGP_STATIC}
+		c := routeDelChange(m)
+		c.orLonger = orLonger
+		if orLonger {
+			c.NextHop = "* or longer"
+		}
+
+		if s.NextHop != "" {
+			cookie, ok := st.Cookie(table, prefix, length, s.NextHop)
+			if !ok {
+				return nil, fmt.Errorf("%v: no cookie recorded for it in %s; use the -state-dir it was added with", s, table)
+			}
+			m.PathCookie = cookie
+			c.Cookie = cookie
+			c.NextHop = s.NextHop
+		}
+
+		changes = append(changes, c)
+	}
+
+	return changes, nil
+}
+
+// planTables is the tables a plan against the device reads back: the ones sync
+// would, plus the ones the [[delete]]s are in.
+func (rts *Routes) planTables(st *State) []syncTable {
+	tables := rts.syncTables(st)
+	seen := make(map[syncTable]bool)
+	for _, t := range tables {
+		seen[t] = true
+	}
+	for i := range rts.Deletes {
+		name, f, err := rts.selectorTable(&rts.Deletes[i])
+		if t := (syncTable{name, f}); err == nil && !seen[t] {
+			seen[t] = true
+			tables = append(tables, t)
+		}
+	}
+	return tables
+}
+
+// under reports whether p is the prefix/length route or more specific than it.
+func under(p *Path, prefix string, length uint32) bool {
+	ip, sup := net.ParseIP(p.Prefix), net.ParseIP(prefix)
+	if ip == nil || sup == nil || (ip.To4() == nil) != (sup.To4() == nil) || p.Length < length {
+		return false
+	}
+	bits := 128
+	if sup.To4() != nil {
+		bits = 32
+	}
+	n := net.IPNet{IP: sup.Mask(net.CIDRMask(int(length), bits)), Mask: net.CIDRMask(int(length), bits)}
+	return n.Contains(ip)
+}
+
+// DeleteFlags pick what del removes from the command line, instead of the routes file.
+type DeleteFlags struct {
+	Prefix   string // e.g. 10.123.0.0/24
+	NextHop  string
+	OrLonger bool
+	Table    string
+}
+
+// RegisterFlags registers the -delete-* flags on fs.
+func (d *DeleteFlags) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&d.Prefix, "delete-prefix", "", "For del: remove this prefix, e.g. 10.123.0.0/24, instead of the routes in -routesfile")
+	fs.StringVar(&d.NextHop, "delete-nexthop", "", "For del: remove only the path to this next hop of -delete-prefix. Needs -state-dir")
+	fs.BoolVar(&d.OrLonger, "delete-or-longer", false, "For del: remove everything more specific than -delete-prefix too")
+	fs.StringVar(&d.Table, "delete-table", "", "For del: the table to remove from; on its own, remove everything in it")
+}
+
+// Enabled reports whether any of the -delete-* flags are set. Any of them on
+// its own means del works from the flags, so a -delete-nexthop without a
+// prefix is refused rather than deleting everything in the routes file.
+func (d *DeleteFlags) Enabled() bool {
+	return d.Prefix != "" || d.Table != "" || d.NextHop != "" || d.OrLonger
+}
+
+// Routes returns the routes "file" that del works from for the flags.
+func (d *DeleteFlags) Routes() (*Routes, error) {
+	if d.Prefix == "" && (d.NextHop != "" || d.OrLonger) {
+		return nil, errors.New("bgproutes: -delete-nexthop and -delete-or-longer need -delete-prefix")
+	}
+
+	s := Selector{NextHop: d.NextHop, OrLonger: d.OrLonger, Table: d.Table}
+	if d.Prefix != "" {
+		ip, length, _, err := parsePrefix(d.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		s.Prefix, s.Length = ip.String(), length
+	}
+
+	rts := &Routes{Deletes: []Selector{s}}
+	if err := rts.Validate(); err != nil {
+		return nil, err
+	}
+	return rts, nil
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	jnxType "github.com/arsonistgopher/junos-jet-demo-apps/proto/jnx_addr"
+	prpd "github.com/arsonistgopher/junos-jet-demo-apps/proto/prpd_common"
+)
+
+// Family is an address family.
+type Family int
+
+// Families
+const (
+	Inet  Family = iota // IPv4
+	Inet6               // IPv6
+)
+
+func (f Family) String() string {
+	if f == Inet6 {
+		return "inet6"
+	}
+	return "inet"
+}
+
+// DefaultTable is the table routes of the family go in when no other is given.
+func (f Family) DefaultTable() string {
+	if f == Inet6 {
+		return "inet6.0"
+	}
+	return "inet.0"
+}
+
+// maxLen is the longest prefix length for the family.
+func (f Family) maxLen() uint32 {
+	if f == Inet6 {
+		return 128
+	}
+	return 32
+}
+
+// parseAddr parses an address and says which family it is written in. An
+// IPv4-mapped address such as ::ffff:10.0.0.1 counts as IPv6.
+func parseAddr(s string) (net.IP, Family, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, Inet, fmt.Errorf("%q is not an IP address", s)
+	}
+	if strings.Contains(s, ":") {
+		return ip, Inet6, nil
+	}
+	return ip, Inet, nil
+}
+
+// This function takes the hard work out of getting a RoutePrefix instance
+func getPrefix(s string, f Family) *prpd.RoutePrefix {
+	addr := &jnxType.IpAddress{AddrFormat: &jnxType.IpAddress_AddrString{AddrString: s}}
+	if f == Inet6 {
+		return &prpd.RoutePrefix{RoutePrefixAf: &prpd.RoutePrefix_Inet6{Inet6: addr}}
+	}
+	return &prpd.RoutePrefix{RoutePrefixAf: &prpd.RoutePrefix_Inet{Inet: addr}}
+}
+
+// Family returns the address family of the route, after checking that the prefix,
+// length and next hops make sense together. An IPv6 route can use an IPv4 next
+// hop written IPv4-mapped (::ffff:10.0.0.1), which Junos accepts for 6PE; a bare
+// IPv4 next hop on an IPv6 route, or the other way around, is an error.
+func (r *Route) Family() (Family, error) {
+	_, f, err := parseAddr(r.Prefix)
+	if err != nil {
+		return f, fmt.Errorf("route %s/%d: prefix %v", r.Prefix, r.Length, err)
+	}
+	if r.Length > f.maxLen() {
+		return f, fmt.Errorf("route %s/%d: length is more than %d", r.Prefix, r.Length, f.maxLen())
+	}
+
+	for _, nh := range r.Paths() {
+		n := nh.Address
+		_, nf, err := parseAddr(n)
+		if err != nil {
+			return f, fmt.Errorf("route %s/%d: next hop %v", r.Prefix, r.Length, err)
+		}
+		switch {
+		case nf == f:
+		case f == Inet6:
+			return f, fmt.Errorf("route %s/%d: next hop %s is IPv4; write it IPv4-mapped as ::ffff:%s", r.Prefix, r.Length, n, n)
+		default:
+			return f, fmt.Errorf("route %s/%d: next hop %s is IPv6 but the route is IPv4", r.Prefix, r.Length, n)
+		}
+	}
+
+	return f, nil
+}
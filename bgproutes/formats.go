@@ -0,0 +1,318 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Stdin is the -routesfile that reads the routes from standard input.
+const Stdin = "-"
+
+// decoder reads routes in one format in to rts. name is the file, for errors.
+// Validation is done afterwards, the same for every format.
+type decoder func(r io.Reader, name string, rts *Routes) error
+
+// decoders are the formats -format takes, and extensions picks from.
+var decoders = map[string]decoder{
+	"toml": decodeTOML,
+	"yaml": decodeYAML,
+	"json": decodeJSON,
+	"csv":  decodeCSV,
+}
+
+// extensions maps a file extension on to its format. Anything else is TOML, as
+// every routes file used to be.
+var extensions = map[string]string{
+	".toml": "toml",
+	".yaml": "yaml",
+	".yml":  "yaml",
+	".json": "json",
+	".csv":  "csv",
+}
+
+// formats lists the formats -format takes.
+func formats() string {
+	var names []string
+	for n := range decoders {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Load decodes a routes file, in the format its extension says, and checks
+// every route in it.
+func Load(path string) (*Routes, error) {
+	return LoadFormat(path, "")
+}
+
+// LoadFormat decodes a routes file in format and checks every route in it. An
+// empty format goes by the extension. A path of Stdin reads standard input,
+// which is TOML unless format says otherwise.
+func LoadFormat(path, format string) (*Routes, error) {
+	if format == "" {
+		format = extensions[strings.ToLower(filepath.Ext(path))]
+		if format == "" || path == Stdin {
+			format = "toml"
+		}
+	}
+	decode, ok := decoders[format]
+	if !ok {
+		return nil, fmt.Errorf("bgproutes: unknown routes format %q, want %s", format, formats())
+	}
+
+	name, r := path, io.Reader(os.Stdin)
+	if path == Stdin {
+		name = "stdin"
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var rts Routes
+	if err := decode(r, name, &rts); err != nil {
+		return nil, err
+	}
+
+	if err := rts.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	return &rts, nil
+}
+
+// decodeTOML reads the routes file the way it has always been written.
+func decodeTOML(r io.Reader, name string, rts *Routes) error {
+	// Marshall!
+	md, err := toml.DecodeReader(r, rts)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+
+	// A misspelt attribute would otherwise be dropped without a word.
+	for _, k := range md.Undecoded() {
+		if unsupportedKeys[k[len(k)-1]] {
+			return fmt.Errorf("%s: %s is not supported by the JET bgp_route API", name, k)
+		}
+		return fmt.Errorf("%s: unknown key %s", name, k)
+	}
+
+	return nil
+}
+
+// decodeJSON reads the same structure as the TOML, with the same key names.
+func decodeJSON(r io.Reader, name string, rts *Routes) error {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(rts); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// decodeYAML reads the same structure as the TOML, with the same key names.
+func decodeYAML(r io.Reader, name string, rts *Routes) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if err := yaml.UnmarshalStrict(b, rts); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// decodeCSV reads one path per row, the way an IPAM exports them:
+//
+//	prefix,length,nexthop[,nexthop...]
+//
+// If the first row starts with "prefix" it is a header naming the columns
+// instead. Then there is a column each for prefix, length and nexthop, and
+// any of table, instance, profile and the attribute keys of the TOML can
+// follow, in any order. Lists, including several next hops, are space
+// separated and an empty cell leaves the attribute unset. The prefix can be
+// written 10.123.0.0/24 with no length. Rows for the same prefix and table
+// become one route, each with its next hops and their own attributes. Lines
+// starting with # are ignored.
+func decodeCSV(r io.Reader, name string, rts *Routes) error {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.TrimLeadingSpace = true
+	cr.FieldsPerRecord = -1
+
+	records, err := cr.ReadAll()
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+
+	var header []string
+	if len(records) > 0 && len(records[0]) > 0 && strings.EqualFold(strings.TrimSpace(records[0][0]), "prefix") {
+		header = records[0]
+		for i := range header {
+			header[i] = strings.TrimSpace(header[i])
+		}
+		records = records[1:]
+	}
+
+	routes := make(map[string]int) // Route key to index in rts.Routes
+	for n, rec := range records {
+		row := n + 1
+		if header != nil {
+			row++
+		}
+
+		rt, nhs, err := csvPath(header, rec)
+		if err != nil {
+			return fmt.Errorf("%s: row %d: %v", name, row, err)
+		}
+
+		k := fmt.Sprintf("%s %s %s/%d", rt.Table, rt.Instance, normalAddr(rt.Prefix), rt.Length)
+		i, ok := routes[k]
+		if !ok {
+			i = len(rts.Routes)
+			routes[k] = i
+			rts.Routes = append(rts.Routes, rt)
+		}
+		rts.Routes[i].NextHop = append(rts.Routes[i].NextHop, nhs...)
+	}
+
+	return nil
+}
+
+// csvPath turns one CSV row in to the route it belongs to, without next hops,
+// and the next hops it adds.
+func csvPath(header []string, rec []string) (Route, []NextHop, error) {
+	var rt Route
+	var addrs []string
+	var nh NextHop
+
+	if header == nil {
+		if len(rec) < 3 {
+			return rt, nil, fmt.Errorf("want prefix,length,nexthop, got %d fields", len(rec))
+		}
+		header = []string{"prefix", "length"}
+		for range rec[2:] {
+			header = append(header, "nexthop")
+		}
+	}
+	if len(rec) != len(header) {
+		return rt, nil, fmt.Errorf("%d fields for %d columns", len(rec), len(header))
+	}
+
+	length := ""
+	for i, col := range header {
+		v := strings.TrimSpace(rec[i])
+		switch strings.ToLower(col) {
+		case "prefix":
+			rt.Prefix = v
+		case "length":
+			length = v
+		case "nexthop", "nexthops":
+			addrs = append(addrs, strings.Fields(v)...)
+		case "table":
+			rt.Table = v
+		case "instance":
+			rt.Instance = v
+		case "profile":
+			nh.Profile = v
+		default:
+			if err := setAttribute(&nh.Attributes, col, v); err != nil {
+				return rt, nil, err
+			}
+		}
+	}
+
+	// 10.123.0.0/24 on its own is as good as a prefix and a length
+	if i := strings.Index(rt.Prefix, "/"); i >= 0 {
+		if length != "" && length != rt.Prefix[i+1:] {
+			return rt, nil, fmt.Errorf("prefix %s and length %s don't agree", rt.Prefix, length)
+		}
+		rt.Prefix, length = rt.Prefix[:i], rt.Prefix[i+1:]
+	}
+	l, err := strconv.ParseUint(length, 10, 32)
+	if err != nil {
+		return rt, nil, fmt.Errorf("length %q is not a number", length)
+	}
+	rt.Length = uint32(l)
+
+	if len(addrs) == 0 {
+		return rt, nil, fmt.Errorf("route %s/%d has no next hop", rt.Prefix, rt.Length)
+	}
+	nhs := make([]NextHop, len(addrs))
+	for i, a := range addrs {
+		nhs[i] = nh
+		nhs[i].Address = a
+	}
+
+	return rt, nhs, nil
+}
+
+// setAttribute sets the attribute with TOML key col from a CSV cell. The keys
+// are matched without regard to case, as spreadsheets have their own ideas.
+func setAttribute(a *Attributes, col, v string) error {
+	av := reflect.ValueOf(a).Elem()
+	at := av.Type()
+	for i := 0; i < at.NumField(); i++ {
+		key := strings.Split(at.Field(i).Tag.Get("toml"), ",")[0]
+		if !strings.EqualFold(key, col) {
+			continue
+		}
+		if v == "" {
+			return nil
+		}
+
+		f := av.Field(i)
+		switch f.Type().String() {
+		case "*uint32", "*uint64":
+			n, err := strconv.ParseUint(v, 10, f.Type().Elem().Bits())
+			if err != nil {
+				return fmt.Errorf("%s %q is not a number", key, v)
+			}
+			p := reflect.New(f.Type().Elem())
+			p.Elem().SetUint(n)
+			f.Set(p)
+		case "*string":
+			f.Set(reflect.ValueOf(&v))
+		case "[]string":
+			f.Set(reflect.ValueOf(strings.Fields(v)))
+		}
+		return nil
+	}
+
+	if unsupportedKeys[col] {
+		return fmt.Errorf("%s is not supported by the JET bgp_route API", col)
+	}
+	return fmt.Errorf("unknown column %q", col)
+}
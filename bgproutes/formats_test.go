@@ -0,0 +1,248 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The same routes file in each of the formats that share the TOML's structure.
+const (
+	formatsTOML = `
+[profile.edge]
+communities = ["64512:100"]
+
+[[route]]
+prefix = "10.123.0.0"
+length = 24
+nexthops = ["10.0.0.1"]
+localPref = 100
+
+[[route]]
+prefix = "10.123.1.0"
+length = 24
+table = "CUST-A.inet.0"
+
+  [[route.nexthop]]
+  address = "10.0.0.2"
+  profile = "edge"
+  med = 5
+`
+
+	formatsJSON = `{
+  "profile": {"edge": {"communities": ["64512:100"]}},
+  "route": [
+    {"prefix": "10.123.0.0", "length": 24, "nexthops": ["10.0.0.1"], "localPref": 100},
+    {"prefix": "10.123.1.0", "length": 24, "table": "CUST-A.inet.0",
+     "nexthop": [{"address": "10.0.0.2", "profile": "edge", "med": 5}]}
+  ]
+}`
+
+	formatsYAML = `
+profile:
+  edge:
+    communities: ["64512:100"]
+route:
+  - prefix: 10.123.0.0
+    length: 24
+    nexthops: [10.0.0.1]
+    localPref: 100
+  - prefix: 10.123.1.0
+    length: 24
+    table: CUST-A.inet.0
+    nexthop:
+      - address: 10.0.0.2
+        profile: edge
+        med: 5
+`
+)
+
+func u32(n uint32) *uint32 { return &n }
+
+// formatsWant is what every one of the formats above decodes to.
+func formatsWant() *Routes {
+	return &Routes{
+		Profiles: map[string]Attributes{"edge": {Communities: []string{"64512:100"}}},
+		Routes: []Route{
+			{Prefix: "10.123.0.0", Length: 24, NextHops: []string{"10.0.0.1"}, Attributes: Attributes{LocalPref: u32(100)}},
+			{Prefix: "10.123.1.0", Length: 24, Table: "CUST-A.inet.0", NextHop: []NextHop{{Address: "10.0.0.2", Profile: "edge", Attributes: Attributes{MED: u32(5)}}}},
+		},
+	}
+}
+
+func TestDecoders(t *testing.T) {
+	tests := []struct {
+		format string
+		file   string
+	}{
+		{format: "toml", file: formatsTOML},
+		{format: "json", file: formatsJSON},
+		{format: "yaml", file: formatsYAML},
+	}
+
+	for _, tt := range tests {
+		var rts Routes
+		if err := decoders[tt.format](strings.NewReader(tt.file), "test", &rts); err != nil {
+			t.Errorf("%s: %v", tt.format, err)
+			continue
+		}
+		if want := formatsWant(); !reflect.DeepEqual(&rts, want) {
+			t.Errorf("%s: decoded\n%+v\nwant\n%+v", tt.format, rts, *want)
+		}
+	}
+}
+
+func TestDecodeCSV(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want []Route
+	}{
+		{
+			name: "no header",
+			file: "# prefix,length,nexthop...\n10.123.0.0,24,10.0.0.1,10.0.0.2\n10.123.1.0,24,10.0.0.1\n",
+			want: []Route{
+				{Prefix: "10.123.0.0", Length: 24, NextHop: []NextHop{{Address: "10.0.0.1"}, {Address: "10.0.0.2"}}},
+				{Prefix: "10.123.1.0", Length: 24, NextHop: []NextHop{{Address: "10.0.0.1"}}},
+			},
+		},
+		{
+			// Rows for the same prefix and table are one route, each path with its own attributes
+			name: "header",
+			file: "Prefix, length, nexthop, table, LOCALPREF, communities\n" +
+				"10.123.0.0/24,,10.0.0.1,,100,64512:100 no-export\n" +
+				"10.123.0.0,24,10.0.0.2 10.0.0.3,,,\n" +
+				"10.123.0.0/24,24,10.0.0.1,CUST-A.inet.0,,\n",
+			want: []Route{
+				{Prefix: "10.123.0.0", Length: 24, NextHop: []NextHop{
+					{Address: "10.0.0.1", Attributes: Attributes{LocalPref: u32(100), Communities: []string{"64512:100", "no-export"}}},
+					{Address: "10.0.0.2"},
+					{Address: "10.0.0.3"},
+				}},
+				{Prefix: "10.123.0.0", Length: 24, Table: "CUST-A.inet.0", NextHop: []NextHop{{Address: "10.0.0.1"}}},
+			},
+		},
+		{
+			name: "instance and profile",
+			file: "prefix,nexthop,instance,profile\n2001:db8:1::/48,2001:db8::1,CUST-B,edge\n",
+			want: []Route{
+				{Prefix: "2001:db8:1::", Length: 48, Instance: "CUST-B", NextHop: []NextHop{{Address: "2001:db8::1", Profile: "edge"}}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		var rts Routes
+		if err := decodeCSV(strings.NewReader(tt.file), "test", &rts); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(rts.Routes, tt.want) {
+			t.Errorf("%s: decoded\n%+v\nwant\n%+v", tt.name, rts.Routes, tt.want)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		format string
+		file   string
+		want   string
+	}{
+		{format: "toml", file: "[[route]]\nprefix = \"10.123.0.0\"\nlocalPreference = 100\n", want: "test: unknown key route.localPreference"},
+		{format: "toml", file: "[[route]]\nprefix = \"10.123.0.0\"\norigin = \"igp\"\n", want: "test: route.origin is not supported by the JET bgp_route API"},
+		{format: "json", file: `{"route": [{"prefix": "10.123.0.0", "localPreference": 100}]}`, want: `unknown field "localPreference"`},
+		{format: "yaml", file: "route:\n  - prefix: 10.123.0.0\n    localpref: 100\n", want: "field localpref not found"},
+		{format: "csv", file: "10.123.0.0,24\n", want: "test: row 1: want prefix,length,nexthop, got 2 fields"},
+		{format: "csv", file: "prefix,length,nexthop\n10.123.0.0,24\n", want: "test: row 2: 2 fields for 3 columns"},
+		{format: "csv", file: "prefix,length,nexthop,colour\n10.123.0.0,24,10.0.0.1,red\n", want: `test: row 2: unknown column "colour"`},
+		{format: "csv", file: "prefix,length,nexthop,origin\n10.123.0.0,24,10.0.0.1,igp\n", want: "test: row 2: origin is not supported by the JET bgp_route API"},
+		{format: "csv", file: "prefix,length,nexthop,med\n10.123.0.0,24,10.0.0.1,low\n", want: `test: row 2: med "low" is not a number`},
+		{format: "csv", file: "10.123.0.0/24,16,10.0.0.1\n", want: "test: row 1: prefix 10.123.0.0/24 and length 16 don't agree"},
+		{format: "csv", file: "10.123.0.0,twenty,10.0.0.1\n", want: `test: row 1: length "twenty" is not a number`},
+		{format: "csv", file: "prefix,length,nexthop\n10.123.0.0,24,\n", want: "test: row 2: route 10.123.0.0/24 has no next hop"},
+	}
+
+	for _, tt := range tests {
+		var rts Routes
+		err := decoders[tt.format](strings.NewReader(tt.file), "test", &rts)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s %q: error %v, want %s", tt.format, tt.file, err, tt.want)
+		}
+	}
+}
+
+func TestLoadFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bgproutes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, file string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(file), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// The extension picks the format, anything else is TOML, and -format wins over both
+	tests := []struct {
+		path   string
+		format string
+	}{
+		{path: write("routes.toml", formatsTOML)},
+		{path: write("routes.JSON", formatsJSON)},
+		{path: write("routes.yaml", formatsYAML)},
+		{path: write("routes.yml", formatsYAML)},
+		{path: write("routes.conf", formatsTOML)},
+		{path: write("routes.txt", formatsJSON), format: "json"},
+	}
+	for _, tt := range tests {
+		rts, err := LoadFormat(tt.path, tt.format)
+		if err != nil {
+			t.Errorf("%s: %v", tt.path, err)
+			continue
+		}
+		if want := formatsWant(); !reflect.DeepEqual(rts, want) {
+			t.Errorf("%s: loaded\n%+v\nwant\n%+v", tt.path, *rts, *want)
+		}
+	}
+
+	rts, err := Load(write("routes.csv", "10.123.0.0,24,10.0.0.1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rts.Routes) != 1 || rts.Routes[0].Prefix != "10.123.0.0" {
+		t.Errorf("csv: loaded %+v", rts.Routes)
+	}
+
+	// Every format is checked the same way once it is decoded
+	if _, err := Load(write("bad.json", `{"route": [{"prefix": "10.123.0.0", "length": 33, "nexthops": ["10.0.0.1"]}]}`)); err == nil || !strings.HasPrefix(err.Error(), filepath.Join(dir, "bad.json")+": ") {
+		t.Errorf("invalid route: error %v", err)
+	}
+
+	if _, err := LoadFormat(write("routes.xml", "<routes/>"), "xml"); err == nil || err.Error() != `bgproutes: unknown routes format "xml", want csv, json, toml, yaml` {
+		t.Errorf("unknown format: error %v", err)
+	}
+}
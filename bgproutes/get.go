@@ -0,0 +1,342 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetclient"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetlog"
+	routing "github.com/arsonistgopher/junos-jet-demo-apps/proto/bgp_route"
+)
+
+// Output formats for routes read back from the router.
+const (
+	OutputTable = "table" // Lined up columns, one path per line
+	OutputJSON  = "json"  // A JSON list of Paths
+	OutputTOML  = "toml"  // [[route]] tables that can be fed back in with -routesfile
+)
+
+// protocols are the -protocol names for the route protocols.
+var protocols = map[string]routing.RouteProtocol{
+	"static": routing.RouteProtocol_PROTO_BGP_STATIC,
+	"bgp":    routing.RouteProtocol_PROTO_BGP,
+	"any":    routing.RouteProtocol_PROTO_UNSPECIFIED,
+}
+
+// protocolName is the -protocol name of p.
+func protocolName(p routing.RouteProtocol) string {
+	for n, v := range protocols {
+		if v == p && n != "any" {
+			return n
+		}
+	}
+	return p.String()
+}
+
+// Query picks the routes to read back from the router.
+type Query struct {
+	Prefix   string // e.g. 10.123.0.0/24. Empty means the whole table
+	OrLonger bool   // Match the more specific routes too
+	Table    string // Routing table. Empty means inet.0 or inet6.0, by the family of Prefix
+	Protocol string // static, bgp or any
+	Output   string // table, json or toml
+}
+
+// match builds the BgpRouteMatch for the query and says whether more specifics
+// are wanted too.
+func (q *Query) match() (*routing.BgpRouteMatch, bool, error) {
+	proto, ok := protocols[q.Protocol]
+	if !ok {
+		return nil, false, fmt.Errorf("unknown protocol %q, want static, bgp or any", q.Protocol)
+	}
+
+	var (
+		prefix   string
+		length   uint32
+		f        Family
+		orLonger = q.OrLonger
+	)
+
+	if q.Prefix == "" {
+		// The whole table is everything longer than the default route
+		f, _ = tableFamily(q.Table)
+		prefix = "0.0.0.0"
+		if f == Inet6 {
+			prefix = "::"
+		}
+		orLonger = true
+	} else {
+		ip, l, fam, err := parsePrefix(q.Prefix)
+		if err != nil {
+			return nil, false, err
+		}
+		f, length, prefix = fam, l, ip.String()
+	}
+
+	table := q.Table
+	if table == "" {
+		table = f.DefaultTable()
+	}
+	if tf, ok := tableFamily(table); ok && tf != f {
+		return nil, false, fmt.Errorf("%s is an %s table, %s is %s", table, tf, q.Prefix, f)
+	}
+
+	m := &routing.BgpRouteMatch{DestPrefix: getPrefix(prefix, f), DestPrefixLen: length, Table: routeTable(table), Protocol: proto}
+
+	return m, orLonger, nil
+}
+
+// parsePrefix reads a prefix such as 10.123.0.0/24. No length means a host route.
+func parsePrefix(s string) (net.IP, uint32, Family, error) {
+	addr := s
+	if i := strings.Index(addr, "/"); i >= 0 {
+		addr = addr[:i]
+	}
+	ip, f, err := parseAddr(addr)
+	if err != nil {
+		return nil, 0, f, err
+	}
+
+	ones := int(f.maxLen())
+	if strings.Contains(s, "/") {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, 0, f, fmt.Errorf("%q is not a prefix", s)
+		}
+		ones, _ = ipnet.Mask.Size()
+		ip = ipnet.IP
+	}
+
+	return ip, uint32(ones), f, nil
+}
+
+// Path is one path as read back from the router.
+type Path struct {
+	Table    string   `json:"table"`
+	Prefix   string   `json:"prefix"`
+	Length   uint32   `json:"length"`
+	Protocol string   `json:"protocol"`
+	Cookie   uint64   `json:"cookie"`
+	NextHops []string `json:"nexthops"`
+	Attributes
+}
+
+// pathOf turns a route entry from BgpRouteGet in to a Path.
+func pathOf(e *routing.BgpRouteEntry) Path {
+	prefix := e.GetDestPrefix().GetInet().GetAddrString()
+	if p6 := e.GetDestPrefix().GetInet6(); p6 != nil {
+		prefix = p6.GetAddrString()
+	}
+
+	p := Path{
+		Table:      e.GetTable().GetRttName().GetName(),
+		Prefix:     prefix,
+		Length:     e.GetDestPrefixLen(),
+		Protocol:   protocolName(e.GetProtocol()),
+		Cookie:     e.GetPathCookie(),
+		Attributes: attributesOf(e),
+	}
+	for _, nh := range e.GetProtocolNexthops() {
+		p.NextHops = append(p.NextHops, nh.GetAddrString())
+	}
+
+	return p
+}
+
+// Fetch connects to one device and reads back the routes that match q.
+func Fetch(jet jetclient.Config, q *Query, logger *jetlog.Logger) ([]Path, error) {
+	m, orLonger, err := q.match()
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := dial(jet, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer logger.Info("Closing connection")
+	defer session.Close()
+
+	return fetch(session, m, orLonger, logger)
+}
+
+// fetch reads back the routes that match m on an open session.
+func fetch(session *jetclient.Session, m *routing.BgpRouteMatch, orLonger bool, logger *jetlog.Logger) ([]Path, error) {
+	// A whole table takes a lot longer to come back than -timeout allows
+	ctx, cancel := session.StreamContext()
+	defer cancel()
+
+	start := time.Now()
+	stream, err := session.BgpRoute().BgpRouteGet(ctx, &routing.BgpRouteGetRequest{BgpRoute: m, OrLonger: orLonger})
+	if err != nil {
+		return nil, fmt.Errorf("could not get routes: %v", err)
+	}
+
+	// The routes can come back over several replies
+	var paths []Path
+	for {
+		reply, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not get routes: %v", err)
+		}
+
+		switch reply.GetStatus() {
+		case routing.BgpRouteGetReply_SUCCESS:
+		case routing.BgpRouteGetReply_PREFIX_NOT_FOUND:
+			// Nothing there is an answer too
+			continue
+		default:
+			return nil, fmt.Errorf("get routes: %v", reply.GetStatus())
+		}
+
+		for _, e := range reply.GetBgpRoutes() {
+			paths = append(paths, pathOf(e))
+		}
+	}
+
+	logger.Info("Result", jetlog.KeyRPC, "BgpRouteGet", "table", m.GetTable().GetRttName().GetName(), "routes", len(paths), jetlog.KeyDuration, time.Since(start))
+
+	return paths, nil
+}
+
+// ToRoutes folds paths back in to routes, one per table and prefix, in the
+// order they were first seen. When every path of a route has the same
+// attributes they go on the route and the next hops in its nexthops list;
+// otherwise each path becomes a [[route.nexthop]] with its own attributes.
+func ToRoutes(paths []Path) []Route {
+	var (
+		routes []Route
+		attrs  [][]Attributes // Per route, per next hop
+		index  = make(map[string]int)
+	)
+
+	for _, p := range paths {
+		key := p.Table + " " + p.Prefix + "/" + fmt.Sprint(p.Length)
+		i, ok := index[key]
+		if !ok {
+			i = len(routes)
+			index[key] = i
+
+			r := Route{Prefix: p.Prefix, Length: p.Length}
+			if f, err := r.Family(); err != nil || p.Table != f.DefaultTable() {
+				r.Table = p.Table
+			}
+			routes = append(routes, r)
+			attrs = append(attrs, nil)
+		}
+
+		for _, nh := range p.NextHops {
+			routes[i].NextHop = append(routes[i].NextHop, NextHop{Address: nh, Attributes: p.Attributes})
+			attrs[i] = append(attrs[i], p.Attributes)
+		}
+	}
+
+	for i := range routes {
+		r := &routes[i]
+		if len(attrs[i]) == 0 {
+			continue
+		}
+		same := true
+		for _, a := range attrs[i][1:] {
+			if !reflect.DeepEqual(a, attrs[i][0]) {
+				same = false
+				break
+			}
+		}
+		if !same {
+			continue
+		}
+
+		r.Attributes = attrs[i][0]
+		for _, nh := range r.NextHop {
+			r.NextHops = append(r.NextHops, nh.Address)
+		}
+		r.NextHop = nil
+	}
+
+	return routes
+}
+
+// WritePaths prints paths to w in the given output format.
+func WritePaths(w io.Writer, paths []Path, output string) error {
+	switch output {
+	case OutputTable:
+		return writeTable(w, paths)
+	case OutputJSON:
+		if paths == nil {
+			paths = []Path{}
+		}
+		b, err := json.MarshalIndent(paths, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+	case OutputTOML:
+		return toml.NewEncoder(w).Encode(struct {
+			Routes []Route `toml:"route"`
+		}{ToRoutes(paths)})
+	default:
+		return fmt.Errorf("unknown output %q, want table, json or toml", output)
+	}
+}
+
+// writeTable prints one path per line with the attributes people look at most.
+func writeTable(w io.Writer, paths []Path) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TABLE\tPREFIX\tNEXT-HOP\tPROTOCOL\tCOOKIE\tLOCAL-PREF\tROUTE-PREF\tMED\tAS-PATH\tCOMMUNITIES")
+	for _, p := range paths {
+		var coms []string
+		coms = append(coms, p.Communities...)
+		coms = append(coms, p.ExtCommunities...)
+		for _, c := range p.LargeCommunities {
+			coms = append(coms, "large:"+c)
+		}
+		fmt.Fprintf(tw, "%s\t%s/%d\t%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			p.Table, p.Prefix, p.Length, strings.Join(p.NextHops, ","), p.Protocol, p.Cookie,
+			optUint32(p.LocalPref), optUint32(p.RoutePref), optUint32(p.MED), optString(p.AsPathStr), strings.Join(coms, " "))
+	}
+	return tw.Flush()
+}
+
+// optUint32 prints an unset attribute as "-".
+func optUint32(v *uint32) string {
+	if v == nil {
+		return "-"
+	}
+	return fmt.Sprint(*v)
+}
+
+// optString prints an unset or empty attribute as "-".
+func optString(v *string) string {
+	if v == nil || *v == "" {
+		return "-"
+	}
+	return *v
+}
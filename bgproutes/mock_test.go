@@ -0,0 +1,495 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/inventory"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetclient"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetmock"
+	routing "github.com/arsonistgopher/junos-jet-demo-apps/proto/bgp_route"
+)
+
+// device starts a mock router and returns the Config to reach it as client 42.
+func device(t *testing.T) (*jetmock.Server, jetclient.Config) {
+	t.Helper()
+	srv := jetmock.New()
+	srv.AddUser("jet", "secret")
+	if err := srv.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+
+	host, port, _ := net.SplitHostPort(srv.Addr())
+	return srv, jetclient.Config{
+		Host:     host,
+		Port:     port,
+		User:     "jet",
+		Password: "secret",
+		ClientID: "42",
+		Timeout:  jetclient.DefaultTimeout,
+		Retry:    jetclient.RetryPolicy{Attempts: 1},
+		Logger:   quiet,
+	}
+}
+
+// rib lists the paths on the mock router, one line each.
+func rib(srv *jetmock.Server) []string {
+	var lines []string
+	for _, e := range srv.Routes() {
+		p := pathOf(e)
+		lines = append(lines, fmt.Sprintf("%s %s/%d %s %d lp %d", p.Table, p.Prefix, p.Length, strings.Join(p.NextHops, ","), p.Cookie, e.GetLocalPreference().GetValue()))
+	}
+	return lines
+}
+
+// program applies one verb with a routes file, failing the test if it fails.
+func program(t *testing.T, jet jetclient.Config, verb Verb, file string) {
+	t.Helper()
+	programIn(t, jet, verb, file, "")
+}
+
+// programIn is program keeping the cookies in stateDir, and returns the plan.
+func programIn(t *testing.T, jet jetclient.Config, verb Verb, file, stateDir string) *Plan {
+	t.Helper()
+	rts := routesOf(t, file)
+	var plan *Plan
+	var err error
+	if verb == Sync {
+		plan, err = Converge(jet, rts, Batching{}, stateDir, quiet)
+	} else {
+		plan, err = Program(jet, rts, verb, Batching{}, stateDir, quiet)
+	}
+	if err != nil {
+		t.Fatalf("%v: %v", verb, err)
+	}
+	return plan
+}
+
+// otherClient adds a path to the router the way another JET client would,
+// with its own cookie.
+func otherClient(t *testing.T, jet jetclient.Config, file string, cookie uint64) {
+	t.Helper()
+	jet.ClientID = "43"
+	session, err := dial(jet, quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	entries := entriesOf(t, file)
+	for i := range entries {
+		entries[i] = withCookie(entries[i], cookie)
+	}
+	ctx, cancel := session.Context()
+	defer cancel()
+	reply, err := session.BgpRoute().BgpRouteAdd(ctx, &routing.BgpRouteUpdateRequest{BgpRoutes: entries})
+	if err != nil || reply.GetStatus() != routing.BgpRouteOperReply_SUCCESS {
+		t.Fatalf("other client's add: %v %v", reply.GetStatus(), err)
+	}
+}
+
+const v6Route = `
+[[route]]
+prefix = "2001:db8:1::"
+length = 48
+nexthops = ["2001:db8::1"]
+`
+
+const customTable = `
+[[route]]
+prefix = "10.200.0.0"
+length = 16
+nexthops = ["10.0.0.9"]
+table = "CUST-A.inet.0"
+`
+
+func TestProgramAgainstMock(t *testing.T) {
+	changed := strings.Replace(twoRoutes, "localPref = 100", "localPref = 200", 1)
+	firstOnly := twoRoutes[:strings.Index(twoRoutes, "[[route]]\nprefix = \"10.123.1.0\"")]
+
+	tests := []struct {
+		name   string
+		before string // Added first, if there is anything
+		others []string
+		state  bool // Keep the cookies in a State
+		verb   Verb
+		file   string
+		want   []string
+	}{
+		{
+			name: "add",
+			verb: Add,
+			file: twoRoutes,
+			want: []string{"inet.0 10.123.0.0/24 10.0.0.1 12345679 lp 100", "inet.0 10.123.1.0/24 10.0.0.1 12345680 lp 0"},
+		},
+		{
+			name:   "del",
+			before: twoRoutes,
+			verb:   Del,
+			file:   firstOnly,
+			want:   []string{"inet.0 10.123.1.0/24 10.0.0.1 12345680 lp 0"},
+		},
+		{
+			name:   "mod",
+			before: twoRoutes,
+			verb:   Mod,
+			file:   changed,
+			want:   []string{"inet.0 10.123.0.0/24 10.0.0.1 12345679 lp 200", "inet.0 10.123.1.0/24 10.0.0.1 12345680 lp 0"},
+		},
+		{
+			name:   "replace",
+			before: firstOnly,
+			verb:   Replace,
+			file:   changed,
+			want:   []string{"inet.0 10.123.0.0/24 10.0.0.1 12345679 lp 200", "inet.0 10.123.1.0/24 10.0.0.1 12345680 lp 0"},
+		},
+		{
+			name:   "sync",
+			before: twoRoutes,
+			state:  true,
+			verb:   Sync,
+			file:   changed[:strings.Index(changed, "[[route]]\nprefix = \"10.123.1.0\"")],
+			want:   []string{"inet.0 10.123.0.0/24 10.0.0.1 12345679 lp 200"},
+		},
+		{
+			// Nothing says the path that went from the file is ours rather than another host's
+			name:   "sync without a state",
+			before: twoRoutes,
+			verb:   Sync,
+			file:   changed[:strings.Index(changed, "[[route]]\nprefix = \"10.123.1.0\"")],
+			want:   []string{"inet.0 10.123.0.0/24 10.0.0.1 12345679 lp 200", "inet.0 10.123.1.0/24 10.0.0.1 12345680 lp 0"},
+		},
+		{
+			// Another client's static routes in the default tables are none of our business
+			name:   "sync leaves other clients alone",
+			before: twoRoutes,
+			others: []string{firstOnly, v6Route},
+			verb:   Sync,
+			file:   customTable,
+			want: []string{
+				"CUST-A.inet.0 10.200.0.0/16 10.0.0.9 12345679 lp 0",
+				"inet.0 10.123.0.0/24 10.0.0.1 42 lp 100",
+				"inet.0 10.123.0.0/24 10.0.0.1 12345679 lp 100",
+				"inet.0 10.123.1.0/24 10.0.0.1 12345680 lp 0",
+				"inet6.0 2001:db8:1::/48 2001:db8::1 42 lp 0",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, jet := device(t)
+			defer srv.Stop()
+
+			stateDir := ""
+			if tt.state {
+				dir, err := ioutil.TempDir("", "bgproutes")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.RemoveAll(dir)
+				stateDir = dir
+			}
+
+			for _, o := range tt.others {
+				otherClient(t, jet, o, 42)
+			}
+			if tt.before != "" {
+				programIn(t, jet, Add, tt.before, stateDir)
+			}
+			programIn(t, jet, tt.verb, tt.file, stateDir)
+
+			if got := rib(srv); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("router has\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestFetchAgainstMock(t *testing.T) {
+	srv, jet := device(t)
+	defer srv.Stop()
+	program(t, jet, Add, twoRoutes+customTable)
+
+	tests := []struct {
+		query Query
+		want  []string // Prefixes
+	}{
+		{Query{Protocol: "static"}, []string{"10.123.0.0", "10.123.1.0"}},
+		{Query{Prefix: "10.123.1.0/24", Protocol: "static"}, []string{"10.123.1.0"}},
+		{Query{Prefix: "10.123.0.0/16", OrLonger: true, Protocol: "any"}, []string{"10.123.0.0", "10.123.1.0"}},
+		{Query{Table: "CUST-A.inet.0", Protocol: "static"}, []string{"10.200.0.0"}},
+		{Query{Prefix: "10.99.0.0/16", Protocol: "static"}, nil},
+	}
+
+	for _, tt := range tests {
+		paths, err := Fetch(jet, &tt.query, quiet)
+		if err != nil {
+			t.Errorf("%+v: %v", tt.query, err)
+			continue
+		}
+		var got []string
+		for _, p := range paths {
+			got = append(got, p.Prefix)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: got %q, want %q", tt.query, got, tt.want)
+		}
+	}
+
+	// What comes back is what went in
+	paths, err := Fetch(jet, &Query{Prefix: "10.123.0.0/24", Protocol: "static"}, quiet)
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("got %v, %v", paths, err)
+	}
+	if p := paths[0]; p.Cookie != 12345679 || p.LocalPref == nil || *p.LocalPref != 100 || !reflect.DeepEqual(p.NextHops, []string{"10.0.0.1"}) {
+		t.Errorf("got %+v", p)
+	}
+}
+
+// route is a routes file with one route in inet.0.
+func route(prefix string, length int) string {
+	return fmt.Sprintf("[[route]]\nprefix = %q\nlength = %d\nnexthops = [\"10.0.0.1\"]\n", prefix, length)
+}
+
+// nextEvents waits for n events and returns them one line each, without the
+// times and cookies.
+func nextEvents(t *testing.T, events <-chan Event, n int) []string {
+	t.Helper()
+	var lines []string
+	for len(lines) < n {
+		select {
+		case ev := <-events:
+			if ev.Path == nil {
+				lines = append(lines, ev.Event)
+			} else {
+				lines = append(lines, fmt.Sprintf("%s %s %s/%d lp %s", ev.Event, ev.Table, ev.Prefix, ev.Length, optUint32(ev.LocalPref)))
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("got %q, then no more events", lines)
+		}
+	}
+	return lines
+}
+
+func TestMonitorAgainstMock(t *testing.T) {
+	srv, jet := device(t)
+	defer srv.Stop()
+
+	program(t, jet, Add, twoRoutes)
+	program(t, jet, Add, customTable)
+	program(t, jet, Add, route("10.201.0.0", 16))
+
+	// The monitor only wants 10.123.0.0/16 and longer in inet.0.
+	events := make(chan Event, 100)
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	mon := jet
+	mon.ClientID = "99"
+	q := &Query{Table: "inet.0", Prefix: "10.123.0.0/16", OrLonger: true, Protocol: "any"}
+	go func() {
+		done <- StreamChanges(mon, q, func(ev Event) error {
+			events <- ev
+			return nil
+		}, stop, quiet)
+	}()
+
+	steps := []struct {
+		name   string
+		change func()
+		want   []string
+	}{
+		{
+			name: "register",
+			want: []string{"add inet.0 10.123.0.0/24 lp 100", "add inet.0 10.123.1.0/24 lp 0", "end-of-rib"},
+		},
+		{
+			name:   "add",
+			change: func() { program(t, jet, Add, route("10.123.2.0", 24)) },
+			want:   []string{"add inet.0 10.123.2.0/24 lp 0"},
+		},
+		{
+			// Nothing for the route outside the prefix, or the unchanged one
+			name: "modify",
+			change: func() {
+				program(t, jet, Add, route("10.202.0.0", 16))
+				program(t, jet, Mod, strings.Replace(twoRoutes, "localPref = 100", "localPref = 200", 1))
+			},
+			want: []string{"modify inet.0 10.123.0.0/24 lp 200"},
+		},
+		{
+			name:   "delete",
+			change: func() { program(t, jet, Del, route("10.123.2.0", 24)) },
+			want:   []string{"delete inet.0 10.123.2.0/24 lp 0"},
+		},
+		{
+			// While the monitor is away one route goes and another comes. The
+			// dump after reconnecting reports the new one and stays quiet about
+			// the one it knows; end-of-rib shows up the one that went.
+			name: "reconnect",
+			change: func() {
+				srv.DropMonitors()
+				program(t, jet, Del, twoRoutes[:strings.Index(twoRoutes, "[[route]]\nprefix = \"10.123.1.0\"")])
+				program(t, jet, Add, route("10.123.3.0", 24))
+			},
+			want: []string{"add inet.0 10.123.3.0/24 lp 0", "delete inet.0 10.123.0.0/24 lp 200", "end-of-rib"},
+		},
+	}
+
+	for _, step := range steps {
+		if step.change != nil {
+			step.change()
+		}
+		if got := nextEvents(t, events, len(step.want)); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: got\n%s\nwant\n%s", step.name, strings.Join(got, "\n"), strings.Join(step.want, "\n"))
+		}
+	}
+
+	close(stop)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("StreamChanges: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("StreamChanges didn't stop")
+	}
+	if len(events) > 0 {
+		t.Errorf("%d events after the last step", len(events))
+	}
+}
+
+func TestDeleteFlagsAgainstMock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bgproutes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "routes.toml")
+	if err := ioutil.WriteFile(file, []byte(twoRoutes+v6Route), 0600); err != nil {
+		t.Fatal(err)
+	}
+	all := []string{
+		"inet.0 10.123.0.0/24 10.0.0.1 12345679 lp 100",
+		"inet.0 10.123.1.0/24 10.0.0.1 12345680 lp 0",
+		"inet6.0 2001:db8:1::/48 2001:db8::1 12345681 lp 0",
+	}
+
+	tests := []struct {
+		name  string
+		flags DeleteFlags
+		err   string // Empty if del should work
+		want  []string
+	}{
+		{
+			// Without a prefix these used to be ignored, and del took out the whole file
+			name:  "next hop without a prefix",
+			flags: DeleteFlags{NextHop: "10.0.0.1"},
+			err:   "bgproutes: -delete-nexthop and -delete-or-longer need -delete-prefix",
+			want:  all,
+		},
+		{
+			name:  "or longer without a prefix",
+			flags: DeleteFlags{OrLonger: true, Table: "inet.0"},
+			err:   "bgproutes: -delete-nexthop and -delete-or-longer need -delete-prefix",
+			want:  all,
+		},
+		{
+			name:  "one path",
+			flags: DeleteFlags{Prefix: "10.123.1.0/24", NextHop: "10.0.0.1"},
+			want:  []string{all[0], all[2]},
+		},
+		{
+			name:  "or longer",
+			flags: DeleteFlags{Prefix: "10.123.0.0/16", OrLonger: true},
+			want:  all[2:],
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, jet := device(t)
+			defer srv.Stop()
+
+			stateDir := filepath.Join(dir, strings.Replace(tt.name, " ", "-", -1))
+			o := Options{RoutesFile: file, StateDir: stateDir}
+			if err := o.Run(Add, jet, &inventory.Flags{}, quiet); err != nil {
+				t.Fatal(err)
+			}
+
+			o.Delete = tt.flags
+			err := o.Run(Del, jet, &inventory.Flags{}, quiet)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("del: %v", err)
+			case tt.err != "" && (err == nil || err.Error() != tt.err):
+				t.Errorf("del: error %v, want %s", err, tt.err)
+			}
+			if got := rib(srv); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("router has\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestSyncConverges(t *testing.T) {
+	file := twoRoutes + v6Route + `
+[[route]]
+prefix = "10.124.0.0"
+length = 16
+nexthops = ["10.0.0.1", "10.0.0.2"]
+communities = ["64512:100", "no-export"]
+largeCommunities = ["large:64512:1:2"]
+med = 10
+routeType = "external"
+`
+	dir, err := ioutil.TempDir("", "bgproutes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, stateDir := range []string{"", dir} {
+		srv, jet := device(t)
+
+		if plan := programIn(t, jet, Sync, file, stateDir); plan.Count(Add) != 5 {
+			t.Errorf("first sync (state %q) added %d paths, want 5", stateDir, plan.Count(Add))
+		}
+		before := rib(srv)
+
+		// What the router gives back is the same as what went in, so there is nothing more to do
+		for i := 0; i < 2; i++ {
+			plan := programIn(t, jet, Sync, file, stateDir)
+			if len(plan.Changes) != 0 || plan.Unchanged != 5 || plan.Spared != 0 {
+				t.Errorf("sync %d (state %q): changes %q, %d unchanged, %d spared", i+2, stateDir, summary(plan), plan.Unchanged, plan.Spared)
+			}
+		}
+		if got := rib(srv); !reflect.DeepEqual(got, before) {
+			t.Errorf("state %q: router changed to\n%s\nfrom\n%s", stateDir, strings.Join(got, "\n"), strings.Join(before, "\n"))
+		}
+		srv.Stop()
+	}
+}
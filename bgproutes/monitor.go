@@ -0,0 +1,366 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetclient"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetlog"
+	routing "github.com/arsonistgopher/junos-jet-demo-apps/proto/bgp_route"
+)
+
+// Monitor events.
+const (
+	EventAdd      = "add"        // A path we had not seen before
+	EventModify   = "modify"     // A known path with new next hops or attributes
+	EventDelete   = "delete"     // A path went away
+	EventEndOfRib = "end-of-rib" // The router has sent every path it had when we registered
+)
+
+// minReconnect stops a zero -retry-backoff turning the reconnect loop in to a spin.
+const minReconnect = time.Second
+
+// Event is one change seen by StreamChanges. Path is nil for end-of-rib.
+type Event struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	*Path
+}
+
+// monitorFilter picks the paths StreamChanges reports. Unlike Get, no table means every table.
+type monitorFilter struct {
+	tables   map[string]bool // Empty means all
+	prefix   *net.IPNet      // Nil means all
+	orLonger bool
+	protocol string // -protocol name, or "any"
+}
+
+// filter builds the monitorFilter for q. Table may be a comma separated list.
+func (q *Query) filter() (*monitorFilter, error) {
+	if _, ok := protocols[q.Protocol]; !ok {
+		return nil, fmt.Errorf("unknown protocol %q, want static, bgp or any", q.Protocol)
+	}
+
+	f := &monitorFilter{tables: make(map[string]bool), orLonger: q.OrLonger, protocol: q.Protocol}
+	for _, t := range strings.Split(q.Table, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			f.tables[t] = true
+		}
+	}
+
+	if q.Prefix != "" {
+		ip, length, fam, err := parsePrefix(q.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		f.prefix = &net.IPNet{IP: ip, Mask: net.CIDRMask(int(length), int(fam.maxLen()))}
+	}
+
+	return f, nil
+}
+
+// match reports whether p is one of the paths the filter wants.
+func (f *monitorFilter) match(p *Path) bool {
+	if len(f.tables) > 0 && !f.tables[p.Table] {
+		return false
+	}
+	if f.protocol != "any" && p.Protocol != f.protocol {
+		return false
+	}
+	if f.prefix == nil {
+		return true
+	}
+
+	ip := net.ParseIP(p.Prefix)
+	if ip == nil {
+		return false
+	}
+	ones, bits := f.prefix.Mask.Size()
+	if (ip.To4() == nil) != (bits == 128) {
+		return false
+	}
+	if f.orLonger {
+		return int(p.Length) >= ones && f.prefix.Contains(ip)
+	}
+	return int(p.Length) == ones && ip.Equal(f.prefix.IP)
+}
+
+// monitor turns the raw notifications in to events. It remembers every path it
+// has reported so it can tell an add from a modify, and so that after a
+// reconnect it can stay quiet about paths that did not change while it was away
+// and report the ones that went.
+type monitor struct {
+	filter  *monitorFilter
+	known   map[string]Path // Reported paths, by pathID
+	resync  map[string]bool // Paths seen since registering, until end-of-rib
+	dumping bool            // Registered and waiting for end-of-rib
+	emit    func(Event) error
+}
+
+// pathID identifies one path: its table, prefix and cookie.
+func pathID(p *Path) string {
+	return fmt.Sprintf("%s %s/%d %d", p.Table, normalAddr(p.Prefix), p.Length, p.Cookie)
+}
+
+// registered is called every time the monitor RPC is set up. The router starts
+// by sending every route it has, then end-of-rib.
+func (m *monitor) registered() {
+	m.resync = make(map[string]bool)
+	m.dumping = true
+}
+
+// entry handles one notification from the router.
+func (m *monitor) entry(e *routing.BgpRouteMonitorEntry) error {
+	switch e.GetOperation() {
+	case routing.BgpRouteMonitorEntry_END_OF_RIBS:
+		return m.endOfRib()
+
+	case routing.BgpRouteMonitorEntry_ROUTE_UPDATE:
+		p := pathOf(e.GetBgpRoute())
+		if !m.filter.match(&p) {
+			return nil
+		}
+		id := pathID(&p)
+		if m.dumping {
+			m.resync[id] = true
+		}
+
+		old, ok := m.known[id]
+		m.known[id] = p
+		switch {
+		case !ok:
+			return m.emit(Event{Event: EventAdd, Path: &p})
+		case !reflect.DeepEqual(old, p):
+			return m.emit(Event{Event: EventModify, Path: &p})
+		}
+		return nil
+
+	case routing.BgpRouteMonitorEntry_ROUTE_REMOVE:
+		p := pathOf(e.GetBgpRoute())
+		if !m.filter.match(&p) {
+			return nil
+		}
+
+		// A remove may leave the cookie out, which means every path of the prefix
+		gone := m.forget(func(k *Path) bool {
+			return k.Table == p.Table && normalAddr(k.Prefix) == normalAddr(p.Prefix) && k.Length == p.Length &&
+				(p.Cookie == 0 || k.Cookie == p.Cookie)
+		})
+		if len(gone) == 0 {
+			// Never saw it, but it was asked for, so say so anyway
+			return m.emit(Event{Event: EventDelete, Path: &p})
+		}
+		for i := range gone {
+			if err := m.emit(Event{Event: EventDelete, Path: &gone[i]}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return nil
+}
+
+// endOfRib finishes the dump that follows registering. After a reconnect any
+// path we knew about that was not sent again went away while we were gone.
+func (m *monitor) endOfRib() error {
+	if !m.dumping {
+		return nil
+	}
+	m.dumping = false
+
+	gone := m.forget(func(k *Path) bool { return !m.resync[pathID(k)] })
+	m.resync = nil
+	for i := range gone {
+		if err := m.emit(Event{Event: EventDelete, Path: &gone[i]}); err != nil {
+			return err
+		}
+	}
+
+	return m.emit(Event{Event: EventEndOfRib})
+}
+
+// forget drops the known paths that gone picks and returns them in a stable order.
+func (m *monitor) forget(gone func(*Path) bool) []Path {
+	var ids []string
+	for id, p := range m.known {
+		if gone(&p) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	paths := make([]Path, 0, len(ids))
+	for _, id := range ids {
+		paths = append(paths, m.known[id])
+		delete(m.known, id)
+	}
+	return paths
+}
+
+// EventWriter returns a function that prints events to w, a line at a time:
+// text for the table output or JSON lines for json.
+func EventWriter(w io.Writer, output string) (func(Event) error, error) {
+	switch output {
+	case OutputTable:
+		return func(ev Event) error {
+			return writeEvent(w, ev)
+		}, nil
+	case OutputJSON:
+		enc := json.NewEncoder(w)
+		return func(ev Event) error {
+			return enc.Encode(ev)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown output %q for monitor, want table or json", output)
+	}
+}
+
+// writeEvent prints one event as a line of text. It can't line up with the
+// lines before it the way writeTable does, so it labels the attributes instead.
+func writeEvent(w io.Writer, ev Event) error {
+	ts := ev.Time.Format(time.RFC3339)
+	if ev.Path == nil {
+		_, err := fmt.Fprintf(w, "%s %s\n", ts, ev.Event)
+		return err
+	}
+
+	p := ev.Path
+	_, err := fmt.Fprintf(w, "%s %-6s %s %s/%d via %s %s cookie %d local-pref %s med %s as-path %s\n",
+		ts, ev.Event, p.Table, p.Prefix, p.Length, strings.Join(p.NextHops, ","), p.Protocol, p.Cookie,
+		optUint32(p.LocalPref), optUint32(p.MED), optString(p.AsPathStr))
+	return err
+}
+
+// StreamChanges connects to one device, registers for bgp_route notifications and
+// hands every change to the paths q selects to emit, until stop is closed. If
+// the stream breaks it connects again with the -retry backoff and carries on
+// where it left off: the router sends all of its routes again, StreamChanges keeps
+// quiet about the ones it already reported and reports a delete for any that
+// went while it was away. Only failing to connect the first time is an error.
+//
+// Monitoring needs BgpRouteInitialize like everything else, so give the
+// monitor its own -cid rather than the one the routes are programmed with.
+func StreamChanges(jet jetclient.Config, q *Query, emit func(Event) error, stop <-chan struct{}, logger *jetlog.Logger) error {
+	f, err := q.filter()
+	if err != nil {
+		return err
+	}
+
+	// Events carry the time we saw them; the notifications don't have one
+	m := &monitor{filter: f, known: make(map[string]Path), emit: func(ev Event) error {
+		ev.Time = time.Now()
+		if err := emit(ev); err != nil {
+			return emitError{err}
+		}
+		return nil
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	retry := jet.Retry
+	if retry.InitialBackoff < minReconnect {
+		retry.InitialBackoff = minReconnect
+	}
+
+	connected := false
+	for n := 1; ; n++ {
+		registered, err := m.run(ctx, jet, logger)
+		if ctx.Err() != nil {
+			logger.Info("Monitor stopped")
+			return nil
+		}
+		if e, ok := err.(emitError); ok {
+			// Nowhere to print to, so there is no point reconnecting
+			return e.err
+		}
+		if !connected && !registered {
+			return err
+		}
+		if registered {
+			connected = true
+			n = 1
+		}
+
+		logger.Warn("Monitor stream lost, reconnecting", "attempt", n, jetlog.KeyError, err)
+		if !retry.Sleep(ctx, n) {
+			logger.Info("Monitor stopped")
+			return nil
+		}
+	}
+}
+
+// emitError is a failure to hand on an event, as opposed to a problem with the stream.
+type emitError struct {
+	err error
+}
+
+func (e emitError) Error() string {
+	return e.err.Error()
+}
+
+// run makes one connection and reads notifications until the stream breaks. It
+// reports whether the monitor RPC was registered, which resets the backoff.
+func (m *monitor) run(ctx context.Context, jet jetclient.Config, logger *jetlog.Logger) (bool, error) {
+	session, err := dial(jet, logger)
+	if err != nil {
+		return false, err
+	}
+	defer session.Close()
+
+	// The default formats give addresses and table names as strings, which is
+	// what pathOf reads. The stream lives as long as ctx, not the -timeout.
+	stream, err := session.BgpRoute().BgpRouteMonitorRegister(ctx, &routing.BgpRouteMonitorRegRequest{})
+	if err != nil {
+		return false, fmt.Errorf("could not register for route notifications: %v", err)
+	}
+	m.registered()
+	logger.Info("Monitoring routes", jetlog.KeyRPC, "BgpRouteMonitorRegister", "known", len(m.known))
+
+	for {
+		reply, err := stream.Recv()
+		if err == io.EOF {
+			return true, fmt.Errorf("route notifications ended")
+		}
+		if err != nil {
+			return true, fmt.Errorf("route notifications: %v", err)
+		}
+
+		for _, e := range reply.GetMonitorReply() {
+			if err := m.entry(e); err != nil {
+				return true, err
+			}
+		}
+	}
+}
@@ -0,0 +1,411 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetclient"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetlog"
+	routing "github.com/arsonistgopher/junos-jet-demo-apps/proto/bgp_route"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+)
+
+// Change is one path that is added, modified, replaced or deleted.
+type Change struct {
+	Verb    Verb // Add, Mod, Replace or Del
+	Table   string
+	Prefix  string
+	Length  uint32
+	NextHop string // "*" when every path of the prefix is deleted, "* or longer" with everything under it
+	Cookie  uint64
+	Note    string // What is on the device now, when the plan was made against it
+	Err     error  // Why the change failed once the plan is applied, nil if it went in
+
+	entry    *routing.BgpRouteEntry // What to send for Add, Mod and Replace
+	match    *routing.BgpRouteMatch // What to send for Del
+	orLonger bool                   // Del takes everything more specific than match too
+}
+
+// Plan is the list of changes a run makes, in the order they are sent.
+type Plan struct {
+	Changes   []Change
+	Unchanged int // Paths sync found already right
+	Spared    int // Paths sync would have deleted, but couldn't show were ours
+
+	compared bool     // Made against what is on the device
+	kept     []Path   // The paths sync found already right
+	tables   []string // The tables sync read back, with every one of our paths in them in kept or Changes
+}
+
+// Count returns the number of changes with verb v.
+func (p *Plan) Count(v Verb) int {
+	n := 0
+	for _, c := range p.Changes {
+		if c.Verb == v {
+			n++
+		}
+	}
+	return n
+}
+
+// Print writes one line per change and a count of each kind to w.
+func (p *Plan) Print(w io.Writer) error {
+	if len(p.Changes) > 0 {
+		notes := false
+		for _, c := range p.Changes {
+			notes = notes || c.Note != ""
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		head := "ACTION\tTABLE\tPREFIX\tNEXT-HOP\tCOOKIE"
+		if notes {
+			head += "\tON DEVICE"
+		}
+		fmt.Fprintln(tw, head)
+		for _, c := range p.Changes {
+			line := fmt.Sprintf("%s\t%s\t%s/%d\t%s\t%d", c.Verb, c.Table, c.Prefix, c.Length, c.NextHop, c.Cookie)
+			if notes {
+				line += "\t" + c.Note
+			}
+			fmt.Fprintln(tw, line)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	counts := []string{fmt.Sprintf("%d to add", p.Count(Add)), fmt.Sprintf("%d to modify", p.Count(Mod))}
+	if n := p.Count(Replace); n > 0 {
+		counts = append(counts, fmt.Sprintf("%d to replace", n))
+	}
+	counts = append(counts, fmt.Sprintf("%d to delete", p.Count(Del)))
+	if p.compared {
+		counts = append(counts, fmt.Sprintf("%d unchanged", p.Unchanged))
+	}
+	if p.Spared > 0 {
+		counts = append(counts, fmt.Sprintf("%d not deleted, not recorded as ours", p.Spared))
+	}
+	_, err := fmt.Fprintln(w, strings.Join(counts, ", "))
+	return err
+}
+
+// batch is changes of one kind, sent in one RPC.
+type batch struct {
+	verb     Verb
+	orLonger bool // Del only: the request removes everything under each match
+	entries  []*routing.BgpRouteEntry
+	matches  []*routing.BgpRouteMatch
+	changes  []int // Index in Plan.Changes of each entry or match
+}
+
+// rpc names the RPC the batch is sent with.
+func (b *batch) rpc() string {
+	switch b.verb {
+	case Mod:
+		return "BgpRouteModify"
+	case Replace:
+		return "BgpRouteUpdate"
+	case Del:
+		return "BgpRouteRemove"
+	default:
+		return "BgpRouteAdd"
+	}
+}
+
+// request is the batch as the protobuf message that goes on the wire.
+func (b *batch) request() proto.Message {
+	if b.verb == Del {
+		return &routing.BgpRouteRemoveRequest{OrLonger: b.orLonger, BgpRoutes: b.matches}
+	}
+	return &routing.BgpRouteUpdateRequest{BgpRoutes: b.entries}
+}
+
+// batches groups the changes by kind, a batch each. Make before break: new paths go in
+// before old ones come out. OrLonger is set for a whole remove request, so the
+// or-longer deletes go in a batch of their own after the exact ones.
+func (p *Plan) batches() []batch {
+	kinds := []batch{{verb: Add}, {verb: Replace}, {verb: Mod}, {verb: Del}, {verb: Del, orLonger: true}}
+
+	var out []batch
+	for _, b := range kinds {
+		for i, c := range p.Changes {
+			if c.Verb != b.verb || c.orLonger != b.orLonger {
+				continue
+			}
+			if b.verb == Del {
+				b.matches = append(b.matches, c.match)
+			} else {
+				b.entries = append(b.entries, c.entry)
+			}
+			b.changes = append(b.changes, i)
+		}
+		if len(b.entries) > 0 || len(b.matches) > 0 {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// PrintRequests writes every request the plan sends to w as JSON, headed by the
+// RPC, cut up the way bt cuts them.
+func (p *Plan) PrintRequests(w io.Writer, bt Batching) error {
+	m := &jsonpb.Marshaler{OrigName: true, Indent: "  "}
+	for _, b := range p.batches() {
+		chunks := b.chunks(bt.Size)
+		for i, c := range chunks {
+			s, err := m.MarshalToString(c.request())
+			if err != nil {
+				return fmt.Errorf("%s request: %v", c.rpc(), err)
+			}
+			head := c.rpc()
+			if len(chunks) > 1 {
+				head = fmt.Sprintf("%s (%d of %d)", head, i+1, len(chunks))
+			}
+			if _, err := fmt.Fprintf(w, "\n%s:\n%s\n", head, s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// changeOf is the Change that sends e with verb.
+func changeOf(verb Verb, e *routing.BgpRouteEntry) Change {
+	p := pathOf(e)
+	return Change{
+		Verb:    verb,
+		Table:   p.Table,
+		Prefix:  p.Prefix,
+		Length:  p.Length,
+		NextHop: strings.Join(p.NextHops, ","),
+		Cookie:  e.GetPathCookie(),
+		entry:   e,
+	}
+}
+
+// planFor is the plan for running verb over rts. Without a State, cookies are
+// handed out in file order, the same every time, so the plan is exactly what
+// Program sends. With one, paths keep the cookies recorded for them and new
+// paths get new cookies.
+func (rts *Routes) planFor(verb Verb, st *State) (*Plan, error) {
+	// Without a State every run numbers its paths from the same place
+	cookie := firstCookie
+
+	entries, matches, err := rts.build(func(table, prefix string, length uint32, nextHop string) uint64 {
+		switch {
+		case st == nil:
+			cookie++
+			return cookie
+		case verb == Del:
+			// Deleting is no reason to hand out cookies; 0 means we never made it
+			c, _ := st.Cookie(table, prefix, length, nextHop)
+			return c
+		default:
+			return st.assign(table, prefix, length, nextHop)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{}
+	switch verb {
+	case Add, Mod, Replace:
+		for _, e := range entries {
+			plan.Changes = append(plan.Changes, changeOf(verb, e))
+		}
+	case Del:
+		// [[delete]]s say exactly what goes, instead of the routes
+		if len(rts.Deletes) > 0 {
+			plan.Changes, err = rts.deletes(st)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+
+		// With a State a route whose paths we all made loses exactly those
+		// paths. Otherwise every path of the prefix goes, as it always has.
+		ours := make(map[string][]Path)
+		for _, e := range entries {
+			p := pathOf(e)
+			k := routeKey(p.Table, p.Prefix, p.Length)
+			if p.Cookie == 0 {
+				ours[k] = nil
+				continue
+			}
+			if paths, ok := ours[k]; ok && paths == nil {
+				continue
+			}
+			ours[k] = append(ours[k], p)
+		}
+
+		for _, m := range matches {
+			c := routeDelChange(m)
+			paths := ours[routeKey(c.Table, c.Prefix, c.Length)]
+			if st == nil || len(paths) == 0 {
+				plan.Changes = append(plan.Changes, c)
+				continue
+			}
+			for _, p := range paths {
+				plan.Changes = append(plan.Changes, delChange(p))
+			}
+		}
+	case Sync:
+		return nil, fmt.Errorf("bgproutes: sync can only be planned against the device")
+	default:
+		return nil, fmt.Errorf("bgproutes: can't plan %v", verb)
+	}
+
+	return plan, nil
+}
+
+// routeKey identifies a route by its table and prefix.
+func routeKey(table, prefix string, length uint32) string {
+	return fmt.Sprintf("%s %s/%d", table, normalAddr(prefix), length)
+}
+
+// routeDelChange is the Change that removes every path of the route m matches.
+func routeDelChange(m *routing.BgpRouteMatch) Change {
+	prefix := m.GetDestPrefix().GetInet().GetAddrString()
+	if p6 := m.GetDestPrefix().GetInet6(); p6 != nil {
+		prefix = p6.GetAddrString()
+	}
+	return Change{
+		Verb:    Del,
+		Table:   m.GetTable().GetRttName().GetName(),
+		Prefix:  prefix,
+		Length:  m.GetDestPrefixLen(),
+		NextHop: "*",
+		match:   m,
+	}
+}
+
+// annotate notes against each change what is on the device now, so a reviewer
+// can see an add that will fail with ROUTE_EXISTS before it does.
+func (p *Plan) annotate(current []Path) {
+	p.compared = true
+
+	have := make(map[string]Path)
+	paths := make(map[string]int) // Installed paths per table and prefix
+	for _, c := range current {
+		k := pathKey(&c)
+		if _, ok := have[k]; !ok {
+			have[k] = c
+		}
+		paths[pathKey(&Path{Table: c.Table, Prefix: c.Prefix, Length: c.Length})]++
+	}
+
+	for i := range p.Changes {
+		c := &p.Changes[i]
+		if c.Verb == Del {
+			n := paths[pathKey(&Path{Table: c.Table, Prefix: c.Prefix, Length: c.Length})]
+			switch {
+			case c.orLonger:
+				n = 0
+				for j := range current {
+					if current[j].Table == c.Table && under(&current[j], c.Prefix, c.Length) {
+						n++
+					}
+				}
+				c.Note = fmt.Sprintf("%d paths installed under it", n)
+			case c.Cookie != 0:
+				c.Note = "not installed"
+				for _, cur := range current {
+					if cur.Table == c.Table && normalAddr(cur.Prefix) == normalAddr(c.Prefix) && cur.Length == c.Length && cur.Cookie == c.Cookie {
+						c.Note = "installed"
+						break
+					}
+				}
+			case n == 0:
+				c.Note = "not installed"
+			default:
+				c.Note = fmt.Sprintf("%d paths installed", n)
+			}
+			continue
+		}
+
+		want := pathOf(c.entry)
+		cur, ok := have[pathKey(&want)]
+		switch {
+		case !ok && c.Verb == Mod:
+			c.Note = "not installed, modify will fail"
+		case !ok:
+			c.Note = "new"
+		case c.Verb == Add:
+			c.Note = "already installed, add will fail"
+		case cur.Cookie != c.Cookie:
+			c.Note = fmt.Sprintf("installed with cookie %d", cur.Cookie)
+		case reflect.DeepEqual(cur.Attributes, want.Attributes):
+			c.Note = "no change"
+			p.Unchanged++
+		default:
+			c.Note = "attributes differ"
+		}
+	}
+}
+
+// DryRun works out what verb would do with rts without connecting to anything.
+// The cookies come from st, if there is one, as they would for real, but st
+// isn't changed on disk.
+func DryRun(rts *Routes, verb Verb, st *State) (*Plan, error) {
+	return rts.planFor(verb, st)
+}
+
+// PlanAgainstDevice connects to one device and works out what verb would do
+// there, without changing anything. For sync that is the real sync plan; for
+// the other verbs each change is marked with what is installed now.
+func PlanAgainstDevice(jet jetclient.Config, rts *Routes, verb Verb, stateDir string, logger *jetlog.Logger) (*Plan, error) {
+	// Read, never saved
+	st, err := openState(stateDir, jet, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer st.Close()
+
+	var plan *Plan
+	if verb != Sync {
+		if plan, err = rts.planFor(verb, st); err != nil {
+			return nil, err
+		}
+	}
+
+	session, err := dial(jet, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer logger.Info("Closing connection")
+	defer session.Close()
+
+	if verb == Sync {
+		return rts.plan(session, st, logger)
+	}
+
+	current, err := readTables(session, rts.planTables(st), logger)
+	if err != nil {
+		return nil, err
+	}
+	plan.annotate(current)
+
+	return plan, nil
+}
@@ -0,0 +1,239 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetclient"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetlog"
+	routing "github.com/arsonistgopher/junos-jet-demo-apps/proto/bgp_route"
+	jnxType "github.com/arsonistgopher/junos-jet-demo-apps/proto/jnx_addr"
+	prpd "github.com/arsonistgopher/junos-jet-demo-apps/proto/prpd_common"
+)
+
+// Verb is what to do with the routes.
+type Verb int
+
+// Verbs
+const (
+	Add     Verb = iota // Add the routes
+	Del                 // Delete the routes
+	Mod                 // Change the attributes of paths that are already there
+	Replace             // Add the paths, or overwrite them if they are already there
+	Get                 // Read the routes back from the router
+	Sync                // Add, modify and delete until the router matches the file
+	Daemon              // Keep syncing whenever the file changes
+	Monitor             // Print route changes on the router as they happen
+	Cleanup             // Withdraw every route this client ID has programmed
+	Purge               // Commit the purge-timeout, the one time
+)
+
+var verbNames = []string{"add", "del", "mod", "replace", "get", "sync", "daemon", "monitor", "cleanup", "purge-timeout"}
+
+func (v Verb) String() string {
+	if v < 0 || int(v) >= len(verbNames) {
+		return fmt.Sprintf("verb(%d)", int(v))
+	}
+	return verbNames[v]
+}
+
+// VerbNames returns the names ParseVerb takes, in Verb order, for help text.
+func VerbNames() []string {
+	return append([]string(nil), verbNames...)
+}
+
+// ParseVerb turns "add", "del", "mod", "replace", "get", "sync", "daemon", "monitor", "cleanup" or "purge-timeout" into a Verb.
+// "list" is taken as another name for "get".
+func ParseVerb(s string) (Verb, error) {
+	if s == "list" {
+		return Get, nil
+	}
+	for i, n := range verbNames {
+		if s == n {
+			return Verb(i), nil
+		}
+	}
+	return Add, fmt.Errorf("bgproutes: unknown verb %q, want %s", s, strings.Join(verbNames, ", "))
+}
+
+// Program connects to one device and adds, deletes, modifies or replaces the routes in rts,
+// in requests cut up as bt says. The plan comes back with the outcome of every
+// change once it has been sent, even if some failed; it is nil if nothing was sent.
+//
+// Without a stateDir, path cookies are handed out in file order, so a mod or
+// replace finds the paths an earlier add installed as long as routes and next
+// hops keep their order, and a del takes out every path of each prefix. With
+// one, the cookies come from the device's State and are saved there afterwards.
+func Program(jet jetclient.Config, rts *Routes, verb Verb, bt Batching, stateDir string, logger *jetlog.Logger) (*Plan, error) {
+	st, err := openState(stateDir, jet, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer st.Close()
+
+	plan, err := rts.planFor(verb, st)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := dial(jet, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer logger.Info("Closing connection")
+	defer session.Close()
+
+	err = plan.apply(session, bt, logger)
+	if serr := plan.record(st); serr != nil {
+		logger.Error("Unable to save the state", jetlog.KeyError, serr)
+		if err == nil {
+			err = serr
+		}
+	}
+
+	return plan, err
+}
+
+// dial connects and logs in to one device and binds to the bgp_route service.
+// The caller closes the session.
+func dial(jet jetclient.Config, logger *jetlog.Logger) (*jetclient.Session, error) {
+	// Connect and login
+	jet.Logger = logger
+	session, err := jetclient.Dial(jet)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Connect: SUCCESS")
+
+	bgpInitReply, err := session.BgpRouteInitialize()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	logger.Info("BGP Route API Init", "status", bgpInitReply.String())
+
+	return session, nil
+}
+
+// routeTable is the RouteTable for a table name.
+func routeTable(name string) *prpd.RouteTable {
+	rttname := &prpd.RouteTableName{Name: name}
+	rtt := &prpd.RouteTable_RttName{RttName: rttname}
+	return &prpd.RouteTable{RtTableFormat: rtt}
+}
+
+// build turns rts in to one BgpRouteEntry per path, for adds, and one BgpRouteMatch
+// per route, for deletion. cookie hands out the path cookies, given the table,
+// prefix, length and next hop of each path.
+func (rts *Routes) build(cookie func(table, prefix string, length uint32, nextHop string) uint64) ([]*routing.BgpRouteEntry, []*routing.BgpRouteMatch, error) {
+	// Create slice of BgpRouteEntrys (for adds)
+	var rtaddslice []*routing.BgpRouteEntry
+
+	// Create a slice of BgpRouteMatches (for deletion)
+	var rtdelslice []*routing.BgpRouteMatch
+
+	// Let's build the slice of routes for adding and deletion
+	for _, r := range rts.Routes {
+		// Checked by Load already, so this only fails for hand built Routes
+		f, err := r.Family()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		table := rts.Table(&r, f)
+		rtTable := routeTable(table)
+		inetPrefix := getPrefix(r.Prefix, f)
+
+		// Build the BgpRouteMatch var for deletion
+		bgprm := &routing.BgpRouteMatch{DestPrefix: inetPrefix, DestPrefixLen: r.Length, Table: rtTable, Protocol: routing.RouteProtocol_PROTO_BGP_STATIC, PathCookie: 0}
+		// Add the BgpRouteMatch var to the slice (so we can delete "all the routes!"")
+		rtdelslice = append(rtdelslice, bgprm)
+
+		// Build next hop table for adds
+		for _, nh := range r.Paths() {
+			nhAddr := &jnxType.IpAddress{AddrFormat: &jnxType.IpAddress_AddrString{AddrString: nh.Address}}
+			nhAddrSlice := []*jnxType.IpAddress{nhAddr}
+
+			routeParams := &routing.BgpRouteEntry{
+				DestPrefix:       inetPrefix,
+				DestPrefixLen:    r.Length,
+				Table:            rtTable,
+				ProtocolNexthops: nhAddrSlice,
+				Protocol:         routing.RouteProtocol_PROTO_BGP_STATIC,
+				PathCookie:       cookie(table, r.Prefix, r.Length, nh.Address),
+			}
+			attrs := rts.PathAttributes(&r, &nh)
+			attrs.apply(routeParams)
+
+			rtaddslice = append(rtaddslice, routeParams)
+		}
+	}
+
+	return rtaddslice, rtdelslice, nil
+}
+
+// send makes one RPC for the batch: its entries are added, modified or replaced,
+// or its matches are deleted. The reply says how far the router got; only a
+// failed RPC is an error.
+func send(session *jetclient.Session, b *batch, logger *jetlog.Logger) (*routing.BgpRouteOperReply, error) {
+	bgpc := session.BgpRoute()
+	routeUpdReq := &routing.BgpRouteUpdateRequest{BgpRoutes: b.entries}
+
+	ctx, cancel := session.Context()
+	defer cancel()
+
+	var (
+		rpc    string
+		result *routing.BgpRouteOperReply
+		err    error
+		count  = len(b.entries)
+	)
+	start := time.Now()
+
+	switch b.verb {
+	case Add:
+		rpc = "BgpRouteAdd"
+		result, err = bgpc.BgpRouteAdd(ctx, routeUpdReq)
+	case Mod:
+		// Modify only touches paths that exist; a missing one is an error from the router
+		rpc = "BgpRouteModify"
+		result, err = bgpc.BgpRouteModify(ctx, routeUpdReq)
+	case Replace:
+		// Update adds the paths that aren't there and overwrites the ones that are
+		rpc = "BgpRouteUpdate"
+		result, err = bgpc.BgpRouteUpdate(ctx, routeUpdReq)
+	case Del:
+		rpc = "BgpRouteRemove"
+		count = len(b.matches)
+		// OrLonger takes everything more specific than each match too
+		removeRequest := &routing.BgpRouteRemoveRequest{OrLonger: b.orLonger, BgpRoutes: b.matches}
+		result, err = bgpc.BgpRouteRemove(ctx, removeRequest)
+	default:
+		return nil, fmt.Errorf("bgproutes: can't %v routes with Program", b.verb)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not %s routes: %v", b.verb, err)
+	}
+
+	logger.Info("Result", jetlog.KeyRPC, rpc, "status", result.Status, "routes", count, "completed", result.GetOperationsCompleted(), jetlog.KeyDuration, time.Since(start))
+
+	return result, nil
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package bgproutes programs BGP-Static routes described in a TOML, YAML, JSON or CSV file in to
+// Junos over the JET bgp_route API. It is the engine behind bgp_static_routes
+// and "jetctl route".
+package bgproutes
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Route is one [[route]] in the routes file. Table and Instance override the ones
+// in [basics], and so do any attributes set on the route or in its profile.
+type Route struct {
+	Prefix     string    `toml:"prefix" json:"prefix" yaml:"prefix"`
+	Length     uint32    `toml:"length" json:"length" yaml:"length"`
+	NextHops   []string  `toml:"nexthops" json:"nexthops,omitempty" yaml:"nexthops,omitempty"`           // Next hops that take the route's attributes
+	NextHop    []NextHop `toml:"nexthop" json:"nexthop,omitempty" yaml:"nexthop,omitempty"`              // Next hops with attributes of their own
+	Table      string    `toml:"table,omitempty" json:"table,omitempty" yaml:"table,omitempty"`          // Routing table, e.g. CUST-A.inet.0
+	Instance   string    `toml:"instance,omitempty" json:"instance,omitempty" yaml:"instance,omitempty"` // Routing instance; the table is picked by family
+	Profile    string    `toml:"profile,omitempty" json:"profile,omitempty" yaml:"profile,omitempty"`    // Named [profile.<name>] applied before the route's own attributes
+	Attributes `yaml:",inline"`
+}
+
+// NextHop is one [[route.nexthop]]: a next hop with its own profile and attributes
+// layered on top of the route's.
+type NextHop struct {
+	Address    string `toml:"address" json:"address" yaml:"address"`
+	Profile    string `toml:"profile,omitempty" json:"profile,omitempty" yaml:"profile,omitempty"`
+	Attributes `yaml:",inline"`
+}
+
+// Paths returns every next hop of the route, the plain ones first.
+func (r *Route) Paths() []NextHop {
+	paths := make([]NextHop, 0, len(r.NextHops)+len(r.NextHop))
+	for _, n := range r.NextHops {
+		paths = append(paths, NextHop{Address: n})
+	}
+	return append(paths, r.NextHop...)
+}
+
+// Basics are the [basics] attributes shared by every route in the file.
+type Basics struct {
+	Attributes `yaml:",inline"`
+	Table      string `toml:"table" json:"table,omitempty" yaml:"table,omitempty"`          // Routing table for every route, e.g. CUST-A.inet.0
+	Instance   string `toml:"instance" json:"instance,omitempty" yaml:"instance,omitempty"` // Routing instance for every route; the table is picked by family
+}
+
+// Routes is the decoded routes file. The YAML and JSON forms use the same keys as the TOML.
+type Routes struct {
+	Basics   Basics                `json:"basics" yaml:"basics"`
+	Profiles map[string]Attributes `toml:"profile" json:"profile,omitempty" yaml:"profile,omitempty"`
+	Routes   []Route               `toml:"route" json:"route" yaml:"route"`
+	Deletes  []Selector            `toml:"delete" json:"delete,omitempty" yaml:"delete,omitempty"` // What del removes, when there are any
+}
+
+// Validate checks every route, so that a mistake is found before any router is touched.
+func (rts *Routes) Validate() error {
+	if rts.Basics.Table != "" && rts.Basics.Instance != "" {
+		return errors.New("basics: give table or instance, not both")
+	}
+	if err := rts.Basics.Attributes.Validate(); err != nil {
+		return fmt.Errorf("basics: %v", err)
+	}
+	for name, p := range rts.Profiles {
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("profile %s: %v", name, err)
+		}
+	}
+
+	for i := range rts.Routes {
+		r := &rts.Routes[i]
+		f, err := r.Family()
+		if err != nil {
+			return err
+		}
+
+		if err := rts.checkProfile(r.Profile); err != nil {
+			return fmt.Errorf("route %s/%d: %v", r.Prefix, r.Length, err)
+		}
+		if err := r.Attributes.Validate(); err != nil {
+			return fmt.Errorf("route %s/%d: %v", r.Prefix, r.Length, err)
+		}
+		for _, nh := range r.NextHop {
+			if err := rts.checkProfile(nh.Profile); err != nil {
+				return fmt.Errorf("route %s/%d next hop %s: %v", r.Prefix, r.Length, nh.Address, err)
+			}
+			if err := nh.Attributes.Validate(); err != nil {
+				return fmt.Errorf("route %s/%d next hop %s: %v", r.Prefix, r.Length, nh.Address, err)
+			}
+		}
+
+		if r.Table != "" && r.Instance != "" {
+			return fmt.Errorf("route %s/%d: give table or instance, not both", r.Prefix, r.Length)
+		}
+		table := rts.Table(r, f)
+		if tf, ok := tableFamily(table); ok && tf != f {
+			return fmt.Errorf("route %s/%d: %s route can't go in table %s", r.Prefix, r.Length, f, table)
+		}
+	}
+
+	for i := range rts.Deletes {
+		if err := rts.validateSelector(&rts.Deletes[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkProfile makes sure a profile reference points somewhere.
+func (rts *Routes) checkProfile(name string) error {
+	if name == "" {
+		return nil
+	}
+	if _, ok := rts.Profiles[name]; !ok {
+		return fmt.Errorf("unknown profile %q", name)
+	}
+	return nil
+}
+
+// PathAttributes returns the attributes for one next hop of r. Each layer
+// overrides the one before: [basics], the route's profile, the route, the next
+// hop's profile and then the next hop itself.
+func (rts *Routes) PathAttributes(r *Route, nh *NextHop) Attributes {
+	a := rts.Basics.Attributes
+	if p, ok := rts.Profiles[r.Profile]; ok {
+		a = a.Merge(&p)
+	}
+	a = a.Merge(&r.Attributes)
+	if p, ok := rts.Profiles[nh.Profile]; ok {
+		a = a.Merge(&p)
+	}
+	return a.Merge(&nh.Attributes)
+}
+
+// Table returns the routing table for r, which is of family f. The route's own
+// table or instance wins over the one in [basics], and an instance means its
+// table for the family, so instance CUST-A holds IPv6 routes in CUST-A.inet6.0.
+func (rts *Routes) Table(r *Route, f Family) string {
+	switch {
+	case r.Table != "":
+		return r.Table
+	case r.Instance != "":
+		return r.Instance + "." + f.DefaultTable()
+	case rts.Basics.Table != "":
+		return rts.Basics.Table
+	case rts.Basics.Instance != "":
+		return rts.Basics.Instance + "." + f.DefaultTable()
+	default:
+		return f.DefaultTable()
+	}
+}
+
+// tableFamily works out the family of a table from its name, e.g. CUST-A.inet6.0
+// is inet6. Tables of other kinds are not checked.
+func tableFamily(table string) (Family, bool) {
+	parts := strings.Split(table, ".")
+	if len(parts) < 2 {
+		return Inet, false
+	}
+	switch parts[len(parts)-2] {
+	case "inet":
+		return Inet, true
+	case "inet6":
+		return Inet6, true
+	default:
+		return Inet, false
+	}
+}
@@ -0,0 +1,279 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetclient"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetlog"
+)
+
+// firstCookie is where a new state starts handing out cookies. It is where a
+// plan without a state starts too, so the first add with a state gets the same
+// cookies as it always did without one.
+const firstCookie = uint64(12345678)
+
+// unsafeName matches the characters a device name can't have in a file name.
+var unsafeName = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// State is the path cookies handed out on one device, kept on disk between runs
+// so that a del, mod or replace finds the exact paths an earlier add or sync
+// made. It is locked from OpenState to Close, so two runs against the same
+// device take turns rather than handing out the same cookie twice.
+//
+// The file is TOML, one table per routing table, keyed by prefix and next hop:
+//
+//	next_cookie = 12345690
+//
+//	[table."inet.0"]
+//	"10.123.0.0/24 10.0.0.1" = 12345679
+type State struct {
+	Next   uint64                       `toml:"next_cookie"` // Last cookie handed out
+	Tables map[string]map[string]uint64 `toml:"table"`       // Table, then path, to cookie
+
+	file   string
+	unlock func() error    // Lets go of the lock
+	used   map[uint64]bool // Every cookie in Tables
+}
+
+// OpenState locks and loads the state for device in dir, making both if they
+// aren't there. It waits for any other run holding the lock.
+func OpenState(dir, device string, logger *jetlog.Logger) (*State, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("bgproutes: state directory: %v", err)
+	}
+
+	base := filepath.Join(dir, unsafeName.ReplaceAllString(device, "_"))
+	unlock, err := lockState(base+".lock", base+".toml", logger)
+	if err != nil {
+		return nil, fmt.Errorf("bgproutes: state lock: %v", err)
+	}
+
+	s := &State{Next: firstCookie, Tables: make(map[string]map[string]uint64), file: base + ".toml", unlock: unlock}
+	if _, err := toml.DecodeFile(s.file, s); err != nil && !os.IsNotExist(err) {
+		s.Close()
+		return nil, fmt.Errorf("bgproutes: state %s: %v", s.file, err)
+	}
+
+	s.used = make(map[uint64]bool)
+	for _, paths := range s.Tables {
+		for _, c := range paths {
+			s.used[c] = true
+		}
+	}
+
+	return s, nil
+}
+
+// openState opens the state for the device jet connects to. No dir means no
+// state, and a nil *State, which every method copes with.
+func openState(dir string, jet jetclient.Config, logger *jetlog.Logger) (*State, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	return OpenState(dir, jet.Target(), logger)
+}
+
+// statePath is how a path is keyed within its table.
+func statePath(prefix string, length uint32, nextHop string) string {
+	nhs := strings.Split(nextHop, ",")
+	for i := range nhs {
+		nhs[i] = normalAddr(nhs[i])
+	}
+	return fmt.Sprintf("%s/%d %s", normalAddr(prefix), length, strings.Join(nhs, ","))
+}
+
+// family works out the family of a table paths are recorded in, from its name
+// or else from the paths.
+func (s *State) family(table string) (Family, bool) {
+	if f, ok := tableFamily(table); ok {
+		return f, true
+	}
+	for k := range s.Tables[table] {
+		// Keys are "prefix/length nexthop"
+		if _, _, f, err := parsePrefix(strings.SplitN(k, " ", 2)[0]); err == nil {
+			return f, true
+		}
+	}
+	return Inet, false
+}
+
+// Cookie returns the cookie recorded for a path, if there is one.
+func (s *State) Cookie(table, prefix string, length uint32, nextHop string) (uint64, bool) {
+	if s == nil {
+		return 0, false
+	}
+	c, ok := s.Tables[table][statePath(prefix, length, nextHop)]
+	return c, ok
+}
+
+// assign returns the cookie recorded for a path, or a new one nobody has. A new
+// cookie is only recorded once the path is known to be on the router.
+func (s *State) assign(table, prefix string, length uint32, nextHop string) uint64 {
+	if c, ok := s.Cookie(table, prefix, length, nextHop); ok {
+		return c
+	}
+	return s.fresh(nil)
+}
+
+// fresh returns a cookie that has never been handed out from the State, and
+// isn't in skip either.
+func (s *State) fresh(skip map[uint64]bool) uint64 {
+	for {
+		s.Next++
+		if !s.used[s.Next] && !skip[s.Next] {
+			s.used[s.Next] = true
+			return s.Next
+		}
+	}
+}
+
+// Record notes that the path is on the router with cookie.
+func (s *State) Record(table, prefix string, length uint32, nextHop string, cookie uint64) {
+	if s == nil {
+		return
+	}
+	if s.Tables[table] == nil {
+		s.Tables[table] = make(map[string]uint64)
+	}
+	s.Tables[table][statePath(prefix, length, nextHop)] = cookie
+	s.used[cookie] = true
+}
+
+// Forget drops one path. A next hop of "*" drops every path of the prefix.
+func (s *State) Forget(table, prefix string, length uint32, nextHop string) {
+	if s == nil {
+		return
+	}
+	paths := s.Tables[table]
+	if nextHop != "*" {
+		delete(paths, statePath(prefix, length, nextHop))
+	} else {
+		route := fmt.Sprintf("%s/%d ", normalAddr(prefix), length)
+		for k := range paths {
+			if strings.HasPrefix(k, route) {
+				delete(paths, k)
+			}
+		}
+	}
+	if len(paths) == 0 {
+		delete(s.Tables, table)
+	}
+}
+
+// ForgetUnder drops every path of the prefix and of everything more specific.
+func (s *State) ForgetUnder(table, prefix string, length uint32) {
+	if s == nil {
+		return
+	}
+	paths := s.Tables[table]
+	for k := range paths {
+		// Keys are "prefix/length nexthop"
+		route := strings.SplitN(k, " ", 2)[0]
+		ip, l, _, err := parsePrefix(route)
+		if err == nil && under(&Path{Prefix: ip.String(), Length: l}, prefix, length) {
+			delete(paths, k)
+		}
+	}
+	if len(paths) == 0 {
+		delete(s.Tables, table)
+	}
+}
+
+// Clear forgets every path, after they have all been withdrawn.
+func (s *State) Clear() {
+	if s == nil {
+		return
+	}
+	s.Tables = make(map[string]map[string]uint64)
+}
+
+// Save writes the state back. The file is replaced in one go, so a run that
+// dies half way through leaves the old state rather than half of a new one.
+func (s *State) Save() error {
+	if s == nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(s); err != nil {
+		return fmt.Errorf("bgproutes: state %s: %v", s.file, err)
+	}
+
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("bgproutes: state %s: %v", s.file, err)
+	}
+	if err := os.Rename(tmp, s.file); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("bgproutes: state %s: %v", s.file, err)
+	}
+	return nil
+}
+
+// Close lets go of the lock.
+func (s *State) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.unlock()
+}
+
+// record brings the state in line with a plan that has been applied: the paths
+// that went in are recorded with their cookies and the ones deleted are
+// forgotten. Changes that failed leave the state alone. After a sync, which
+// reads the whole of each table, those tables are started afresh with what of
+// ours the device has: the paths found already right and the ones a failed
+// modify left where they were. Then the state is saved.
+func (p *Plan) record(s *State) error {
+	if s == nil {
+		return nil
+	}
+
+	for _, t := range p.tables {
+		delete(s.Tables, t)
+	}
+	for _, k := range p.kept {
+		s.Record(k.Table, k.Prefix, k.Length, hopsKey(k.NextHops), k.Cookie)
+	}
+	for _, c := range p.Changes {
+		if c.Err != nil {
+			if p.compared && c.Verb == Mod {
+				s.Record(c.Table, c.Prefix, c.Length, c.NextHop, c.Cookie)
+			}
+			continue
+		}
+		switch {
+		case c.Verb == Del && c.orLonger:
+			s.ForgetUnder(c.Table, c.Prefix, c.Length)
+		case c.Verb == Del:
+			s.Forget(c.Table, c.Prefix, c.Length, c.NextHop)
+		default:
+			s.Record(c.Table, c.Prefix, c.Length, c.NextHop, c.Cookie)
+		}
+	}
+
+	return s.Save()
+}
@@ -0,0 +1,50 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetlog"
+)
+
+// lockState takes an exclusive flock on the file at path, waiting for whoever
+// has it. The lock goes with the file descriptor, so closing it or exiting
+// gives it up; the file itself stays for next time.
+func lockState(path, state string, logger *jetlog.Logger) (func() error, error) {
+	lock, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	// Say why we're stuck if someone else has it
+	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		logger.Info("Waiting for another run to finish with the state", "file", state)
+		err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX)
+	}
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	return lock.Close, nil
+}
@@ -0,0 +1,64 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStateLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bgproutes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := OpenState(dir, "vmx01", quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second run against the same device waits for the first to finish
+	opened := make(chan *State)
+	go func() {
+		next, err := OpenState(dir, "vmx01", quiet)
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- next
+	}()
+
+	select {
+	case <-opened:
+		t.Fatal("the state was opened twice at once")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	st.Close()
+	select {
+	case next := <-opened:
+		next.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the state wasn't opened once it was let go")
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetlog"
+)
+
+// staleLock is how old a lock file has to be before it is taken over, even
+// though the process that made it may still be running. No run holds the state
+// anywhere near that long.
+const staleLock = time.Hour
+
+// lockPoll is how often a run waiting for the lock file looks again.
+const lockPoll = 100 * time.Millisecond
+
+// lockExclusive locks by creating the file at path, which fails while another
+// run has it, and waits until it can. The file holds the process ID, so a lock
+// left behind by a run that died is found and taken over. Unlocking removes it.
+// It works anywhere, for platforms without flock.
+func lockExclusive(path, state string, logger *jetlog.Logger) (func() error, error) {
+	waiting := false
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			return func() error { return os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if fi, ok := staleLockFile(path); ok {
+			// Only remove it if it is still the file we looked at, not one a
+			// run waiting alongside us has just made
+			if now, err := os.Stat(path); err == nil && os.SameFile(fi, now) {
+				logger.Warn("Taking over the state lock from a run that has gone", "file", path)
+				if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		// Say why we're stuck if someone else has it
+		if !waiting {
+			logger.Info("Waiting for another run to finish with the state", "file", state)
+			waiting = true
+		}
+		time.Sleep(lockPoll)
+	}
+}
+
+// staleLockFile reports whether the lock file at path was left by a run that
+// has gone: its process isn't there any more, or it is older than staleLock.
+func staleLockFile(path string) (os.FileInfo, bool) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		// Gone already, so the next try takes it
+		return nil, false
+	}
+	if time.Since(fi.ModTime()) > staleLock {
+		return fi, true
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		// A run that is starting may not have written its ID yet
+		return fi, time.Since(fi.ModTime()) > 10*time.Second
+	}
+	return fi, !running(pid)
+}
+
+// running reports whether process pid is still there. On Windows finding a
+// process that has exited fails; elsewhere it always works, so only the age of
+// the lock file counts.
+func running(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockExclusive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bgproutes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "vmx01.lock")
+
+	unlock, err := lockExclusive(path, "vmx01.toml", quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second run waits for the first to finish
+	locked := make(chan func() error)
+	go func() {
+		next, err := lockExclusive(path, "vmx01.toml", quiet)
+		if err != nil {
+			t.Error(err)
+		}
+		locked <- next
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("locked twice at once")
+	case <-time.After(3 * lockPoll):
+	}
+
+	if err := unlock(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case next := <-locked:
+		if err := next(); err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not locked once it was let go")
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("lock file left behind: %v", err)
+	}
+}
+
+func TestLockExclusiveStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bgproutes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		age     time.Duration
+	}{
+		{name: "too old", content: fmt.Sprintf("%d\n", os.Getpid()), age: staleLock + time.Minute},
+		{name: "never written", content: "", age: time.Minute},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name+".lock")
+		if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		then := time.Now().Add(-tt.age)
+		if err := os.Chtimes(path, then, then); err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			unlock, err := lockExclusive(path, "vmx01.toml", quiet)
+			if err == nil {
+				err = unlock()
+			}
+			done <- err
+		}()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: the lock left behind wasn't taken over", tt.name)
+		}
+	}
+
+	// A lock a run is still holding is not
+	path := filepath.Join(dir, "held.lock")
+	if err := ioutil.WriteFile(path, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, stale := staleLockFile(path); stale {
+		t.Error("a fresh lock of a running process is stale")
+	}
+}
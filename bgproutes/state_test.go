@@ -0,0 +1,253 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// recorded lists what a state has, as "table path cookie", sorted.
+func recorded(st *State) []string {
+	var out []string
+	for table, paths := range st.Tables {
+		for k, c := range paths {
+			out = append(out, fmt.Sprintf("%s %s %d", table, k, c))
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bgproutes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := OpenState(dir, "vmx01:32767", quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Record("inet.0", "10.123.0.0", 24, "10.0.0.1", st.assign("inet.0", "10.123.0.0", 24, "10.0.0.1"))
+	st.Record("inet6.0", "2001:DB8:0::", 48, "2001:db8::1,2001:db8::2", st.assign("inet6.0", "2001:db8::", 48, "2001:db8::1,2001:db8::2"))
+	if err := st.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The device name is made safe for a file name
+	if _, err := os.Stat(filepath.Join(dir, "vmx01_32767.toml")); err != nil {
+		t.Errorf("state file: %v", err)
+	}
+
+	st, err = OpenState(dir, "vmx01:32767", quiet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	want := []string{
+		fmt.Sprintf("inet.0 10.123.0.0/24 10.0.0.1 %d", firstCookie+1),
+		fmt.Sprintf("inet6.0 2001:db8::/48 2001:db8::1,2001:db8::2 %d", firstCookie+2),
+	}
+	if got := recorded(st); !reflect.DeepEqual(got, want) {
+		t.Errorf("reloaded\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if st.Next != firstCookie+2 {
+		t.Errorf("next cookie %d, want %d", st.Next, firstCookie+2)
+	}
+
+	// Addresses are compared by value, not by how they are written
+	if c, ok := st.Cookie("inet6.0", "2001:db8:0:0::", 48, "2001:DB8::1,2001:db8:0::2"); !ok || c != firstCookie+2 {
+		t.Errorf("cookie %d %v, want %d", c, ok, firstCookie+2)
+	}
+}
+
+func TestStateAssign(t *testing.T) {
+	st, done := testState(t)
+	defer done()
+
+	first := st.assign("inet.0", "10.123.0.0", 24, "10.0.0.1")
+	if first != firstCookie+1 {
+		t.Errorf("first cookie %d, want %d", first, firstCookie+1)
+	}
+
+	// A path that was never recorded gets a new cookie each time it is asked for
+	if again := st.assign("inet.0", "10.123.0.0", 24, "10.0.0.1"); again == first {
+		t.Errorf("unrecorded path got cookie %d again", again)
+	}
+
+	// A recorded one keeps its cookie, and nobody else gets it
+	st.Record("inet.0", "10.123.1.0", 24, "10.0.0.1", firstCookie+3)
+	if c := st.assign("inet.0", "10.123.1.0", 24, "10.0.0.1"); c != firstCookie+3 {
+		t.Errorf("recorded path got cookie %d, want %d", c, firstCookie+3)
+	}
+	if c := st.assign("inet.0", "10.123.2.0", 24, "10.0.0.1"); c != firstCookie+4 {
+		t.Errorf("new path got cookie %d, want %d past the recorded one", c, firstCookie+4)
+	}
+}
+
+func TestStateForget(t *testing.T) {
+	fill := func(st *State) {
+		st.Record("inet.0", "10.123.0.0", 16, "10.0.0.1", 1)
+		st.Record("inet.0", "10.123.0.0", 24, "10.0.0.1", 2)
+		st.Record("inet.0", "10.123.0.0", 24, "10.0.0.2", 3)
+		st.Record("inet.0", "10.124.0.0", 24, "10.0.0.1", 4)
+		st.Record("CUST-A.inet.0", "10.123.0.0", 24, "10.0.0.1", 5)
+	}
+
+	tests := []struct {
+		name   string
+		forget func(st *State)
+		want   []string
+	}{
+		{
+			name:   "one path",
+			forget: func(st *State) { st.Forget("inet.0", "10.123.0.0", 24, "10.0.0.2") },
+			want:   []string{"CUST-A.inet.0 10.123.0.0/24 10.0.0.1 5", "inet.0 10.123.0.0/16 10.0.0.1 1", "inet.0 10.123.0.0/24 10.0.0.1 2", "inet.0 10.124.0.0/24 10.0.0.1 4"},
+		},
+		{
+			name:   "every path of a prefix",
+			forget: func(st *State) { st.Forget("inet.0", "10.123.0.0", 24, "*") },
+			want:   []string{"CUST-A.inet.0 10.123.0.0/24 10.0.0.1 5", "inet.0 10.123.0.0/16 10.0.0.1 1", "inet.0 10.124.0.0/24 10.0.0.1 4"},
+		},
+		{
+			name:   "or longer",
+			forget: func(st *State) { st.ForgetUnder("inet.0", "10.123.0.0", 16) },
+			want:   []string{"CUST-A.inet.0 10.123.0.0/24 10.0.0.1 5", "inet.0 10.124.0.0/24 10.0.0.1 4"},
+		},
+		{
+			name:   "the last path takes the table with it",
+			forget: func(st *State) { st.Forget("CUST-A.inet.0", "10.123.0.0", 24, "10.0.0.1") },
+			want:   []string{"inet.0 10.123.0.0/16 10.0.0.1 1", "inet.0 10.123.0.0/24 10.0.0.1 2", "inet.0 10.123.0.0/24 10.0.0.2 3", "inet.0 10.124.0.0/24 10.0.0.1 4"},
+		},
+		{
+			name:   "everything",
+			forget: func(st *State) { st.Clear() },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, done := testState(t)
+			defer done()
+			fill(st)
+			tt.forget(st)
+
+			if got := recorded(st); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("left\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+			for table, paths := range st.Tables {
+				if len(paths) == 0 {
+					t.Errorf("empty table %s left behind", table)
+				}
+			}
+		})
+	}
+
+	// None of it minds there being no state
+	var none *State
+	none.Record("inet.0", "10.123.0.0", 24, "10.0.0.1", 1)
+	none.Forget("inet.0", "10.123.0.0", 24, "*")
+	none.ForgetUnder("inet.0", "10.123.0.0", 16)
+	none.Clear()
+	if err := none.Save(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPlanRecord(t *testing.T) {
+	failed := errors.New("ROUTE_EXISTS")
+
+	t.Run("only what went in", func(t *testing.T) {
+		st, done := testState(t)
+		defer done()
+
+		plan, err := routesOf(t, twoRoutes).planFor(Add, st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan.Changes[1].Err = failed
+		if err := plan.record(st); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{fmt.Sprintf("inet.0 10.123.0.0/24 10.0.0.1 %d", firstCookie+1)}
+		if got := recorded(st); !reflect.DeepEqual(got, want) {
+			t.Errorf("recorded %v, want %v", got, want)
+		}
+	})
+
+	t.Run("deletes are forgotten", func(t *testing.T) {
+		st, done := testState(t)
+		defer done()
+		st.Record("inet.0", "10.123.0.0", 24, "10.0.0.1", 7)
+		st.Record("inet.0", "10.123.1.0", 24, "10.0.0.1", 8)
+
+		plan, err := routesOf(t, twoRoutes).planFor(Del, st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan.Changes[1].Err = errNotSent
+		if err := plan.record(st); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{"inet.0 10.123.1.0/24 10.0.0.1 8"}
+		if got := recorded(st); !reflect.DeepEqual(got, want) {
+			t.Errorf("recorded %v, want %v", got, want)
+		}
+	})
+
+	t.Run("a sync starts its tables afresh", func(t *testing.T) {
+		st, done := testState(t)
+		defer done()
+		st.Record("inet.0", "10.99.0.0", 24, "10.0.0.1", 9)
+		st.Record("CUST-A.inet.0", "10.200.0.0", 16, "10.0.0.9", 10)
+
+		current := installed(t, twoRoutes, 11, 12)
+		current[1].Cookie = 13 // Still ours, but a modify of it failed
+		plan := &Plan{compared: true, tables: []string{"inet.0"}, kept: current[:1]}
+		mod, err := routesOf(t, twoRoutes).planFor(Mod, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := mod.Changes[1]
+		c.Cookie, c.Err = 13, failed
+		plan.Changes = append(plan.Changes, c)
+
+		if err := plan.record(st); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{"CUST-A.inet.0 10.200.0.0/16 10.0.0.9 10", "inet.0 10.123.0.0/24 10.0.0.1 11", "inet.0 10.123.1.0/24 10.0.0.1 13"}
+		if got := recorded(st); !reflect.DeepEqual(got, want) {
+			t.Errorf("recorded\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	})
+}
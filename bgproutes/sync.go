@@ -0,0 +1,410 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetclient"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetlog"
+	routing "github.com/arsonistgopher/junos-jet-demo-apps/proto/bgp_route"
+)
+
+// pathKey identifies a path by where it is and where it goes, so the same path
+// read back from the router and built from the file compare equal.
+func pathKey(p *Path) string {
+	return fmt.Sprintf("%s %s/%d %s", p.Table, normalAddr(p.Prefix), p.Length, hopsKey(p.NextHops))
+}
+
+// hopsKey joins next hops the way the State keys them, each written the way
+// normalAddr writes it.
+func hopsKey(nhs []string) string {
+	out := make([]string, len(nhs))
+	for i, nh := range nhs {
+		out[i] = normalAddr(nh)
+	}
+	return strings.Join(out, ",")
+}
+
+// normalAddr writes an address the way Go does, so 2001:DB8:0::1 and 2001:db8::1 match.
+func normalAddr(s string) string {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.String()
+	}
+	return s
+}
+
+// cookieSpan is how far past firstCookie the cookies of a run without a State
+// go. No routes file comes close.
+const cookieSpan = 1 << 20
+
+// claim is how sure sync is that a path on the router is one of ours.
+type claim int
+
+const (
+	theirs   claim = iota // Another client's, left alone
+	unproven              // Has a cookie from the range every run without a State numbers its paths in, but nothing records it
+	mine                  // The State has it recorded with that cookie
+)
+
+// owner tells our paths from other clients'. Only a path the State has recorded
+// with the cookie it has on the router is provably ours. One with a cookie from
+// the range a run without a State hands out may be ours, or may be another
+// host's run of this tool, so sync will match it against the file and modify it
+// but never delete it. Once sync has kept or modified it, the State records it
+// and it is ours from then on.
+func owner(st *State) func(p *Path) claim {
+	return func(p *Path) claim {
+		if c, ok := st.Cookie(p.Table, p.Prefix, p.Length, hopsKey(p.NextHops)); ok && c == p.Cookie {
+			return mine
+		}
+		if p.Cookie > firstCookie && p.Cookie <= firstCookie+cookieSpan {
+			return unproven
+		}
+		return theirs
+	}
+}
+
+// diff works out the changes that turn our paths in current in to desired.
+// Paths are matched on table, prefix and next hops; a matched path whose
+// attributes differ is modified in place under the cookie it already has.
+// Only the paths st has recorded are deleted, whether they have gone from the
+// file or are a second copy of a path; the ones owner can't prove are ours are
+// counted in Spared instead. Other clients' paths are left alone, although
+// their cookies are not handed out again. New cookies come from st when there
+// is one, so they are never used twice on the device.
+func diff(desired []*routing.BgpRouteEntry, current []Path, st *State) *Plan {
+	plan := &Plan{compared: true}
+	ours := owner(st)
+
+	// A path recorded as ours wins over an unproven copy of it
+	have := make(map[string]Path)
+	used := make(map[uint64]bool)
+	var owned, maybe []Path
+	for _, p := range current {
+		used[p.Cookie] = true
+		switch ours(&p) {
+		case mine:
+			owned = append(owned, p)
+		case unproven:
+			maybe = append(maybe, p)
+		}
+	}
+	for _, p := range append(owned, maybe...) {
+		if k := pathKey(&p); have[k].Cookie == 0 {
+			have[k] = p
+		}
+	}
+
+	// New paths get cookies that aren't in use on the router yet
+	next := firstCookie
+	cookie := func() uint64 {
+		if st != nil {
+			c := st.fresh(used)
+			used[c] = true
+			return c
+		}
+		for {
+			next++
+			if !used[next] {
+				used[next] = true
+				return next
+			}
+		}
+	}
+
+	var adds, mods []Change
+	want := make(map[string]bool)
+	for _, e := range desired {
+		p := pathOf(e)
+		k := pathKey(&p)
+		if want[k] {
+			continue
+		}
+		want[k] = true
+
+		c := Change{Table: p.Table, Prefix: p.Prefix, Length: p.Length, NextHop: hopsKey(p.NextHops)}
+
+		cur, ok := have[k]
+		switch {
+		case !ok:
+			c.Verb = Add
+			c.Cookie = cookie()
+			c.entry = withCookie(e, c.Cookie)
+			adds = append(adds, c)
+		case !sameAttributes(&p.Attributes, &cur.Attributes):
+			c.Verb = Mod
+			c.Cookie = cur.Cookie
+			c.entry = withCookie(e, c.Cookie)
+			mods = append(mods, c)
+		default:
+			plan.Unchanged++
+			plan.kept = append(plan.kept, cur)
+		}
+	}
+
+	// Anything not in the file goes, and so does the second copy of a path
+	// that is on the router twice, but only if it is provably ours
+	var dels []Change
+	for _, p := range owned {
+		k := pathKey(&p)
+		if want[k] && have[k].Cookie == p.Cookie {
+			continue
+		}
+		dels = append(dels, delChange(p))
+	}
+	for _, p := range maybe {
+		k := pathKey(&p)
+		if !want[k] || have[k].Cookie != p.Cookie {
+			plan.Spared++
+		}
+	}
+
+	plan.Changes = append(append(adds, mods...), dels...)
+
+	return plan
+}
+
+// sameAttributes reports whether the router's path has the attributes we would
+// send, looking only at the ones we set. The router fills in some that weren't
+// sent, and a route or local preference is sent as 0 when it isn't set, so
+// those are left out rather than have every sync modify the path again.
+// Addresses and communities are compared the way they mean, not as spelled, and
+// an empty list is the same as none.
+func sameAttributes(want, have *Attributes) bool {
+	sameUint32 := func(w, h *uint32, zeroUnset bool) bool {
+		if w == nil || (zeroUnset && *w == 0) {
+			return true
+		}
+		return h != nil && *h == *w
+	}
+	sameString := func(w, h *string, norm func(string) string) bool {
+		if w == nil || *w == "" {
+			return true
+		}
+		return h != nil && norm(*h) == norm(*w)
+	}
+	sameList := func(w, h []string, norm func(string) string) bool {
+		if len(w) != len(h) {
+			return false
+		}
+		ws, hs := make([]string, len(w)), make([]string, len(h))
+		for i := range w {
+			ws[i], hs[i] = norm(w[i]), norm(h[i])
+		}
+		sort.Strings(ws)
+		sort.Strings(hs)
+		return reflect.DeepEqual(ws, hs)
+	}
+	community := func(s string) string { return strings.ToLower(strings.TrimPrefix(s, "large:")) }
+	routeType := func(a *Attributes) string {
+		if a.RouteType == nil || *a.RouteType == "" {
+			return "internal"
+		}
+		return *a.RouteType
+	}
+
+	switch {
+	case !sameUint32(want.LocalPref, have.LocalPref, true), !sameUint32(want.RoutePref, have.RoutePref, true), !sameUint32(want.MED, have.MED, false):
+		return false
+	case want.AIGP != nil && (have.AIGP == nil || *have.AIGP != *want.AIGP):
+		return false
+	case !sameString(want.AsPathStr, have.AsPathStr, strings.TrimSpace):
+		return false
+	case !sameString(want.Originator, have.Originator, normalAddr), !sameString(want.Cluster, have.Cluster, normalAddr):
+		return false
+	case !sameList(want.ClusterList, have.ClusterList, normalAddr):
+		return false
+	case !sameList(want.Communities, have.Communities, community), !sameList(want.ExtCommunities, have.ExtCommunities, community), !sameList(want.LargeCommunities, have.LargeCommunities, community):
+		return false
+	case routeType(want) != routeType(have):
+		return false
+	}
+	return true
+}
+
+// withCookie returns a copy of e with its path cookie set.
+func withCookie(e *routing.BgpRouteEntry, cookie uint64) *routing.BgpRouteEntry {
+	c := *e
+	c.PathCookie = cookie
+	return &c
+}
+
+// delChange is the Change that removes the path p, and only that path.
+func delChange(p Path) Change {
+	_, f, _ := parseAddr(p.Prefix)
+	return Change{
+		Verb:    Del,
+		Table:   p.Table,
+		Prefix:  p.Prefix,
+		Length:  p.Length,
+		NextHop: strings.Join(p.NextHops, ","),
+		Cookie:  p.Cookie,
+		match: &routing.BgpRouteMatch{
+			DestPrefix:    getPrefix(p.Prefix, f),
+			DestPrefixLen: p.Length,
+			Table:         routeTable(p.Table),
+			Protocol:      routing.RouteProtocol_PROTO_BGP_STATIC,
+			PathCookie:    p.Cookie,
+		},
+	}
+}
+
+// syncTable is a table sync reads back, with the family of the routes in it.
+type syncTable struct {
+	name   string
+	family Family
+}
+
+// syncTables lists the tables sync reads back: the ones the file uses, plus
+// with a State the ones it has paths recorded in, so a route taken out of the
+// file is still found when it was the last one in its table. No other table
+// can have paths of ours in it, so no other table is read.
+func (rts *Routes) syncTables(st *State) []syncTable {
+	var tables []syncTable
+	seen := make(map[syncTable]bool)
+	add := func(t syncTable) {
+		if !seen[t] {
+			seen[t] = true
+			tables = append(tables, t)
+		}
+	}
+
+	for i := range rts.Routes {
+		r := &rts.Routes[i]
+		if f, err := r.Family(); err == nil {
+			add(syncTable{rts.Table(r, f), f})
+		}
+	}
+
+	if st != nil {
+		// Sorted so the tables are read in the same order every time
+		var names []string
+		for name := range st.Tables {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if f, ok := st.family(name); ok {
+				add(syncTable{name, f})
+			}
+		}
+	}
+
+	return tables
+}
+
+// readTables reads back the BGP-Static paths in tables.
+func readTables(session *jetclient.Session, tables []syncTable, logger *jetlog.Logger) ([]Path, error) {
+	var current []Path
+	for _, t := range tables {
+		// Everything longer than the default route is the whole table
+		zero := "0.0.0.0"
+		if t.family == Inet6 {
+			zero = "::"
+		}
+		m := &routing.BgpRouteMatch{DestPrefix: getPrefix(zero, t.family), DestPrefixLen: 0, Table: routeTable(t.name), Protocol: routing.RouteProtocol_PROTO_BGP_STATIC}
+		paths, err := fetch(session, m, true, logger)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", t.name, err)
+		}
+		current = append(current, paths...)
+	}
+
+	return current, nil
+}
+
+// plan reads back what is on the device and works out what sync has to change
+// to our paths on it. st says which paths are ours, and may be nil.
+func (rts *Routes) plan(session *jetclient.Session, st *State, logger *jetlog.Logger) (*Plan, error) {
+	desired, _, err := rts.build(func(string, string, uint32, string) uint64 { return 0 })
+	if err != nil {
+		return nil, err
+	}
+
+	tables := rts.syncTables(st)
+	current, err := readTables(session, tables, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	ours := owner(st)
+	plan := diff(desired, current, st)
+	for _, t := range tables {
+		plan.tables = append(plan.tables, t.name)
+	}
+
+	others := 0
+	for i := range current {
+		if ours(&current[i]) == theirs {
+			others++
+		}
+	}
+	if others > 0 {
+		logger.Debug("Leaving other clients' paths alone", "paths", others)
+	}
+	if plan.Spared > 0 {
+		logger.Warn("Not deleting paths that aren't recorded as ours; they may be another run's. Use -state-dir to have sync remove them", "paths", plan.Spared)
+	}
+
+	return plan, nil
+}
+
+// Converge connects to one device and makes our BGP-Static paths on it match
+// rts, with as few changes as it can. Only the paths the device's State has
+// cookies for are deleted. Paths with cookies in the range a run without a
+// State hands out are matched against the file and modified, but are never
+// deleted, as they could as well be another host's; without a stateDir, sync
+// only adds and modifies. Paths other clients put in the same tables are left
+// where they are. The plan is returned even when applying it fails
+// part way, so the caller can say what was attempted. With a stateDir the
+// State is made to match what sync leaves in the tables it read.
+func Converge(jet jetclient.Config, rts *Routes, bt Batching, stateDir string, logger *jetlog.Logger) (*Plan, error) {
+	st, err := openState(stateDir, jet, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer st.Close()
+
+	session, err := dial(jet, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer logger.Info("Closing connection")
+	defer session.Close()
+
+	plan, err := rts.plan(session, st, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("Sync plan", "add", plan.Count(Add), "modify", plan.Count(Mod), "delete", plan.Count(Del), "unchanged", plan.Unchanged)
+
+	err = plan.apply(session, bt, logger)
+	if serr := plan.record(st); serr != nil {
+		logger.Error("Unable to save the state", jetlog.KeyError, serr)
+		if err == nil {
+			err = serr
+		}
+	}
+
+	return plan, err
+}
@@ -0,0 +1,335 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetlog"
+	routing "github.com/arsonistgopher/junos-jet-demo-apps/proto/bgp_route"
+)
+
+// quiet is a logger for tests that don't care what is logged.
+var quiet = jetlog.New(ioutil.Discard, "text", jetlog.LevelError)
+
+// testState opens a State in a directory of its own. done closes it and
+// removes the directory.
+func testState(t *testing.T) (st *State, done func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "bgproutes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err = OpenState(dir, "vmx01", quiet)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return st, func() {
+		st.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// routesOf decodes and checks a TOML routes file.
+func routesOf(t *testing.T, file string) *Routes {
+	t.Helper()
+	var rts Routes
+	if err := decodeTOML(strings.NewReader(file), "test", &rts); err != nil {
+		t.Fatal(err)
+	}
+	if err := rts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return &rts
+}
+
+// entriesOf builds the route entries of a routes file, without cookies.
+func entriesOf(t *testing.T, file string) []*routing.BgpRouteEntry {
+	t.Helper()
+	entries, _, err := routesOf(t, file).build(func(string, string, uint32, string) uint64 { return 0 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// installed is the paths of a routes file as the router would give them back,
+// with the cookies given in order.
+func installed(t *testing.T, file string, cookies ...uint64) []Path {
+	t.Helper()
+	entries := entriesOf(t, file)
+	if len(entries) != len(cookies) {
+		t.Fatalf("%d paths for %d cookies", len(entries), len(cookies))
+	}
+	paths := make([]Path, len(entries))
+	for i, e := range entries {
+		paths[i] = pathOf(withCookie(e, cookies[i]))
+	}
+	return paths
+}
+
+// summary writes a plan's changes one per line, to compare in tests.
+func summary(p *Plan) []string {
+	var lines []string
+	for _, c := range p.Changes {
+		lines = append(lines, strings.Join([]string{c.Verb.String(), c.Table, c.Prefix, c.NextHop}, " "))
+	}
+	return lines
+}
+
+const twoRoutes = `
+[[route]]
+prefix = "10.123.0.0"
+length = 24
+nexthops = ["10.0.0.1"]
+localPref = 100
+
+[[route]]
+prefix = "10.123.1.0"
+length = 24
+nexthops = ["10.0.0.1"]
+`
+
+func TestDiff(t *testing.T) {
+	changed := strings.Replace(twoRoutes, "localPref = 100", "localPref = 200", 1)
+	firstOnly := twoRoutes[:strings.Index(twoRoutes, "[[route]]\nprefix = \"10.123.1.0\"")]
+
+	// What the router gives back isn't always spelled the way it was sent
+	filled := installed(t, twoRoutes, 12345679, 12345680)
+	for i := range filled {
+		pref := uint32(170)
+		filled[i].RoutePref = &pref
+		filled[i].Communities = []string{}
+	}
+	v6 := `
+[[route]]
+prefix = "2001:DB8:1::"
+length = 48
+nexthops = ["2001:DB8:0::1"]
+localPref = 100
+`
+	v6Back := installed(t, v6, 12345700)
+	v6Back[0].Prefix, v6Back[0].NextHops = "2001:db8:1::", []string{"2001:db8::1"}
+
+	tests := []struct {
+		name      string
+		file      string
+		current   []Path
+		recorded  []Path // In the State. Nil runs without one
+		want      []string
+		unchanged int
+		spared    int
+	}{
+		{
+			name: "empty router",
+			file: twoRoutes,
+			want: []string{"add inet.0 10.123.0.0 10.0.0.1", "add inet.0 10.123.1.0 10.0.0.1"},
+		},
+		{
+			name:      "in sync",
+			file:      twoRoutes,
+			current:   installed(t, twoRoutes, 12345679, 12345680),
+			unchanged: 2,
+		},
+		{
+			name:      "in sync, as the router fills it in",
+			file:      twoRoutes,
+			current:   filled,
+			unchanged: 2,
+		},
+		{
+			name:      "attributes differ",
+			file:      changed,
+			current:   installed(t, twoRoutes, 12345679, 12345680),
+			want:      []string{"mod inet.0 10.123.0.0 10.0.0.1"},
+			unchanged: 1,
+		},
+		{
+			// Every run without a State hands out the same cookies, so it could be another host's
+			name:      "taken out of the file, no state",
+			file:      firstOnly,
+			current:   installed(t, twoRoutes, 12345679, 12345680),
+			unchanged: 1,
+			spared:    1,
+		},
+		{
+			name:      "taken out of the file",
+			file:      firstOnly,
+			current:   installed(t, twoRoutes, 12345679, 12345680),
+			recorded:  installed(t, twoRoutes, 12345679, 12345680),
+			want:      []string{"del inet.0 10.123.1.0 10.0.0.1"},
+			unchanged: 1,
+		},
+		{
+			name:      "another client's path",
+			file:      firstOnly,
+			current:   installed(t, twoRoutes, 12345679, 42),
+			unchanged: 1,
+		},
+		{
+			name:      "on the router twice, no state",
+			file:      firstOnly,
+			current:   append(installed(t, firstOnly, 12345679), installed(t, firstOnly, 12345690)...),
+			unchanged: 1,
+			spared:    1,
+		},
+		{
+			// The recorded copy is kept, whichever comes back first
+			name:      "on the router twice",
+			file:      firstOnly,
+			current:   append(installed(t, firstOnly, 12345690), installed(t, firstOnly, 12345679)...),
+			recorded:  append(installed(t, firstOnly, 12345679), installed(t, twoRoutes, 1, 12345690)[1]),
+			want:      []string{},
+			unchanged: 1,
+			spared:    1,
+		},
+		{
+			name:     "IPv6 spelt differently",
+			file:     strings.Replace(v6, "localPref = 100", "localPref = 200", 1),
+			current:  v6Back,
+			recorded: installed(t, v6, 12345700),
+			want:     []string{"mod inet6.0 2001:DB8:1:: 2001:db8::1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var st *State
+			if tt.recorded != nil {
+				var done func()
+				st, done = testState(t)
+				defer done()
+				for _, p := range tt.recorded {
+					st.Record(p.Table, p.Prefix, p.Length, strings.Join(p.NextHops, ","), p.Cookie)
+				}
+			}
+
+			plan := diff(entriesOf(t, tt.file), tt.current, st)
+			if got := summary(plan); len(got)+len(tt.want) > 0 && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("changes = %q, want %q", got, tt.want)
+			}
+			if plan.Unchanged != tt.unchanged {
+				t.Errorf("unchanged = %d, want %d", plan.Unchanged, tt.unchanged)
+			}
+			if plan.Spared != tt.spared {
+				t.Errorf("spared = %d, want %d", plan.Spared, tt.spared)
+			}
+		})
+	}
+}
+
+func TestDiffCookies(t *testing.T) {
+	// A modify keeps the cookie the path has
+	current := installed(t, twoRoutes, 12345700, 12345701)
+	plan := diff(entriesOf(t, strings.Replace(twoRoutes, "localPref = 100", "localPref = 200", 1)), current, nil)
+	if c := plan.Changes[0]; c.Verb != Mod || c.Cookie != 12345700 || c.entry.PathCookie != 12345700 {
+		t.Errorf("modify got cookie %d (entry %d), want 12345700", c.Cookie, c.entry.PathCookie)
+	}
+
+	// New paths skip cookies on the router, even other clients'
+	plan = diff(entriesOf(t, twoRoutes), installed(t, twoRoutes, 7, firstCookie+1), nil)
+	if got := plan.Count(Add); got != 1 {
+		t.Fatalf("changes = %q, want an add beside the other client's path", summary(plan))
+	}
+	if c := plan.Changes[0]; c.Cookie != firstCookie+2 {
+		t.Errorf("add %s got cookie %d, want %d", c.Prefix, c.Cookie, firstCookie+2)
+	}
+
+	// With a State they carry on from where the last run stopped, past every
+	// cookie it has handed out, even for paths that have since gone
+	st, done := testState(t)
+	defer done()
+	st.Next = firstCookie + 10
+	st.Record("inet.0", "10.99.0.0", 24, "10.0.0.1", firstCookie+11)
+	st.Forget("inet.0", "10.99.0.0", 24, "10.0.0.1")
+	plan = diff(entriesOf(t, twoRoutes), installed(t, twoRoutes, 99, firstCookie+12)[:0], st)
+	var got []uint64
+	for _, c := range plan.Changes {
+		got = append(got, c.Cookie)
+	}
+	if want := []uint64{firstCookie + 12, firstCookie + 13}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cookies %v, want %v", got, want)
+	}
+	if st.Next != firstCookie+13 {
+		t.Errorf("next cookie %d, want %d", st.Next, firstCookie+13)
+	}
+}
+
+func TestOwner(t *testing.T) {
+	st, done := testState(t)
+	defer done()
+	st.Record("inet.0", "10.123.0.0", 24, "10.0.0.1", 12345700)
+	st.Record("inet6.0", "2001:DB8:1::", 48, "2001:DB8:0::1", 12345701)
+
+	path := func(table, prefix string, cookie uint64) *Path {
+		return &Path{Table: table, Prefix: prefix, Length: 24, NextHops: []string{"10.0.0.1"}, Cookie: cookie}
+	}
+
+	tests := []struct {
+		name string
+		st   *State
+		p    *Path
+		want claim
+	}{
+		{"no state, our range", nil, path("inet.0", "10.123.0.0", 12345679), unproven},
+		{"no state, first cookie", nil, path("inet.0", "10.123.0.0", firstCookie), theirs},
+		{"no state, past our range", nil, path("inet.0", "10.123.0.0", firstCookie+cookieSpan+1), theirs},
+		{"no state, someone else", nil, path("inet.0", "10.123.0.0", 7), theirs},
+		{"recorded", st, path("inet.0", "10.123.0.0", 12345700), mine},
+		{"recorded, other cookie", st, path("inet.0", "10.123.0.0", 12345679), unproven},
+		{"not recorded", st, path("inet.0", "10.123.9.0", 12345679), unproven},
+		{"not recorded, someone else", st, path("CUST.inet.0", "10.123.0.0", 7), theirs},
+		{"recorded, spelt differently", st, &Path{Table: "inet6.0", Prefix: "2001:db8:1::", Length: 48, NextHops: []string{"2001:db8::1"}, Cookie: 12345701}, mine},
+	}
+
+	for _, tt := range tests {
+		if got := owner(tt.st)(tt.p); got != tt.want {
+			t.Errorf("%s: owner = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSyncTables(t *testing.T) {
+	rts := routesOf(t, `
+[[route]]
+prefix = "10.123.0.0"
+length = 24
+nexthops = ["10.0.0.1"]
+table = "CUST-A.inet.0"
+`)
+
+	// Only the table the file uses, not the defaults where other clients' routes are
+	if got, want := rts.syncTables(nil), []syncTable{{"CUST-A.inet.0", Inet}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("syncTables(nil) = %v, want %v", got, want)
+	}
+
+	// And the tables the state remembers, even when the file has nothing left in them
+	st, done := testState(t)
+	defer done()
+	st.Record("inet6.0", "2001:db8::", 64, "2001:db8::1", 12345679)
+	st.Record("BLUE", "10.9.0.0", 16, "10.0.0.1", 12345680)
+
+	want := []syncTable{{"CUST-A.inet.0", Inet}, {"BLUE", Inet}, {"inet6.0", Inet6}}
+	if got := rts.syncTables(st); !reflect.DeepEqual(got, want) {
+		t.Errorf("syncTables(st) = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgproutes
+
+import (
+	"os"
+	"time"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetlog"
+)
+
+// settle is how long a file has to be left alone after an inotify event before
+// it is read. Editors tend to write a file in several goes.
+const settle = 250 * time.Millisecond
+
+// watchFile signals on changed whenever the file at path may have changed. It
+// uses inotify where there is one and falls back to polling every interval,
+// including when the inotify watch stops, say because the directory was
+// removed or renamed. changed should have a buffer of one; signals are dropped
+// while one is pending. The watch lasts as long as the process.
+func watchFile(path string, interval time.Duration, changed chan<- struct{}, logger *jetlog.Logger) {
+	events, err := notify(path)
+	if err != nil {
+		logger.Warn("Can't use inotify, polling the routes file instead", "interval", interval, jetlog.KeyError, err)
+		go poll(path, interval, changed)
+		return
+	}
+	logger.Debug("Watching the routes file with inotify", "file", path)
+
+	go func() {
+		settled(events, changed)
+
+		// The file may have changed along with whatever stopped the watch
+		logger.Warn("Lost the inotify watch on the routes file, polling it instead", "file", path, "interval", interval)
+		poke(changed)
+		poll(path, interval, changed)
+	}()
+}
+
+// settled passes events on to changed once the writes stop, until events is closed.
+func settled(events <-chan struct{}, changed chan<- struct{}) {
+	for range events {
+		// Wait for the writes to stop before saying anything
+		timer := time.NewTimer(settle)
+		for waiting := true; waiting; {
+			select {
+			case _, ok := <-events:
+				if !ok {
+					timer.Stop()
+					poke(changed)
+					return
+				}
+				timer.Reset(settle)
+			case <-timer.C:
+				waiting = false
+			}
+		}
+		poke(changed)
+	}
+}
+
+// poll stats path every interval and signals when its size or modification
+// time changes, or it appears or goes away.
+func poll(path string, interval time.Duration, changed chan<- struct{}) {
+	last, lastErr := os.Stat(path)
+	for range time.Tick(interval) {
+		fi, err := os.Stat(path)
+		switch {
+		case (err == nil) != (lastErr == nil):
+			poke(changed)
+		case err == nil && (fi.Size() != last.Size() || !fi.ModTime().Equal(last.ModTime())):
+			poke(changed)
+		}
+		last, lastErr = fi, err
+	}
+}
+
+// poke sends on c unless a signal is already pending.
+func poke(c chan<- struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
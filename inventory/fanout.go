@@ -0,0 +1,205 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetclient"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetlog"
+)
+
+// Target is a selected device together with its resolved connection settings.
+type Target struct {
+	Device
+	Config         jetclient.Config
+	PasswordSource string // Where the password came from, for logging
+}
+
+// Targets loads the inventory named by the flags, selects the target devices and
+// builds their connection settings on top of base. Passwords are resolved here,
+// one device at a time, because a terminal prompt cannot be shared between go routines.
+func (f *Flags) Targets(base jetclient.Config) ([]Target, error) {
+	if f.File == "" {
+		return nil, errors.New("inventory: -target needs -inventory")
+	}
+
+	inv, err := Load(f.File)
+	if err != nil {
+		return nil, err
+	}
+
+	devices, err := inv.Select(f.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]Target, 0, len(devices))
+	for _, d := range devices {
+		cfg := inv.Config(d, base)
+		source, err := cfg.ResolvePassword()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", d.Name, err)
+		}
+		targets = append(targets, Target{Device: d, Config: cfg, PasswordSource: source})
+	}
+
+	return targets, nil
+}
+
+// Result is the outcome of running against one target.
+type Result struct {
+	Target   Target
+	Err      error
+	Duration time.Duration
+}
+
+// Run calls fn for every target with at most parallel calls in flight, and
+// returns one Result per target in the same order as targets.
+func Run(targets []Target, parallel int, fn func(Target) error) []Result {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	results := make([]Result, len(targets))
+
+	// The semaphore channel limits the number of go routines doing work.
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+
+	for i, t := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int, t Target) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			start := time.Now()
+			err := fn(t)
+			results[i] = Result{Target: t, Err: err, Duration: time.Since(start)}
+		}(i, t)
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// Failed returns the number of results with an error.
+func Failed(results []Result) int {
+	n := 0
+	for _, r := range results {
+		if r.Err != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// PrintSummary writes a per device success/failure table to w.
+func PrintSummary(w io.Writer, results []Result) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEVICE\tHOST\tRESULT\tTIME\tERROR")
+	for _, r := range results {
+		status, msg := "ok", ""
+		if r.Err != nil {
+			status, msg = "FAILED", r.Err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Target.Name, r.Target.Config.Host, status, r.Duration.Round(time.Millisecond), msg)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%d devices, %d succeeded, %d failed\n", len(results), len(results)-Failed(results), Failed(results))
+}
+
+// ForEach runs fn against the devices chosen by the flags, or against base alone
+// when no inventory was asked for. Each call gets a logger tagged with the device.
+// With an inventory, failures are logged as they happen and a summary is written
+// to summary at the end; the returned error then only says how many devices failed.
+func (f *Flags) ForEach(base jetclient.Config, logger *jetlog.Logger, summary io.Writer, fn func(Target, *jetlog.Logger) error) error {
+	// One device, the way it has always worked.
+	if !f.Enabled() {
+		// Resolve the password. Saves time if the user gets it wrong
+		source, err := base.ResolvePassword()
+		if err != nil {
+			return err
+		}
+		logger.Info("Using password", "source", source)
+
+		t := Target{Device: Device{Name: base.Host, Host: base.Host}, Config: base, PasswordSource: source}
+		return fn(t, logger.With(jetlog.KeyDevice, base.Target()))
+	}
+
+	// Many devices from the inventory.
+	targets, err := f.Targets(base)
+	if err != nil {
+		return err
+	}
+
+	results := Run(targets, f.Parallel, func(t Target) error {
+		logger := logger.With(jetlog.KeyDevice, t.Name)
+		logger.Info("Using password", "source", t.PasswordSource)
+		err := fn(t, logger)
+		if err != nil {
+			logger.Error("Failed", jetlog.KeyError, err)
+		}
+		return err
+	})
+
+	PrintSummary(summary, results)
+	if n := Failed(results); n > 0 {
+		return fmt.Errorf("inventory: %d of %d devices failed", n, len(results))
+	}
+
+	return nil
+}
+
+// Printer writes what a run against one device produced.
+type Printer func(w io.Writer) error
+
+// ForEachPrinted is ForEach for commands that print something per device. fn
+// does the work and returns a Printer for what it has to show, or nil if there
+// is nothing. Each device's output goes to w whole, under a "---title (name)---"
+// heading when there's an inventory, and fn's error is still returned after it
+// is printed.
+func (f *Flags) ForEachPrinted(base jetclient.Config, logger *jetlog.Logger, w io.Writer, title string, fn func(Target, *jetlog.Logger) (Printer, error)) error {
+	// Serialises printing so output from different devices doesn't interleave.
+	var printMu sync.Mutex
+
+	return f.ForEach(base, logger, w, func(t Target, logger *jetlog.Logger) error {
+		show, err := fn(t, logger)
+		if show == nil {
+			return err
+		}
+
+		printMu.Lock()
+		defer printMu.Unlock()
+		if f.Enabled() {
+			fmt.Fprintf(w, "\n---%s (%s)---\n\n", title, t.Name)
+		}
+		if perr := show(w); err == nil {
+			err = perr
+		}
+		return err
+	})
+}
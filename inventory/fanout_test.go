@@ -0,0 +1,202 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetclient"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetlog"
+)
+
+var quiet = jetlog.New(ioutil.Discard, "text", jetlog.LevelError)
+
+// targetsNamed makes a Target for each name.
+func targetsNamed(names ...string) []Target {
+	var targets []Target
+	for _, n := range names {
+		targets = append(targets, Target{Device: Device{Name: n, Host: n}, Config: jetclient.Config{Host: n}})
+	}
+	return targets
+}
+
+// gauge counts the calls in flight and remembers the most there were at once.
+type gauge struct {
+	mu       sync.Mutex
+	now, max int
+}
+
+func (g *gauge) enter() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.now++
+	if g.now > g.max {
+		g.max = g.now
+	}
+}
+
+func (g *gauge) leave() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.now--
+}
+
+func TestRun(t *testing.T) {
+	names := []string{"r1", "r2", "r3", "r4", "r5", "r6", "r7", "r8"}
+
+	for _, parallel := range []int{0, 1, 3, 8} {
+		var g gauge
+		results := Run(targetsNamed(names...), parallel, func(t Target) error {
+			g.enter()
+			defer g.leave()
+			time.Sleep(20 * time.Millisecond)
+			if t.Name == "r2" || t.Name == "r7" {
+				return fmt.Errorf("%s is down", t.Name)
+			}
+			return nil
+		})
+
+		want := parallel
+		if want < 1 {
+			want = 1
+		}
+		if g.max != want {
+			t.Errorf("parallel %d: %d calls at once, want %d", parallel, g.max, want)
+		}
+
+		if len(results) != len(names) {
+			t.Fatalf("parallel %d: %d results, want %d", parallel, len(results), len(names))
+		}
+		for i, r := range results {
+			if r.Target.Name != names[i] {
+				t.Errorf("parallel %d: result %d is for %s, want %s", parallel, i, r.Target.Name, names[i])
+			}
+			if failed := r.Err != nil; failed != (r.Target.Name == "r2" || r.Target.Name == "r7") {
+				t.Errorf("parallel %d: %s error %v", parallel, r.Target.Name, r.Err)
+			}
+		}
+		if n := Failed(results); n != 2 {
+			t.Errorf("parallel %d: Failed = %d, want 2", parallel, n)
+		}
+	}
+}
+
+// inventoryFlags writes testInventory and returns Flags selecting target from it.
+func inventoryFlags(t *testing.T, target string) (*Flags, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Flags{File: writeInventory(t, dir, testInventory), Target: target, Parallel: 2}, func() { os.RemoveAll(dir) }
+}
+
+func TestForEach(t *testing.T) {
+	f, cleanup := inventoryFlags(t, "all")
+	defer cleanup()
+
+	var mu sync.Mutex
+	seen := make(map[string]string)
+	var summary bytes.Buffer
+	err := f.ForEach(jetclient.Config{Password: "pw"}, quiet, &summary, func(t Target, logger *jetlog.Logger) error {
+		mu.Lock()
+		seen[t.Name] = t.Config.Host + " " + t.PasswordSource
+		mu.Unlock()
+		if t.Name == "ptx01" {
+			return errors.New("ptx01 is down")
+		}
+		return nil
+	})
+
+	if err == nil || err.Error() != "inventory: 1 of 4 devices failed" {
+		t.Errorf("error %v, want 1 of 4 failed", err)
+	}
+	want := map[string]string{"mx01": "mx01.domain command line", "mx02": "mx02 command line", "ptx01": "ptx01 command line", "lab": "lab command line"}
+	if fmt.Sprint(seen) != fmt.Sprint(want) {
+		t.Errorf("ran against %v, want %v", seen, want)
+	}
+
+	out := summary.String()
+	for _, line := range []string{"ptx01   ptx01        FAILED", "ptx01 is down", "4 devices, 3 succeeded, 1 failed"} {
+		if !strings.Contains(out, line) {
+			t.Errorf("summary lacks %q:\n%s", line, out)
+		}
+	}
+}
+
+func TestForEachWithoutInventory(t *testing.T) {
+	var summary bytes.Buffer
+	calls := 0
+	err := (&Flags{}).ForEach(jetclient.Config{Host: "mx01", Port: "32767", Password: "pw"}, quiet, &summary, func(t Target, logger *jetlog.Logger) error {
+		calls++
+		if t.Name != "mx01" || t.PasswordSource != "command line" {
+			return fmt.Errorf("target %+v", t)
+		}
+		return errors.New("mx01 is down")
+	})
+
+	// The error comes back as it is, with no summary.
+	if calls != 1 || err == nil || err.Error() != "mx01 is down" {
+		t.Errorf("%d calls, error %v", calls, err)
+	}
+	if summary.Len() != 0 {
+		t.Errorf("summary written: %q", summary.String())
+	}
+
+	err = (&Flags{Target: "all"}).ForEach(jetclient.Config{}, quiet, &summary, func(Target, *jetlog.Logger) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "-target needs -inventory") {
+		t.Errorf("-target alone: %v", err)
+	}
+}
+
+func TestForEachPrinted(t *testing.T) {
+	f, cleanup := inventoryFlags(t, "group:core")
+	defer cleanup()
+
+	var out bytes.Buffer
+	err := f.ForEachPrinted(jetclient.Config{Password: "pw"}, quiet, &out, "Data", func(t Target, logger *jetlog.Logger) (Printer, error) {
+		return func(w io.Writer) error {
+			// Written in pieces, so interleaving would show.
+			for _, s := range []string{t.Name, " line 1\n", t.Name, " line 2\n"} {
+				io.WriteString(w, s)
+				time.Sleep(time.Millisecond)
+			}
+			return nil
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, block := range []string{
+		"\n---Data (mx02)---\n\nmx02 line 1\nmx02 line 2\n",
+		"\n---Data (ptx01)---\n\nptx01 line 1\nptx01 line 2\n",
+	} {
+		if !strings.Contains(out.String(), block) {
+			t.Errorf("output lacks %q:\n%s", block, out.String())
+		}
+	}
+}
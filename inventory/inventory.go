@@ -0,0 +1,203 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package inventory loads a TOML file describing many Junos devices and runs a
+// function against a selection of them concurrently.
+//
+// An inventory looks like this:
+//
+//	[defaults]
+//	port    = "32767"
+//	user    = "jet"
+//	certdir = "CLIENTCERT"
+//
+//	[group.edge]
+//	user = "jet-edge"
+//
+//	[[device]]
+//	name   = "mx01"
+//	host   = "mx01.domain"
+//	groups = ["edge"]
+//
+// Settings are taken from the device, then its groups in the order listed, then
+// [defaults] and finally the command line flags.
+package inventory
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetclient"
+)
+
+// Settings are the per device connection settings that can be set at any level.
+type Settings struct {
+	Port     string `toml:"port"`
+	User     string `toml:"user"`
+	ClientID string `toml:"clientid"`
+	CertDir  string `toml:"certdir"`
+}
+
+// Device is one router in the inventory.
+type Device struct {
+	Name   string   `toml:"name"`
+	Host   string   `toml:"host"`
+	Groups []string `toml:"groups"`
+	Settings
+}
+
+// Inventory is the decoded inventory file.
+type Inventory struct {
+	Defaults Settings            `toml:"defaults"`
+	Groups   map[string]Settings `toml:"group"`
+	Devices  []Device            `toml:"device"`
+}
+
+// Flags are the command line flags for selecting devices from an inventory.
+type Flags struct {
+	File     string // Inventory file
+	Target   string // Selector, e.g. "group:edge"
+	Parallel int    // Maximum number of devices worked on at once
+}
+
+// RegisterFlags registers -inventory, -target and -parallel on fs.
+func (f *Flags) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&f.File, "inventory", "", "Inventory file describing devices and groups")
+	fs.StringVar(&f.Target, "target", "", "Devices to run against: all, group:<name>, device:<name> or <name>, comma separated")
+	fs.IntVar(&f.Parallel, "parallel", 4, "Number of devices to work on concurrently")
+}
+
+// Enabled reports whether an inventory run was asked for.
+func (f *Flags) Enabled() bool {
+	return f.File != "" || f.Target != ""
+}
+
+// Load decodes and validates an inventory file.
+func Load(path string) (*Inventory, error) {
+	var inv Inventory
+	if _, err := toml.DecodeFile(path, &inv); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for i, d := range inv.Devices {
+		if d.Name == "" {
+			return nil, fmt.Errorf("inventory: device %d has no name", i+1)
+		}
+		if seen[d.Name] {
+			return nil, fmt.Errorf("inventory: device %q is listed twice", d.Name)
+		}
+		seen[d.Name] = true
+
+		if d.Host == "" {
+			inv.Devices[i].Host = d.Name
+		}
+		for _, g := range d.Groups {
+			if _, ok := inv.Groups[g]; !ok {
+				return nil, fmt.Errorf("inventory: device %q is in unknown group %q", d.Name, g)
+			}
+		}
+	}
+
+	return &inv, nil
+}
+
+// Select returns the devices matched by target. The target is a comma separated
+// list of "all", "group:<name>", "device:<name>" or a bare device name. Devices are
+// returned once each, in inventory order.
+func (inv *Inventory) Select(target string) ([]Device, error) {
+	if strings.TrimSpace(target) == "" {
+		return nil, errors.New("inventory: no target given")
+	}
+
+	chosen := make(map[string]bool)
+	for _, sel := range strings.Split(target, ",") {
+		sel = strings.TrimSpace(sel)
+		matched := false
+
+		for _, d := range inv.Devices {
+			if d.matches(sel) {
+				chosen[d.Name] = true
+				matched = true
+			}
+		}
+
+		if !matched {
+			return nil, fmt.Errorf("inventory: target %q matches no devices", sel)
+		}
+	}
+
+	var devices []Device
+	for _, d := range inv.Devices {
+		if chosen[d.Name] {
+			devices = append(devices, d)
+		}
+	}
+
+	return devices, nil
+}
+
+func (d Device) matches(sel string) bool {
+	switch {
+	case sel == "all":
+		return true
+	case strings.HasPrefix(sel, "group:"):
+		g := strings.TrimPrefix(sel, "group:")
+		for _, dg := range d.Groups {
+			if dg == g {
+				return true
+			}
+		}
+		return false
+	case strings.HasPrefix(sel, "device:"):
+		return d.Name == strings.TrimPrefix(sel, "device:")
+	default:
+		return d.Name == sel
+	}
+}
+
+// Config returns base with the host and any settings for d applied on top.
+func (inv *Inventory) Config(d Device, base jetclient.Config) jetclient.Config {
+	cfg := base
+	cfg.Host = d.Host
+
+	// Lowest precedence first so that later layers win.
+	layers := []Settings{inv.Defaults}
+	for i := len(d.Groups) - 1; i >= 0; i-- {
+		layers = append(layers, inv.Groups[d.Groups[i]])
+	}
+	layers = append(layers, d.Settings)
+
+	for _, s := range layers {
+		if s.Port != "" {
+			cfg.Port = s.Port
+		}
+		if s.User != "" {
+			cfg.User = s.User
+		}
+		if s.ClientID != "" {
+			cfg.ClientID = s.ClientID
+		}
+		if s.CertDir != "" {
+			cfg.TLS.CertDir = s.CertDir
+		}
+	}
+
+	return cfg
+}
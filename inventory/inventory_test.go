@@ -0,0 +1,194 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package inventory
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetclient"
+)
+
+const testInventory = `
+[defaults]
+port    = "32767"
+user    = "jet"
+certdir = "CERTS"
+
+[group.edge]
+user     = "jet-edge"
+clientid = "edge"
+
+[group.core]
+user    = "jet-core"
+port    = "50051"
+certdir = "CORE-CERTS"
+
+[[device]]
+name   = "mx01"
+host   = "mx01.domain"
+groups = ["edge"]
+
+[[device]]
+name   = "mx02"
+groups = ["edge", "core"]
+user   = "admin"
+
+[[device]]
+name   = "ptx01"
+groups = ["core"]
+
+[[device]]
+name = "lab"
+`
+
+// writeInventory writes content to a file in dir and returns its path.
+func writeInventory(t *testing.T, dir, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, "inventory.toml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// load writes content and loads it, failing the test if it can't.
+func load(t *testing.T, content string) *Inventory {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	inv, err := Load(writeInventory(t, dir, content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inv
+}
+
+func TestLoad(t *testing.T) {
+	inv := load(t, testInventory)
+	if got := inv.Devices[1].Host; got != "mx02" {
+		t.Errorf("host of a device without one = %q, want its name", got)
+	}
+
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"no name", "[[device]]\nhost = \"mx01\"\n", "device 1 has no name"},
+		{"twice", "[[device]]\nname = \"mx01\"\n[[device]]\nname = \"mx01\"\n", `device "mx01" is listed twice`},
+		{"unknown group", "[[device]]\nname = \"mx01\"\ngroups = [\"edge\"]\n", `unknown group "edge"`},
+		{"not TOML", "[[device]\n", ""},
+	}
+
+	for _, tt := range tests {
+		_, err := Load(writeInventory(t, dir, tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	inv := load(t, testInventory)
+
+	tests := []struct {
+		target string
+		want   []string
+		err    string
+	}{
+		{"all", []string{"mx01", "mx02", "ptx01", "lab"}, ""},
+		{"group:edge", []string{"mx01", "mx02"}, ""},
+		{"group:core", []string{"mx02", "ptx01"}, ""},
+		{"device:lab", []string{"lab"}, ""},
+		{"lab", []string{"lab"}, ""},
+		{"lab, group:edge", []string{"mx01", "mx02", "lab"}, ""}, // Inventory order, not selector order
+		{"group:edge,mx02", []string{"mx01", "mx02"}, ""},        // Each device once
+		{"group:access", nil, `target "group:access" matches no devices`},
+		{"mx01,mx03", nil, `target "mx03" matches no devices`},
+		{" ", nil, "no target given"},
+	}
+
+	for _, tt := range tests {
+		devices, err := inv.Select(tt.target)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: error %v, want %q", tt.target, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.target, err)
+			continue
+		}
+		var got []string
+		for _, d := range devices {
+			got = append(got, d.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	inv := load(t, testInventory)
+	base := jetclient.Config{Host: "flag-host", Port: "1", User: "flag-user", ClientID: "flag-id", Password: "pw"}
+
+	tests := []struct {
+		device                        string
+		host, port, user, id, certDir string
+	}{
+		// Group over defaults.
+		{"mx01", "mx01.domain", "32767", "jet-edge", "edge", "CERTS"},
+		// The device over its groups, and the first group listed over the next.
+		{"mx02", "mx02", "50051", "admin", "edge", "CORE-CERTS"},
+		{"ptx01", "ptx01", "50051", "jet-core", "flag-id", "CORE-CERTS"},
+		// Defaults over the flags, and the flags for what nothing sets.
+		{"lab", "lab", "32767", "jet", "flag-id", "CERTS"},
+	}
+
+	for _, tt := range tests {
+		devices, err := inv.Select(tt.device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := inv.Config(devices[0], base)
+		got := []string{cfg.Host, cfg.Port, cfg.User, cfg.ClientID, cfg.TLS.CertDir, cfg.Password}
+		want := []string{tt.host, tt.port, tt.user, tt.id, tt.certDir, "pw"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: host, port, user, client ID, certdir, password = %q, want %q", tt.device, got, want)
+		}
+	}
+	if base.Host != "flag-host" || base.TLS.CertDir != "" {
+		t.Errorf("Config changed the base: %+v", base)
+	}
+}
@@ -0,0 +1,304 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package jetaudit records every JET RPC a tool makes as a line of JSON, for
+// change control. It hooks in as gRPC client interceptors, so new services are
+// covered without any extra work:
+//
+//	auditor, err := af.Install(&cfg.jet)
+//	...
+//	defer auditor.Close()
+//
+// Request fields that look like secrets (passwords and the like) are redacted
+// before anything is written, and so are the secret statements in configuration
+// loaded with ExecuteCfgCommand.
+package jetaudit
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetclient"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Redacted replaces the value of every secret field.
+const Redacted = "[REDACTED]"
+
+// SecretFields are matched, ignoring case, against the field names of each
+// request. A field whose name contains one of them is redacted.
+var SecretFields = []string{"password", "passwd", "secret", "token", "private_key", "auth_key"}
+
+// Secret statements in configuration, whatever format it is loaded in:
+// secret, password and *-password, pre-shared-key with its ascii-text or
+// hexadecimal value, and authentication-key.
+const configSecrets = `secret|(?:[\w-]+-)?password|pre-shared-key|ascii-text|hexadecimal|authentication-key`
+
+var (
+	// set system login user x authentication encrypted-password "$6$..."
+	// pre-shared-key ascii-text "$9$..."; ## SECRET-DATA
+	textSecret = regexp.MustCompile(`(?m)((?:^|[\s{;])(?:pre-shared-key[ \t]+(?:ascii-text|hexadecimal)|` + configSecrets + `))[ \t]+("(?:[^"\\\n]|\\.)*"|[^\s;{}"]+)`)
+	// <encrypted-password>$6$...</encrypted-password>
+	xmlSecret = regexp.MustCompile(`<(` + configSecrets + `)>[^<]*</`)
+	// "encrypted-password" : "$6$..."
+	jsonSecret = regexp.MustCompile(`"(` + configSecrets + `)"(\s*:\s*)"(?:[^"\\]|\\.)*"`)
+)
+
+// Record is one line of the audit log.
+type Record struct {
+	Time     time.Time       `json:"time"`
+	Device   string          `json:"device"`
+	User     string          `json:"user"`
+	ClientID string          `json:"client_id"`
+	RPC      string          `json:"rpc"`
+	Request  json.RawMessage `json:"request"`
+	Status   string          `json:"status"`           // JET status in the reply, OK without one, or the gRPC code
+	Error    string          `json:"error,omitempty"`  // gRPC error, if the call failed
+	Duration float64         `json:"duration_ms"`      // Time until the (first) reply
+	Stream   bool            `json:"stream,omitempty"` // Streaming RPC: status and duration are for the first reply
+}
+
+// Auditor writes Records to a file. It is safe for concurrent use.
+type Auditor struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// Open appends to the audit log at path, creating it readable by the owner only.
+func Open(path string) (*Auditor, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("jetaudit: %v", err)
+	}
+	return &Auditor{w: f}, nil
+}
+
+// Close closes the audit log.
+func (a *Auditor) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.w.Close()
+}
+
+// write appends one record. Each record goes out in a single write, so nothing is
+// buffered and lost if the tool exits in a hurry.
+func (a *Auditor) write(r *Record) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		b, _ = json.Marshal(&Record{Time: r.Time, Device: r.Device, RPC: r.RPC, Error: "jetaudit: " + err.Error()})
+	}
+	b = append(b, '\n')
+
+	a.mu.Lock()
+	a.w.Write(b)
+	a.mu.Unlock()
+}
+
+// record fills in a Record for a call on the session in ctx.
+func record(ctx context.Context, method string, req interface{}, start time.Time) *Record {
+	r := &Record{Time: start.UTC(), RPC: method, Request: Redact(req)}
+	if info, ok := jetclient.SessionFromContext(ctx); ok {
+		r.Device, r.User, r.ClientID = info.Target, info.User, info.ClientID
+	}
+	return r
+}
+
+// finish sets the status, error and duration of r from the call's outcome.
+func finish(r *Record, reply interface{}, err error, start time.Time) {
+	r.Duration = float64(time.Since(start)) / float64(time.Millisecond)
+	switch {
+	case err != nil:
+		r.Status = status.Code(err).String()
+		r.Error = err.Error()
+	case jetclient.ReplyStatus(reply) != "":
+		r.Status = jetclient.ReplyStatus(reply)
+	default:
+		r.Status = "OK"
+	}
+}
+
+// UnaryClientInterceptor audits unary RPCs. Install adds it for you.
+func (a *Auditor) UnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+
+	r := record(ctx, method, req, start)
+	finish(r, reply, err, start)
+	a.write(r)
+
+	return err
+}
+
+// StreamClientInterceptor audits streaming RPCs. The record is written when the
+// first reply (or error) comes back, as that is all some callers ever read.
+func (a *Auditor) StreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	start := time.Now()
+	cs, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		r := record(ctx, method, nil, start)
+		r.Stream = true
+		finish(r, nil, err, start)
+		a.write(r)
+		return nil, err
+	}
+
+	return &auditStream{ClientStream: cs, a: a, ctx: ctx, method: method, start: start}, nil
+}
+
+// auditStream remembers the request sent on a stream and writes the record on the first reply.
+type auditStream struct {
+	grpc.ClientStream
+	a      *Auditor
+	ctx    context.Context
+	method string
+	start  time.Time
+	req    interface{}
+	once   sync.Once
+}
+
+func (s *auditStream) SendMsg(m interface{}) error {
+	if s.req == nil {
+		s.req = m
+	}
+	return s.ClientStream.SendMsg(m)
+}
+
+func (s *auditStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	s.once.Do(func() {
+		r := record(s.ctx, s.method, s.req, s.start)
+		r.Stream = true
+		if err == io.EOF {
+			finish(r, nil, nil, s.start)
+		} else {
+			finish(r, m, err, s.start)
+		}
+		s.a.write(r)
+	})
+	return err
+}
+
+// Redact renders a request as JSON with the secret fields replaced by Redacted.
+func Redact(req interface{}) json.RawMessage {
+	if req == nil {
+		return json.RawMessage("null")
+	}
+
+	var b []byte
+	if pb, ok := req.(proto.Message); ok {
+		s, err := (&jsonpb.Marshaler{OrigName: true}).MarshalToString(pb)
+		if err == nil {
+			b = []byte(s)
+		}
+	}
+	if b == nil {
+		var err error
+		if b, err = json.Marshal(req); err != nil {
+			return json.RawMessage(`"unprintable request"`)
+		}
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return json.RawMessage(`"unprintable request"`)
+	}
+	out, err := json.Marshal(redact(v))
+	if err != nil {
+		return json.RawMessage(`"unprintable request"`)
+	}
+	return out
+}
+
+// redact walks a decoded JSON value replacing secret fields.
+func redact(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, fv := range t {
+			s, isString := fv.(string)
+			switch {
+			case isSecret(k):
+				t[k] = Redacted
+			case isString && strings.Contains(strings.ToLower(k), "config"):
+				t[k] = redactConfig(s)
+			default:
+				t[k] = redact(fv)
+			}
+		}
+	case []interface{}:
+		for i := range t {
+			t[i] = redact(t[i])
+		}
+	}
+	return v
+}
+
+// redactConfig replaces the values of the secret statements in configuration
+// text, XML or JSON, such as the text_config of ExecuteCfgCommandRequest.
+func redactConfig(config string) string {
+	config = textSecret.ReplaceAllString(config, `${1} "`+Redacted+`"`)
+	config = xmlSecret.ReplaceAllString(config, `<${1}>`+Redacted+`</`)
+	return jsonSecret.ReplaceAllString(config, `"${1}"${2}"`+Redacted+`"`)
+}
+
+func isSecret(field string) bool {
+	f := strings.ToLower(field)
+	for _, s := range SecretFields {
+		if strings.Contains(f, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Flags are the command line flags for the audit log.
+type Flags struct {
+	File string // Audit log. Empty disables auditing.
+}
+
+// RegisterFlags registers -audit-log on fs.
+func (f *Flags) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&f.File, "audit-log", "", "Append a JSON line per JET RPC to this file. Empty disables")
+}
+
+// Install opens the audit log, if one was asked for, and adds the interceptors
+// to cfg. The returned Auditor is nil when auditing is off; Close is safe on nil.
+func (f *Flags) Install(cfg *jetclient.Config) (*Auditor, error) {
+	if f.File == "" {
+		return nil, nil
+	}
+
+	a, err := Open(f.File)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.Interceptors = append(cfg.Interceptors, a.UnaryClientInterceptor)
+	cfg.StreamInterceptors = append(cfg.StreamInterceptors, a.StreamClientInterceptor)
+
+	return a, nil
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jetaudit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetclient"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetmock"
+	mng "github.com/arsonistgopher/junos-jet-demo-apps/proto/management"
+)
+
+func TestRedact(t *testing.T) {
+	type login struct {
+		User     string `json:"user_name"`
+		Password string `json:"password"`
+	}
+	type request struct {
+		Login   login             `json:"login"`
+		Keys    []map[string]bool `json:"keys"`
+		Command string            `json:"command"`
+	}
+
+	tests := []struct {
+		name string
+		req  interface{}
+		want string
+	}{
+		{name: "nothing", req: nil, want: `null`},
+		{
+			name: "nested",
+			req: request{
+				Login:   login{User: "jet", Password: "hunter2"},
+				Keys:    []map[string]bool{{"Auth_Key_ID": true, "other": false}},
+				Command: "show route",
+			},
+			want: `{"command":"show route","keys":[{"Auth_Key_ID":"[REDACTED]","other":false}],"login":{"password":"[REDACTED]","user_name":"jet"}}`,
+		},
+		{
+			// The field name is what counts, not what is in it
+			name: "names, not values",
+			req:  map[string]interface{}{"BgpSecretKey": map[string]string{"value": "x"}, "comment": "password is in here"},
+			want: `{"BgpSecretKey":"[REDACTED]","comment":"password is in here"}`,
+		},
+		{name: "unprintable", req: map[string]interface{}{"c": make(chan int)}, want: `"unprintable request"`},
+	}
+
+	for _, tt := range tests {
+		if got := string(Redact(tt.req)); got != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRedactConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{
+			name: "set",
+			config: `set system login user x authentication encrypted-password "$6$abc.def"
+set system radius-server 10.0.0.1 secret s3cr3t
+set security ike policy p1 pre-shared-key ascii-text "$9$xyz"
+set protocols ospf area 0 interface ge-0/0/0 authentication md5 1 key k
+set system root-authentication plain-text-password
+set interfaces ge-0/0/0 description "keep me"`,
+			want: `set system login user x authentication encrypted-password "[REDACTED]"
+set system radius-server 10.0.0.1 secret "[REDACTED]"
+set security ike policy p1 pre-shared-key ascii-text "[REDACTED]"
+set protocols ospf area 0 interface ge-0/0/0 authentication md5 1 key k
+set system root-authentication plain-text-password
+set interfaces ge-0/0/0 description "keep me"`,
+		},
+		{
+			name: "curly braces",
+			config: `system { login { user x { authentication { encrypted-password "$6$a\"b"; ## SECRET-DATA
+} } } }
+security { ike { policy p1 { pre-shared-key {
+    hexadecimal 0a0b; } } } }
+protocols { bgp { group g { authentication-key "$9$k"; } } }`,
+			want: `system { login { user x { authentication { encrypted-password "[REDACTED]"; ## SECRET-DATA
+} } } }
+security { ike { policy p1 { pre-shared-key {
+    hexadecimal "[REDACTED]"; } } } }
+protocols { bgp { group g { authentication-key "[REDACTED]"; } } }`,
+		},
+		{
+			name:   "xml",
+			config: `<configuration><system><radius-server><name>10.0.0.1</name><secret>$9$abc</secret></radius-server><login><user><name>x</name><authentication><encrypted-password>$6$abc</encrypted-password></authentication></user></login></system></configuration>`,
+			want:   `<configuration><system><radius-server><name>10.0.0.1</name><secret>[REDACTED]</secret></radius-server><login><user><name>x</name><authentication><encrypted-password>[REDACTED]</encrypted-password></authentication></user></login></system></configuration>`,
+		},
+		{
+			name:   "json",
+			config: `{"configuration": {"security": {"ike": {"policy": [{"name": "p1", "pre-shared-key": {"ascii-text" : "$9$a\"b"}}]}}, "system": {"radius-server": [{"name": "10.0.0.1", "secret": "s"}]}}}`,
+			want:   `{"configuration": {"security": {"ike": {"policy": [{"name": "p1", "pre-shared-key": {"ascii-text" : "[REDACTED]"}}]}}, "system": {"radius-server": [{"name": "10.0.0.1", "secret": "[REDACTED]"}]}}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		if got := redactConfig(tt.config); got != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+
+	// The configuration fields of a request are scrubbed; other strings aren't.
+	req := map[string]interface{}{
+		"text_config": `set system radius-server 10.0.0.1 secret s3cr3t`,
+		"comment":     `secret s3cr3t`,
+	}
+	want := `{"comment":"secret s3cr3t","text_config":"set system radius-server 10.0.0.1 secret \"[REDACTED]\""}`
+	if got := string(Redact(req)); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	cfg := &mng.ExecuteCfgCommandRequest{
+		Config:   &mng.ExecuteCfgCommandRequest_TextConfig{TextConfig: `set snmp v3 usm local-engine user u authentication-sha authentication-password "s3cr3t"`},
+		LoadType: mng.ConfigLoadType_CONFIG_LOAD_SET,
+	}
+	if got := string(Redact(cfg)); strings.Contains(got, "s3cr3t") || !strings.Contains(got, Redacted) {
+		t.Errorf("ExecuteCfgCommandRequest not redacted: %s", got)
+	}
+}
+
+func TestAuditAgainstMock(t *testing.T) {
+	srv := jetmock.New()
+	srv.AddUser("jet", "hunter2")
+	if err := srv.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	dir, err := ioutil.TempDir("", "jetaudit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	host, port, _ := net.SplitHostPort(srv.Addr())
+	cfg := jetclient.Config{Host: host, Port: port, User: "jet", Password: "hunter2", ClientID: "42", Retry: jetclient.RetryPolicy{Attempts: 1}}
+	af := Flags{File: filepath.Join(dir, "audit.log")}
+	auditor, err := af.Install(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := jetclient.Dial(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.BgpRouteInitialize(); err != nil {
+		t.Fatal(err)
+	}
+	session.Close()
+	auditor.Close()
+
+	f, err := os.Open(af.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var records []Record
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if strings.Contains(sc.Text(), "hunter2") {
+			t.Errorf("the password is in the audit log: %s", sc.Text())
+		}
+		var r Record
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			t.Fatalf("%v: %s", err, sc.Text())
+		}
+		records = append(records, r)
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("%d records, want the login and the bind", len(records))
+	}
+	for i, rpc := range []string{"LoginCheck", "BgpRouteInitialize"} {
+		r := records[i]
+		if !strings.HasSuffix(r.RPC, "/"+rpc) {
+			t.Errorf("record %d is for %s, want %s", i, r.RPC, rpc)
+		}
+		if r.Device != srv.Addr() || r.User != "jet" || r.ClientID != "42" {
+			t.Errorf("%s: device %q, user %q, client ID %q", rpc, r.Device, r.User, r.ClientID)
+		}
+		if r.Status == "" || r.Error != "" || r.Time.IsZero() {
+			t.Errorf("%s: status %q, error %q, time %v", rpc, r.Status, r.Error, r.Time)
+		}
+	}
+	if !strings.Contains(string(records[0].Request), Redacted) {
+		t.Errorf("login request %s isn't redacted", records[0].Request)
+	}
+}
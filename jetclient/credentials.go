@@ -0,0 +1,183 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jetclient
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// PasswordEnv is the environment variable consulted for the password.
+const PasswordEnv = "JET_PASSWORD"
+
+// CredentialConfig says where to look for a password when -passwd is not given.
+type CredentialConfig struct {
+	File   string // TOML credentials file keyed by host. Defaults to ~/.jet/credentials.toml if present.
+	Helper string // git-credential style helper command, run as "<Helper> get"
+}
+
+// registerFlags registers the credential flags on fs.
+func (c *CredentialConfig) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.File, "credfile", "", "Credentials file keyed by host (default ~/.jet/credentials.toml if it exists)")
+	fs.StringVar(&c.Helper, "cred-helper", "", "Credential helper command, called as '<cmd> get' with git-credential style I/O")
+}
+
+// credential is one entry in the credentials file.
+type credential struct {
+	User     string `toml:"user"`
+	Password string `toml:"password"`
+}
+
+// TOML based struct for the credentials file.
+type credentialFile struct {
+	Hosts map[string]credential `toml:"host"`
+}
+
+// ResolvePassword fills in c.Password if it is empty and returns the name of the
+// source it came from. Sources are tried in this order:
+//
+//  1. -passwd (already in c.Password)
+//  2. the JET_PASSWORD environment variable
+//  3. the credentials file
+//  4. the credential helper
+//  5. a prompt, but only when stdin is a terminal
+//
+// The password itself is never logged or included in an error.
+func (c *Config) ResolvePassword() (string, error) {
+	if c.Password != "" {
+		return "command line", nil
+	}
+
+	if p := os.Getenv(PasswordEnv); p != "" {
+		c.Password = p
+		return "environment", nil
+	}
+
+	path, explicit := c.Creds.File, c.Creds.File != ""
+	if !explicit {
+		if home := os.Getenv("HOME"); home != "" {
+			path = filepath.Join(home, ".jet", "credentials.toml")
+		}
+	}
+	if path != "" {
+		p, err := lookupFile(path, c.Host, c.Port, c.User)
+		switch {
+		case err == nil && p != "":
+			c.Password = p
+			return "credentials file " + path, nil
+		case err != nil && (explicit || !os.IsNotExist(err)):
+			return "", err
+		}
+	}
+
+	if c.Creds.Helper != "" {
+		p, err := runHelper(c.Creds.Helper, c.Host, c.Port, c.User)
+		if err != nil {
+			return "", err
+		}
+		if p != "" {
+			c.Password = p
+			return "credential helper", nil
+		}
+	}
+
+	if terminal.IsTerminal(int(syscall.Stdin)) {
+		fmt.Fprint(os.Stderr, "Enter Password: ")
+		bytePassword, err := terminal.ReadPassword(int(syscall.Stdin))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("jetclient: could not read password: %v", err)
+		}
+		c.Password = string(bytePassword)
+		return "terminal", nil
+	}
+
+	return "", fmt.Errorf("jetclient: no password for %s@%s: use %s, -credfile or -cred-helper", c.User, c.Host, PasswordEnv)
+}
+
+// lookupFile finds the password for user on host in a credentials file. Entries are
+// tried as "host:port", "host" and then "*"; an entry with a user only matches that user.
+// The file must not be readable by group or others.
+func lookupFile(path, host, port, user string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("jetclient: credentials file %s is accessible by others (mode %04o); chmod 600 it", path, fi.Mode().Perm())
+	}
+
+	var cf credentialFile
+	if _, err := toml.DecodeFile(path, &cf); err != nil {
+		// The parser error can quote the offending value, so it is not passed on.
+		return "", fmt.Errorf("jetclient: could not parse credentials file %s", path)
+	}
+
+	for _, key := range []string{host + ":" + port, host, "*"} {
+		cred, ok := cf.Hosts[key]
+		if !ok || cred.Password == "" {
+			continue
+		}
+		if cred.User != "" && cred.User != user {
+			continue
+		}
+		return cred.Password, nil
+	}
+
+	return "", nil
+}
+
+// runHelper asks a git-credential style helper for a password. The helper gets
+// key=value lines on stdin and answers the same way; only "password" is used.
+func runHelper(helper, host, port, user string) (string, error) {
+	cmd := exec.Command("/bin/sh", "-c", helper+" get")
+
+	var in bytes.Buffer
+	fmt.Fprintf(&in, "protocol=jet\nhost=%s\nport=%s\nusername=%s\n\n", host, port, user)
+	cmd.Stdin = &in
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		// Deliberately leave out the output: it may contain the password.
+		return "", fmt.Errorf("jetclient: credential helper %q failed: %v", helper, err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) == 2 && kv[0] == "password" {
+			return kv[1], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", errors.New("jetclient: could not read credential helper output")
+	}
+
+	return "", nil
+}
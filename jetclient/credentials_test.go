@@ -0,0 +1,234 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jetclient
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// writeCreds writes a credentials file with mode perm and returns its path.
+func writeCreds(t *testing.T, dir, content string, perm os.FileMode) string {
+	t.Helper()
+	path := filepath.Join(dir, "credentials.toml")
+	if err := ioutil.WriteFile(path, []byte(content), perm); err != nil {
+		t.Fatal(err)
+	}
+	// WriteFile's mode is subject to the umask.
+	if err := os.Chmod(path, perm); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeHelper writes a credential helper that saves what it is sent in a file
+// next to it and answers with password, and returns the command to run it.
+func writeHelper(t *testing.T, dir, password string) (helper, input string) {
+	t.Helper()
+	input = filepath.Join(dir, "helper.in")
+	helper = filepath.Join(dir, "helper.sh")
+	script := "#!/bin/sh\n[ \"$1\" = get ] || exit 2\ncat > '" + input + "'\necho username=ignored\necho password=" + password + "\n"
+	if err := ioutil.WriteFile(helper, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return helper, input
+}
+
+func TestResolvePassword(t *testing.T) {
+	const creds = `
+[host."router1"]
+password = "file-pw"
+`
+	tests := []struct {
+		name   string
+		passwd string
+		env    string
+		file   bool // Use the credentials file
+		home   bool // Put it at ~/.jet/credentials.toml rather than -credfile
+		helper bool
+		want   string
+		source string
+	}{
+		{"flag wins", "flag-pw", "env-pw", true, false, true, "flag-pw", "command line"},
+		{"environment", "", "env-pw", true, false, true, "env-pw", "environment"},
+		{"file", "", "", true, false, true, "file-pw", "credentials file"},
+		{"default file", "", "", true, true, true, "file-pw", "credentials file"},
+		{"helper", "", "", false, false, true, "helper-pw", "credential helper"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("HOME", dir)
+			t.Setenv(PasswordEnv, tt.env)
+
+			c := Config{Host: "router1", Port: "32767", User: "jet", Password: tt.passwd}
+			if tt.file {
+				if tt.home {
+					jetDir := filepath.Join(dir, ".jet")
+					if err := os.Mkdir(jetDir, 0700); err != nil {
+						t.Fatal(err)
+					}
+					writeCreds(t, jetDir, creds, 0600)
+				} else {
+					c.Creds.File = writeCreds(t, dir, creds, 0600)
+				}
+			}
+			if tt.helper {
+				c.Creds.Helper, _ = writeHelper(t, dir, "helper-pw")
+			}
+
+			source, err := c.ResolvePassword()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Password != tt.want || !strings.HasPrefix(source, tt.source) {
+				t.Errorf("got %q from %q, want %q from %q", c.Password, source, tt.want, tt.source)
+			}
+		})
+	}
+}
+
+func TestResolvePasswordNowhere(t *testing.T) {
+	if terminal.IsTerminal(int(syscall.Stdin)) {
+		t.Skip("stdin is a terminal, so it would prompt")
+	}
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv(PasswordEnv, "")
+
+	c := Config{Host: "router1", Port: "32767", User: "jet"}
+	if source, err := c.ResolvePassword(); err == nil {
+		t.Errorf("got a password from %q", source)
+	}
+
+	// A missing -credfile is an error, a missing default file is not.
+	c.Creds.File = filepath.Join(t.TempDir(), "missing.toml")
+	if _, err := c.ResolvePassword(); err == nil || !os.IsNotExist(err) {
+		t.Errorf("missing -credfile: %v", err)
+	}
+}
+
+func TestCredentialsFilePermissions(t *testing.T) {
+	const creds = `
+[host."*"]
+password = "s3cret-pw"
+`
+	tests := []struct {
+		perm os.FileMode
+		ok   bool
+	}{
+		{0600, true},
+		{0400, true},
+		{0640, false},
+		{0604, false},
+		{0660, false},
+	}
+
+	for _, tt := range tests {
+		path := writeCreds(t, t.TempDir(), creds, tt.perm)
+		p, err := lookupFile(path, "router1", "32767", "jet")
+		switch {
+		case tt.ok && (err != nil || p != "s3cret-pw"):
+			t.Errorf("mode %04o: %q, %v", tt.perm, p, err)
+		case !tt.ok && (err == nil || !strings.Contains(err.Error(), "accessible by others")):
+			t.Errorf("mode %04o: %v, want it refused", tt.perm, err)
+		}
+		if err != nil && strings.Contains(err.Error(), "s3cret-pw") {
+			t.Errorf("mode %04o: error shows the password: %v", tt.perm, err)
+		}
+	}
+}
+
+func TestLookupFile(t *testing.T) {
+	const creds = `
+[host."router1:32767"]
+password = "port-pw"
+
+[host."router1"]
+password = "host-pw"
+
+[host."router2"]
+user = "admin"
+password = "admin-pw"
+
+[host."*"]
+password = "any-pw"
+`
+	path := writeCreds(t, t.TempDir(), creds, 0600)
+
+	tests := []struct {
+		host, port, user string
+		want             string
+	}{
+		{"router1", "32767", "jet", "port-pw"},
+		{"router1", "50051", "jet", "host-pw"},
+		{"router2", "32767", "admin", "admin-pw"},
+		{"router2", "32767", "jet", "any-pw"}, // The router2 entry is admin's only
+		{"router3", "32767", "jet", "any-pw"},
+	}
+
+	for _, tt := range tests {
+		got, err := lookupFile(path, tt.host, tt.port, tt.user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s@%s:%s = %q, want %q", tt.user, tt.host, tt.port, got, tt.want)
+		}
+	}
+
+	bad := writeCreds(t, t.TempDir(), "[host.\"*\"]\npassword = \"unterminated-pw\n", 0600)
+	if _, err := lookupFile(bad, "router1", "32767", "jet"); err == nil || strings.Contains(err.Error(), "unterminated-pw") {
+		t.Errorf("unparsable file: %v", err)
+	}
+}
+
+func TestRunHelper(t *testing.T) {
+	dir := t.TempDir()
+	helper, input := writeHelper(t, dir, "helper-pw")
+
+	got, err := runHelper(helper, "router1", "32767", "jet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "helper-pw" {
+		t.Errorf("password %q, want helper-pw", got)
+	}
+
+	sent, err := ioutil.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "protocol=jet\nhost=router1\nport=32767\nusername=jet\n\n"; string(sent) != want {
+		t.Errorf("helper was sent %q, want %q", sent, want)
+	}
+
+	// A failing helper's output is left out of the error.
+	failing := filepath.Join(dir, "failing.sh")
+	if err := ioutil.WriteFile(failing, []byte("#!/bin/sh\necho password=leaked-pw\nexit 1\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runHelper(failing, "router1", "32767", "jet"); err == nil || strings.Contains(err.Error(), "leaked-pw") {
+		t.Errorf("failing helper: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jetclient
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"google.golang.org/grpc"
+)
+
+// SessionInfo describes the session an RPC is made on, for interceptors.
+type SessionInfo struct {
+	Target   string // host:port
+	User     string // User the session logs in as
+	ClientID string // JET client ID
+}
+
+type sessionKey struct{}
+
+// SessionFromContext returns the session an intercepted RPC belongs to.
+func SessionFromContext(ctx context.Context) (SessionInfo, bool) {
+	info, ok := ctx.Value(sessionKey{}).(SessionInfo)
+	return info, ok
+}
+
+// info returns the SessionInfo for s.
+func (s *Session) info() SessionInfo {
+	return SessionInfo{Target: s.cfg.Target(), User: s.cfg.User, ClientID: s.cfg.ClientID}
+}
+
+// chain wraps invoker in the configured interceptors.
+func (s *Session) chain(invoker grpc.UnaryInvoker) grpc.UnaryInvoker {
+	for i := len(s.cfg.Interceptors) - 1; i >= 0; i-- {
+		ic, next := s.cfg.Interceptors[i], invoker
+		invoker = func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			return ic(ctx, method, req, reply, cc, next, opts...)
+		}
+	}
+
+	if len(s.cfg.Interceptors) == 0 {
+		return invoker
+	}
+
+	info, next := s.info(), invoker
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		return next(context.WithValue(ctx, sessionKey{}, info), method, req, reply, cc, opts...)
+	}
+}
+
+// streamInterceptor runs streaming RPCs through the configured StreamInterceptors.
+// Streams are not retried.
+func (s *Session) streamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	for i := len(s.cfg.StreamInterceptors) - 1; i >= 0; i-- {
+		ic, next := s.cfg.StreamInterceptors[i], streamer
+		streamer = func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			return ic(ctx, desc, cc, method, next, opts...)
+		}
+	}
+
+	return streamer(context.WithValue(ctx, sessionKey{}, s.info()), desc, cc, method, opts...)
+}
+
+// ReplyStatus returns the name of the Status field of a JET reply, or "" if the
+// reply has none. Every service has its own status enum, hence the reflection.
+func ReplyStatus(reply interface{}) string {
+	m := reflect.ValueOf(reply).MethodByName("GetStatus")
+	if !m.IsValid() || m.Type().NumIn() != 0 || m.Type().NumOut() != 1 {
+		return ""
+	}
+	if s, ok := m.Call(nil)[0].Interface().(fmt.Stringer); ok {
+		return s.String()
+	}
+	return ""
+}
@@ -0,0 +1,252 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jetclient
+
+import (
+	"context"
+	"flag"
+	"math/rand"
+	"time"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetlog"
+	auth "github.com/arsonistgopher/junos-jet-demo-apps/proto/auth"
+	routing "github.com/arsonistgopher/junos-jet-demo-apps/proto/bgp_route"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+)
+
+// Full method names of the RPCs the session makes on its own behalf.
+// These are invoked without going back through the interceptor.
+const (
+	loginMethod   = "/authentication.Login/LoginCheck"
+	bgpInitMethod = "/routing.BgpRoute/BgpRouteInitialize"
+)
+
+// idempotent lists the unary RPCs that are safe to repeat even if the first attempt
+// may have reached the router. BgpRouteAdd is missing on purpose: a repeat after
+// an abort can fail with ROUTE_EXISTS, so it is only retried when the call
+// clearly never got through (see retryable).
+var idempotent = map[string]bool{
+	bgpInitMethod:                       true,
+	"/routing.BgpRoute/BgpRouteCleanup": true,
+	"/routing.BgpRoute/BgpRouteModify":  true,
+	"/routing.BgpRoute/BgpRouteUpdate":  true,
+	"/routing.BgpRoute/BgpRouteRemove":  true,
+}
+
+// RetryPolicy controls exponential backoff for connecting, logging in and RPCs.
+type RetryPolicy struct {
+	Attempts       int           // Total attempts per call. 1 disables retries.
+	InitialBackoff time.Duration // Wait before the second attempt
+	MaxBackoff     time.Duration // Cap on the wait between attempts
+	Multiplier     float64       // Growth of the wait per attempt
+}
+
+// KeepaliveConfig sets gRPC keepalive pings. A zero Time disables them, which is
+// the default because the Junos gRPC server may close connections that ping too often.
+type KeepaliveConfig struct {
+	Time    time.Duration // Ping after this long without activity
+	Timeout time.Duration // Close the connection if a ping is not answered in this time
+}
+
+// registerFlags registers the retry and keepalive flags on fs.
+func (p *RetryPolicy) registerFlags(fs *flag.FlagSet) {
+	p.Multiplier = 2
+	fs.IntVar(&p.Attempts, "retries", 3, "Attempts for connect, login and each RPC. 1 disables retries")
+	fs.DurationVar(&p.InitialBackoff, "retry-backoff", time.Second, "Initial wait between attempts")
+	fs.DurationVar(&p.MaxBackoff, "retry-max-backoff", 30*time.Second, "Maximum wait between attempts")
+}
+
+// registerFlags registers the keepalive flags on fs.
+func (k *KeepaliveConfig) registerFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&k.Time, "keepalive", 0, "Send gRPC keepalive pings after this much idle time (0 disables)")
+	fs.DurationVar(&k.Timeout, "keepalive-timeout", 20*time.Second, "Wait this long for a keepalive ping reply")
+}
+
+// dialOption returns the keepalive dial option, or nil if keepalives are off.
+func (k *KeepaliveConfig) dialOption() grpc.DialOption {
+	if k.Time <= 0 {
+		return nil
+	}
+	return grpc.WithKeepaliveParams(keepalive.ClientParameters{
+		Time:                k.Time,
+		Timeout:             k.Timeout,
+		PermitWithoutStream: true,
+	})
+}
+
+// attempts returns the number of attempts, never less than one.
+func (p *RetryPolicy) attempts() int {
+	if p.Attempts < 1 {
+		return 1
+	}
+	return p.Attempts
+}
+
+// backoff returns the wait before attempt n+1 (n counts from 1), with +/-20% jitter
+// so a fleet of clients doesn't retry in lock step after a router restart.
+func (p *RetryPolicy) backoff(n int) time.Duration {
+	d := float64(p.InitialBackoff)
+	mult := p.Multiplier
+	if mult < 1 {
+		mult = 1
+	}
+	for i := 1; i < n; i++ {
+		d *= mult
+		if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+			d = float64(p.MaxBackoff)
+			break
+		}
+	}
+	return time.Duration(d * (0.8 + 0.4*rand.Float64()))
+}
+
+// Sleep waits for the backoff before attempt n+1 or until ctx is done, and reports whether to carry on.
+func (p *RetryPolicy) Sleep(ctx context.Context, n int) bool {
+	t := time.NewTimer(p.backoff(n))
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// retryable classifies an RPC error by its gRPC status code.
+func retryable(err error, method string) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted:
+		// The call almost certainly never reached the service.
+		return true
+	case codes.Unauthenticated, codes.PermissionDenied:
+		// Seen after a routing-engine switchover, before we log in again. From
+		// LoginCheck itself it is a wrong password, and trying again won't help.
+		return method != loginMethod
+	case codes.Aborted:
+		// DeadlineExceeded is not here: the deadline is the caller's, and it has
+		// gone by the time we could try again.
+		return idempotent[method]
+	default:
+		return false
+	}
+}
+
+// needsRelogin reports whether err suggests the JET session state was lost.
+func needsRelogin(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Unauthenticated, codes.PermissionDenied:
+		return true
+	default:
+		return false
+	}
+}
+
+// OnReinitialize registers fn to be called after the session has transparently
+// logged in again and re-initialized the bgp_route service, with the status that
+// BgpRouteInitialize returned. SUCCESS (rather than SUCCESS_STATE_REBOUND) means
+// the router forgot our routes and they need programming again.
+func (s *Session) OnReinitialize(fn func(routing.BgpRouteInitializeReply_BgpRouteInitializeStatus)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onReinit = fn
+}
+
+// unaryInterceptor retries failed unary RPCs according to the retry policy. When
+// the failure looks like lost session state it logs in again, re-initializes the
+// bgp_route service if it was in use, and then retries the original call. Every
+// attempt, the re-login included, goes through the configured Interceptors.
+func (s *Session) unaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	invoker = s.chain(invoker)
+
+	if method == loginMethod {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+
+	attempts := s.cfg.Retry.attempts()
+	for n := 1; ; n++ {
+		gen := s.generation()
+
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if err == nil || n >= attempts || !retryable(err, method) {
+			return err
+		}
+
+		s.log.Warn("RPC failed, retrying", jetlog.KeyRPC, method, "attempt", n, "attempts", attempts, jetlog.KeyError, err)
+
+		if !s.cfg.Retry.Sleep(ctx, n) {
+			return err
+		}
+
+		if needsRelogin(err) {
+			if lerr := s.relogin(ctx, gen, method, cc, invoker); lerr != nil {
+				s.log.Error("re-login failed", jetlog.KeyError, lerr)
+			}
+		}
+	}
+}
+
+// generation returns a counter that goes up every time the session logs in again.
+func (s *Session) generation() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gen
+}
+
+// relogin logs in again and re-initializes bgp_route. gen is the generation the
+// failed call was made in; if another go routine has already logged in again
+// since then there is nothing to do.
+func (s *Session) relogin(ctx context.Context, gen int, method string, cc *grpc.ClientConn, invoker grpc.UnaryInvoker) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.gen != gen {
+		return nil
+	}
+
+	loginReply := new(auth.LoginReply)
+	if err := invoker(ctx, loginMethod, s.loginRequest(), loginReply, cc); err != nil {
+		return err
+	}
+	if !loginReply.GetResult() {
+		return errLoginRefused
+	}
+	s.gen++
+	s.log.Info("logged in again")
+
+	// Initialize is about to be retried by the caller anyway.
+	if !s.bgpInit || method == bgpInitMethod {
+		return nil
+	}
+
+	initReply := new(routing.BgpRouteInitializeReply)
+	if err := invoker(ctx, bgpInitMethod, &routing.BgpRouteInitializeRequest{}, initReply, cc); err != nil {
+		return err
+	}
+
+	st := routing.BgpRouteInitializeReply_BgpRouteInitializeStatus(initReply.Status)
+	s.log.Info("BGP route API re-initialized", jetlog.KeyRPC, bgpInitMethod, "status", st.String())
+	if s.onReinit != nil {
+		go s.onReinit(st)
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jetclient
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetryable(t *testing.T) {
+	const add = "/routing.BgpRoute/BgpRouteAdd"
+	const remove = "/routing.BgpRoute/BgpRouteRemove"
+
+	tests := []struct {
+		code   codes.Code
+		method string
+		want   bool
+	}{
+		{codes.Unavailable, add, true},
+		{codes.ResourceExhausted, loginMethod, true},
+		{codes.Unauthenticated, remove, true},
+		{codes.PermissionDenied, add, true},
+		{codes.Unauthenticated, loginMethod, false}, // A wrong password stays wrong
+		{codes.PermissionDenied, loginMethod, false},
+		{codes.Aborted, remove, true},
+		{codes.Aborted, add, false}, // Might be ROUTE_EXISTS the second time
+		{codes.DeadlineExceeded, remove, false},
+		{codes.InvalidArgument, remove, false},
+	}
+
+	for _, tt := range tests {
+		if got := retryable(status.Error(tt.code, "x"), tt.method); got != tt.want {
+			t.Errorf("retryable(%v, %s) = %v, want %v", tt.code, tt.method, got, tt.want)
+		}
+	}
+
+	if retryable(errors.New("not a status"), remove) {
+		t.Error("retryable(plain error) = true, want false")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := RetryPolicy{Attempts: 5, InitialBackoff: time.Second, MaxBackoff: 3 * time.Second, Multiplier: 2}
+
+	for n, want := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		got := p.backoff(n + 1)
+		if lo, hi := want*8/10, want*12/10; got < lo || got > hi {
+			t.Errorf("backoff(%d) = %v, want %v +/-20%%", n+1, got, want)
+		}
+	}
+}
+
+func TestSleepCancelled(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if p.Sleep(ctx, 1) {
+		t.Error("Sleep with a cancelled context = true, want false")
+	}
+}
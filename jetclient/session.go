@@ -0,0 +1,315 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package jetclient takes care of the boilerplate every JET application needs:
+// dialling the gRPC server on Junos (with or without TLS), authenticating with
+// LoginCheck and handing out typed service clients on the shared connection.
+//
+// Nothing in here calls log.Fatal. Errors are returned so the package can be
+// used from long running services as well as from the one-shot demo tools.
+package jetclient
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetlog"
+	auth "github.com/arsonistgopher/junos-jet-demo-apps/proto/auth"
+	routing "github.com/arsonistgopher/junos-jet-demo-apps/proto/bgp_route"
+	mng "github.com/arsonistgopher/junos-jet-demo-apps/proto/management"
+
+	"google.golang.org/grpc"
+)
+
+// Default values shared by all of the tools in this repository.
+const (
+	DefaultHost     = "127.0.0.1"
+	DefaultPort     = "32767"
+	DefaultUser     = "jet"
+	DefaultClientID = "42"
+	DefaultTimeout  = 10 * time.Second
+
+	// DefaultStreamTimeout bounds a streaming read, which for a full table
+	// can take far longer than any unary RPC.
+	DefaultStreamTimeout = 5 * time.Minute
+)
+
+// Config is everything required to open a session with a JET gRPC server.
+type Config struct {
+	Host          string           // Hostname or IP address of Junos host
+	Port          string           // Port that the gRPC server is listening on
+	User          string           // Username of Junos host
+	Password      string           // Password for user
+	ClientID      string           // ClientID of session
+	Timeout       time.Duration    // Timeout applied to each unary RPC
+	StreamTimeout time.Duration    // Timeout applied to a whole streaming read, such as BgpRouteGet. Zero means none
+	TLS           TLSConfig        // Certificates and TLS settings. Empty means clear text.
+	Creds         CredentialConfig // Where to find the password if it is not given
+	Retry         RetryPolicy      // Backoff for connect, login and RPCs. Zero value means no retries.
+	Keepalive     KeepaliveConfig  // gRPC keepalive pings. Zero value means none.
+	Logger        *jetlog.Logger   // Where the session logs. Nil means jetlog.Default() with the device added.
+
+	// Interceptors wrap every unary RPC attempt, including logins, first one outermost.
+	// They run inside the retry logic, so each retry is seen as a separate call.
+	// SessionFromContext tells them which session the call belongs to.
+	Interceptors []grpc.UnaryClientInterceptor
+
+	// StreamInterceptors do the same for streaming RPCs such as ExecuteOpCommand.
+	StreamInterceptors []grpc.StreamClientInterceptor
+}
+
+// RegisterFlags registers the common connection flags on fs, with the defaults
+// that the demo applications have always used. The -timeout flag is in seconds.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	c.Timeout = DefaultTimeout
+	c.StreamTimeout = DefaultStreamTimeout
+	fs.StringVar(&c.Host, "host", DefaultHost, "Hostname or IP Address")
+	fs.StringVar(&c.Port, "port", DefaultPort, "Port that the grpc server is listening on.")
+	fs.StringVar(&c.User, "user", DefaultUser, "Username for authentication")
+	fs.StringVar(&c.ClientID, "cid", DefaultClientID, "Client ID for session")
+	fs.Var((*secondsValue)(&c.Timeout), "timeout", "Timeout in seconds for JET")
+	fs.Var((*secondsValue)(&c.StreamTimeout), "stream-timeout", "Timeout in seconds for reading routes back, which can be a whole table. 0 means no limit")
+	fs.StringVar(&c.Password, "passwd", "", "Password for Junos host. Visible in ps; prefer "+PasswordEnv+", -credfile or -cred-helper")
+	c.TLS.registerFlags(fs)
+	c.Creds.registerFlags(fs)
+	c.Retry.registerFlags(fs)
+	c.Keepalive.registerFlags(fs)
+}
+
+// Target returns the "host:port" string that is dialled.
+func (c *Config) Target() string {
+	return c.Host + ":" + c.Port
+}
+
+// Session is an authenticated connection to a JET gRPC server.
+type Session struct {
+	cfg  Config
+	conn *grpc.ClientConn
+	log  *jetlog.Logger
+
+	mu       sync.Mutex
+	gen      int  // Bumped every time the session logs in again
+	bgpInit  bool // BgpRouteInitialize has been called, so redo it after a re-login
+	onReinit func(routing.BgpRouteInitializeReply_BgpRouteInitializeStatus)
+}
+
+// errLoginRefused is returned when LoginCheck answers but says no.
+var errLoginRefused = errors.New("login refused")
+
+// Dial connects to the JET server described by cfg and authenticates with LoginCheck,
+// retrying with backoff as cfg.Retry allows. The returned Session must be closed by the caller.
+func Dial(cfg Config) (*Session, error) {
+	if cfg.Host == "" || cfg.Port == "" {
+		return nil, errors.New("jetclient: host and port are required")
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+
+	// A logger handed to us is expected to carry the device already.
+	logger := cfg.Logger
+	if logger == nil {
+		logger = jetlog.Default().With(jetlog.KeyDevice, cfg.Target())
+	}
+	s := &Session{cfg: cfg, log: logger}
+
+	opts, err := s.dialOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	// Set up a connection to the server. This does not block; connection
+	// problems show up when we log in.
+	conn, err := grpc.Dial(cfg.Target(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("jetclient: did not connect to %s: %v", cfg.Target(), err)
+	}
+	s.conn = conn
+
+	attempts := cfg.Retry.attempts()
+	for n := 1; ; n++ {
+		err = s.Login()
+		if err == nil {
+			return s, nil
+		}
+
+		// A refusal is a wrong user or password; asking again won't change it.
+		le, ok := err.(*loginError)
+		if n >= attempts || errors.Is(err, errLoginRefused) || !ok || !retryable(le.err, loginMethod) {
+			conn.Close()
+			return nil, err
+		}
+
+		s.log.Warn("login failed, retrying", "attempt", n, "attempts", attempts, jetlog.KeyError, err)
+		if !cfg.Retry.Sleep(context.Background(), n) {
+			conn.Close()
+			return nil, err
+		}
+	}
+}
+
+// dialOptions builds the gRPC dial options for the session.
+func (s *Session) dialOptions() ([]grpc.DialOption, error) {
+	var opts []grpc.DialOption
+
+	// If we're running with TLS
+	if s.cfg.TLS.Enabled() {
+		creds, warnings, err := loadTLS(&s.cfg)
+		if err != nil {
+			return nil, err
+		}
+		for _, w := range warnings {
+			s.log.Warn(w)
+		}
+		opts = append(opts, grpc.WithTransportCredentials(creds))
+	} else { // Else we're not running with TLS
+		opts = append(opts, grpc.WithInsecure())
+	}
+
+	if ka := s.cfg.Keepalive.dialOption(); ka != nil {
+		opts = append(opts, ka)
+	}
+
+	opts = append(opts, grpc.WithUnaryInterceptor(s.unaryInterceptor))
+	opts = append(opts, grpc.WithStreamInterceptor(s.streamInterceptor))
+
+	return opts, nil
+}
+
+// loginRequest builds the LoginCheck request from the session config.
+func (s *Session) loginRequest() *auth.LoginRequest {
+	return &auth.LoginRequest{
+		UserName: s.cfg.User,
+		Password: s.cfg.Password,
+		ClientId: s.cfg.ClientID,
+	}
+}
+
+// Login performs a LoginCheck against the JET auth API on the existing connection.
+func (s *Session) Login() error {
+	ctx, cancel := s.Context()
+	defer cancel()
+
+	r, err := auth.NewLoginClient(s.conn).LoginCheck(ctx, s.loginRequest())
+	if err != nil {
+		return &loginError{target: s.cfg.Target(), err: err}
+	}
+	if !r.GetResult() {
+		return fmt.Errorf("jetclient: login to %s as %q: %w", s.cfg.Target(), s.cfg.User, errLoginRefused)
+	}
+
+	return nil
+}
+
+// loginError keeps the gRPC error from LoginCheck so Dial can classify it.
+type loginError struct {
+	target string
+	err    error
+}
+
+func (e *loginError) Error() string {
+	return fmt.Sprintf("jetclient: could not login to %s. Check IP address or domain name: %v", e.target, e.err)
+}
+
+// Context returns a context bounded by the session timeout.
+func (s *Session) Context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.cfg.Timeout)
+}
+
+// StreamContext returns a context for a streaming read, bounded by the stream
+// timeout rather than the unary one. Cancel it to stop the read early.
+func (s *Session) StreamContext() (context.Context, context.CancelFunc) {
+	if s.cfg.StreamTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), s.cfg.StreamTimeout)
+}
+
+// Config returns a copy of the configuration the session was opened with.
+func (s *Session) Config() Config {
+	return s.cfg
+}
+
+// Target returns the "host:port" string of the session.
+func (s *Session) Target() string {
+	return s.cfg.Target()
+}
+
+// Conn returns the underlying gRPC connection for services this package does not wrap.
+func (s *Session) Conn() *grpc.ClientConn {
+	return s.conn
+}
+
+// BgpRoute returns a client for the bgp_route service.
+func (s *Session) BgpRoute() routing.BgpRouteClient {
+	return routing.NewBgpRouteClient(s.conn)
+}
+
+// Management returns a client for the management service.
+func (s *Session) Management() mng.ManagementRpcApiClient {
+	return mng.NewManagementRpcApiClient(s.conn)
+}
+
+// BgpRouteInitialize binds this client ID to the bgp_route service.
+// Both SUCCESS and SUCCESS_STATE_REBOUND are treated as success; the status is
+// returned so callers can tell whether routes from a previous session survived.
+func (s *Session) BgpRouteInitialize() (routing.BgpRouteInitializeReply_BgpRouteInitializeStatus, error) {
+	ctx, cancel := s.Context()
+	defer cancel()
+
+	reply, err := s.BgpRoute().BgpRouteInitialize(ctx, &routing.BgpRouteInitializeRequest{})
+	if err != nil {
+		return 0, fmt.Errorf("jetclient: could not connect to BGP service: %v", err)
+	}
+
+	status := routing.BgpRouteInitializeReply_BgpRouteInitializeStatus(reply.Status)
+	if status != routing.BgpRouteInitializeReply_SUCCESS && status != routing.BgpRouteInitializeReply_SUCCESS_STATE_REBOUND {
+		return status, fmt.Errorf("jetclient: BGP route API init: %s", status.String())
+	}
+
+	s.mu.Lock()
+	s.bgpInit = true
+	s.mu.Unlock()
+
+	return status, nil
+}
+
+// Close tears down the gRPC connection.
+func (s *Session) Close() error {
+	return s.conn.Close()
+}
+
+// secondsValue is a flag.Value for a time.Duration expressed as whole seconds,
+// which keeps -timeout compatible with the integer flag the tools used to have.
+type secondsValue time.Duration
+
+func (v *secondsValue) String() string {
+	return fmt.Sprint(int(time.Duration(*v) / time.Second))
+}
+
+func (v *secondsValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid timeout %q", s)
+	}
+	*v = secondsValue(time.Duration(n) * time.Second)
+	return nil
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jetclient
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetlog"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetmock"
+)
+
+func TestDialRefused(t *testing.T) {
+	srv := jetmock.New()
+	srv.AddUser("jet", "secret")
+	if err := srv.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	// A retry would wait an hour before asking again.
+	host, port, _ := net.SplitHostPort(srv.Addr())
+	cfg := Config{
+		Host:     host,
+		Port:     port,
+		User:     "jet",
+		Password: "wrong",
+		Timeout:  DefaultTimeout,
+		Retry:    RetryPolicy{Attempts: 3, InitialBackoff: time.Hour},
+		Logger:   jetlog.New(ioutil.Discard, jetlog.FormatText, jetlog.LevelError),
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		s, err := Dial(cfg)
+		if err == nil {
+			s.Close()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, errLoginRefused) {
+			t.Errorf("Dial = %v, want a login refusal", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Dial retried a refused login")
+	}
+}
@@ -0,0 +1,217 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jetclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// DefaultExpiryWarning is how close to expiry a client certificate has to be before
+// the pre-flight check warns about it.
+const DefaultExpiryWarning = 30 * 24 * time.Hour
+
+// TLSConfig describes how to secure the gRPC connection. Files named explicitly
+// take precedence over the client.crt, client.key and CA.crt files in CertDir.
+type TLSConfig struct {
+	CertDir       string        // Directory with client.crt, client.key, CA.crt
+	CertFile      string        // Client certificate (PEM)
+	KeyFile       string        // Client key (PEM)
+	CAFile        string        // CA certificate(s) used to verify Junos (PEM)
+	ServerName    string        // Name to verify in the Junos certificate. Defaults to the host.
+	MinVersion    string        // Minimum TLS version: "1.0", "1.1" or "1.2". Empty is the Go default.
+	SystemRoots   bool          // Trust the system root pool as well as CAFile
+	ExpiryWarning time.Duration // Warn when the client certificate expires within this window
+}
+
+// registerFlags registers the TLS flags on fs.
+func (t *TLSConfig) registerFlags(fs *flag.FlagSet) {
+	t.ExpiryWarning = DefaultExpiryWarning
+	fs.StringVar(&t.CertDir, "certdir", "", "Directory with client.crt, client.key, CA.crt")
+	fs.StringVar(&t.CertFile, "cert", "", "Client certificate file. Overrides client.crt in -certdir")
+	fs.StringVar(&t.KeyFile, "key", "", "Client key file. Overrides client.key in -certdir")
+	fs.StringVar(&t.CAFile, "ca", "", "CA certificate file. Overrides CA.crt in -certdir")
+	fs.StringVar(&t.ServerName, "servername", "", "Server name expected in the Junos certificate (default -host)")
+	fs.StringVar(&t.MinVersion, "tls-min-version", "", "Minimum TLS version: 1.0, 1.1 or 1.2")
+	fs.BoolVar(&t.SystemRoots, "system-roots", false, "Also trust the system root CA pool")
+}
+
+// Enabled reports whether any TLS setting is present. With none the connection is clear text.
+func (t *TLSConfig) Enabled() bool {
+	return t.CertDir != "" || t.CertFile != "" || t.KeyFile != "" || t.CAFile != "" || t.SystemRoots
+}
+
+// fromDir returns explicit if set, otherwise name inside CertDir (or "" without one).
+func (t *TLSConfig) fromDir(explicit, name string) string {
+	if explicit != "" {
+		return explicit
+	}
+	if t.CertDir == "" {
+		return ""
+	}
+	return filepath.Join(t.CertDir, name)
+}
+
+// Files returns the certificate, key and CA file paths that will be used.
+func (t *TLSConfig) Files() (certFile, keyFile, caFile string) {
+	return t.fromDir(t.CertFile, "client.crt"), t.fromDir(t.KeyFile, "client.key"), t.fromDir(t.CAFile, "CA.crt")
+}
+
+// tlsVersions maps the -tls-min-version values on to crypto/tls constants.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+}
+
+// Build loads the certificates and returns a tls.Config for connecting to host.
+// The returned warnings come from the pre-flight check of the client certificate;
+// they do not stop the connection, but usually explain why it later fails.
+func (t *TLSConfig) Build(host string) (*tls.Config, []string, error) {
+	certFile, keyFile, caFile := t.Files()
+
+	conf := &tls.Config{ServerName: host}
+	if t.ServerName != "" {
+		conf.ServerName = t.ServerName
+	}
+
+	if t.MinVersion != "" {
+		v, ok := tlsVersions[t.MinVersion]
+		if !ok {
+			return nil, nil, fmt.Errorf("jetclient: unsupported TLS version %q", t.MinVersion)
+		}
+		conf.MinVersion = v
+	}
+
+	// Create certPool for CA
+	certPool := x509.NewCertPool()
+	if t.SystemRoots {
+		sys, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, nil, fmt.Errorf("jetclient: could not load system root pool: %v", err)
+		}
+		certPool = sys
+	}
+
+	if caFile != "" {
+		// Get CA
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("jetclient: could not read CA certificate: %v", err)
+		}
+
+		// Append CA cert to pool
+		if ok := certPool.AppendCertsFromPEM(ca); !ok {
+			return nil, nil, fmt.Errorf("jetclient: failed to append CA certificate from %s", caFile)
+		}
+	} else if !t.SystemRoots {
+		return nil, nil, errors.New("jetclient: TLS needs a CA certificate or -system-roots")
+	}
+	conf.RootCAs = certPool
+
+	var warnings []string
+
+	// A client certificate is optional, but it has to come with its key.
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, nil, errors.New("jetclient: client certificate and key must be given together")
+		}
+
+		// Grab x509 cert/key for client
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("jetclient: could not load client certificate: %v", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+
+		warnings, err = t.preflight(cert, certPool)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return conf, warnings, nil
+}
+
+// preflight checks the client certificate for imminent expiry and for a chain to the CA.
+func (t *TLSConfig) preflight(cert tls.Certificate, roots *x509.CertPool) ([]string, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("jetclient: client certificate file holds no certificate")
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("jetclient: could not parse client certificate: %v", err)
+	}
+
+	var warnings []string
+
+	now := time.Now()
+	switch {
+	case now.After(leaf.NotAfter):
+		warnings = append(warnings, fmt.Sprintf("client certificate %q expired on %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339)))
+	case now.Before(leaf.NotBefore):
+		warnings = append(warnings, fmt.Sprintf("client certificate %q is not valid until %s", leaf.Subject.CommonName, leaf.NotBefore.Format(time.RFC3339)))
+	case leaf.NotAfter.Sub(now) < t.ExpiryWarning:
+		warnings = append(warnings, fmt.Sprintf("client certificate %q expires in %s on %s", leaf.Subject.CommonName, leaf.NotAfter.Sub(now).Round(time.Hour), leaf.NotAfter.Format(time.RFC3339)))
+	}
+
+	// Any further certificates in the file are treated as intermediates.
+	intermediates := x509.NewCertPool()
+	for _, der := range cert.Certificate[1:] {
+		if c, err := x509.ParseCertificate(der); err == nil {
+			intermediates.AddCert(c)
+		}
+	}
+
+	// The leaf's own dates were reported above. Check the chain as of a time
+	// the leaf is valid, so an expired certificate doesn't hide a wrong CA too.
+	at := now
+	if now.After(leaf.NotAfter) || now.Before(leaf.NotBefore) {
+		at = leaf.NotBefore
+	}
+
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   at,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		warnings = append(warnings, fmt.Sprintf("client certificate %q does not chain to the CA: %v", leaf.Subject.CommonName, err))
+	}
+
+	return warnings, nil
+}
+
+// loadTLS builds transport credentials from cfg.TLS, returning any pre-flight warnings.
+func loadTLS(cfg *Config) (credentials.TransportCredentials, []string, error) {
+	conf, warnings, err := cfg.TLS.Build(cfg.Host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// build creds
+	return credentials.NewTLS(conf), warnings, nil
+}
@@ -0,0 +1,299 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jetclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// issuer is a certificate that can sign others, and its key.
+type issuer struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// certDir is a scratch directory to write generated certificates into.
+type certDir struct {
+	t   *testing.T
+	dir string
+	n   int
+}
+
+func newCertDir(t *testing.T) *certDir {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "jetclient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &certDir{t: t, dir: dir}
+}
+
+// issue makes a certificate for name valid from notBefore to notAfter, signed
+// by parent or self-signed when parent is nil.
+func (d *certDir) issue(name string, isCA bool, notBefore, notAfter time.Time, parent *issuer) *issuer {
+	d.t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		d.t.Fatal(err)
+	}
+
+	d.n++
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(int64(d.n)),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+
+	signer := &issuer{cert: tmpl, key: key}
+	if parent != nil {
+		signer = parent
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer.cert, &key.PublicKey, signer.key)
+	if err != nil {
+		d.t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		d.t.Fatal(err)
+	}
+	return &issuer{cert: cert, key: key}
+}
+
+// write saves certs as one PEM file and returns its path.
+func (d *certDir) write(name string, certs ...*issuer) string {
+	d.t.Helper()
+	var data []byte
+	for _, c := range certs {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})...)
+	}
+	return d.save(name, data)
+}
+
+// writeKey saves the key of c and returns its path.
+func (d *certDir) writeKey(name string, c *issuer) string {
+	d.t.Helper()
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		d.t.Fatal(err)
+	}
+	return d.save(name, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+}
+
+func (d *certDir) save(name string, data []byte) string {
+	d.t.Helper()
+	path := filepath.Join(d.dir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		d.t.Fatal(err)
+	}
+	return path
+}
+
+// trusted reports whether conf would accept a certificate issued by c.
+func trusted(conf *tls.Config, c *issuer) bool {
+	_, err := c.cert.Verify(x509.VerifyOptions{Roots: conf.RootCAs, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	return err == nil
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	d := newCertDir(t)
+	defer os.RemoveAll(d.dir)
+	now := time.Now()
+	caFile := d.write("CA.crt", d.issue("ca", true, now.Add(-time.Hour), now.Add(time.Hour), nil))
+
+	tests := []struct {
+		version string
+		want    uint16
+		err     bool
+	}{
+		{"", 0, false},
+		{"1.0", tls.VersionTLS10, false},
+		{"1.1", tls.VersionTLS11, false},
+		{"1.2", tls.VersionTLS12, false},
+		{"1.3", 0, true},
+		{"TLS1.2", 0, true},
+	}
+
+	for _, tt := range tests {
+		tc := TLSConfig{CAFile: caFile, MinVersion: tt.version}
+		conf, _, err := tc.Build("router")
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: no error", tt.version)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.version, err)
+			continue
+		}
+		if conf.MinVersion != tt.want {
+			t.Errorf("%q: MinVersion = %#x, want %#x", tt.version, conf.MinVersion, tt.want)
+		}
+	}
+}
+
+func TestTLSServerName(t *testing.T) {
+	d := newCertDir(t)
+	defer os.RemoveAll(d.dir)
+	now := time.Now()
+	caFile := d.write("CA.crt", d.issue("ca", true, now.Add(-time.Hour), now.Add(time.Hour), nil))
+
+	tests := []struct {
+		override string
+		want     string
+	}{
+		{"", "10.0.0.1"},
+		{"router.example.net", "router.example.net"},
+	}
+
+	for _, tt := range tests {
+		tc := TLSConfig{CAFile: caFile, ServerName: tt.override}
+		conf, _, err := tc.Build("10.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conf.ServerName != tt.want {
+			t.Errorf("-servername %q: ServerName = %q, want %q", tt.override, conf.ServerName, tt.want)
+		}
+	}
+}
+
+func TestTLSRoots(t *testing.T) {
+	d := newCertDir(t)
+	defer os.RemoveAll(d.dir)
+	now := time.Now()
+	ca := d.issue("ca", true, now.Add(-time.Hour), now.Add(time.Hour), nil)
+	caFile := d.write("CA.crt", ca)
+	junos := d.issue("junos", false, now.Add(-time.Hour), now.Add(time.Hour), ca)
+	notPEM := d.save("junk.crt", []byte("not a certificate"))
+
+	if _, err := x509.SystemCertPool(); err != nil {
+		t.Skipf("no system root pool: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		tls     TLSConfig
+		trusted bool // Certificates issued by ca are accepted
+		err     string
+	}{
+		{"CA file", TLSConfig{CAFile: caFile}, true, ""},
+		{"system roots", TLSConfig{SystemRoots: true}, false, ""},
+		{"system roots and CA file", TLSConfig{SystemRoots: true, CAFile: caFile}, true, ""},
+		{"neither", TLSConfig{CertFile: "client.crt"}, false, "needs a CA certificate"},
+		{"missing CA file", TLSConfig{CAFile: filepath.Join(d.dir, "missing.crt")}, false, "could not read CA"},
+		{"not PEM", TLSConfig{CAFile: notPEM}, false, "failed to append"},
+	}
+
+	for _, tt := range tests {
+		conf, _, err := tt.tls.Build("router")
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := trusted(conf, junos); got != tt.trusted {
+			t.Errorf("%s: trusts the CA = %v, want %v", tt.name, got, tt.trusted)
+		}
+	}
+}
+
+func TestTLSPreflight(t *testing.T) {
+	d := newCertDir(t)
+	defer os.RemoveAll(d.dir)
+	now := time.Now()
+	year := 365 * 24 * time.Hour
+	ca := d.issue("ca", true, now.Add(-year), now.Add(year), nil)
+	caFile := d.write("CA.crt", ca)
+	other := d.issue("other ca", true, now.Add(-year), now.Add(year), nil)
+	intermediate := d.issue("intermediate", true, now.Add(-year), now.Add(year), ca)
+
+	tests := []struct {
+		name     string
+		cert     *issuer
+		chain    []*issuer // Further certificates in the certificate file
+		warnings []string  // Substrings, in order
+	}{
+		{"valid", d.issue("valid", false, now.Add(-time.Hour), now.Add(year), ca), nil, nil},
+		{"expiring", d.issue("expiring", false, now.Add(-time.Hour), now.Add(10*24*time.Hour), ca), nil, []string{`"expiring" expires in`}},
+		{"expired", d.issue("expired", false, now.Add(-year), now.Add(-time.Hour), ca), nil, []string{`"expired" expired on`}},
+		{"not yet valid", d.issue("early", false, now.Add(time.Hour), now.Add(year), ca), nil, []string{`"early" is not valid until`}},
+		{"other CA", d.issue("stranger", false, now.Add(-time.Hour), now.Add(year), other), nil, []string{`"stranger" does not chain to the CA`}},
+		{"expired and other CA", d.issue("both", false, now.Add(-year), now.Add(-time.Hour), other), nil, []string{`"both" expired on`, `"both" does not chain to the CA`}},
+		{"intermediate", d.issue("leaf", false, now.Add(-time.Hour), now.Add(year), intermediate), []*issuer{intermediate}, nil},
+		{"missing intermediate", d.issue("orphan", false, now.Add(-time.Hour), now.Add(year), intermediate), nil, []string{`"orphan" does not chain to the CA`}},
+	}
+
+	for _, tt := range tests {
+		tc := TLSConfig{
+			CAFile:        caFile,
+			CertFile:      d.write(tt.name+".crt", append([]*issuer{tt.cert}, tt.chain...)...),
+			KeyFile:       d.writeKey(tt.name+".key", tt.cert),
+			ExpiryWarning: DefaultExpiryWarning,
+		}
+		conf, warnings, err := tc.Build("router")
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(conf.Certificates) != 1 {
+			t.Errorf("%s: %d client certificates, want 1", tt.name, len(conf.Certificates))
+		}
+		if len(warnings) != len(tt.warnings) {
+			t.Errorf("%s: warnings %q, want %q", tt.name, warnings, tt.warnings)
+			continue
+		}
+		for i, w := range tt.warnings {
+			if !strings.Contains(warnings[i], w) {
+				t.Errorf("%s: warning %q, want %q", tt.name, warnings[i], w)
+			}
+		}
+	}
+
+	// The key has to come with the certificate.
+	tc := TLSConfig{CAFile: caFile, CertFile: d.write("alone.crt", ca)}
+	if _, _, err := tc.Build("router"); err == nil || !strings.Contains(err.Error(), "must be given together") {
+		t.Errorf("certificate without a key: %v", err)
+	}
+}
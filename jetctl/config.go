@@ -0,0 +1,155 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// configEnv names the config file when -config is not given.
+const configEnv = "JETCTL_CONFIG"
+
+// globalSection is the config file table for the global flags.
+const globalSection = "global"
+
+// configPath returns the config file to read and whether it has to exist.
+func configPath(flagValue string) (string, bool) {
+	if flagValue != "" {
+		return flagValue, true
+	}
+	if p := os.Getenv(configEnv); p != "" {
+		return p, true
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		return filepath.Join(home, ".jet", "jetctl.toml"), false
+	}
+	return "", false
+}
+
+// applyConfig sets every flag that was not given on the command line from the
+// config file. Keys are flag names; [global] holds the global flags and a table
+// named after the command group (e.g. [route]) holds that command's flags, which
+// win over [global]:
+//
+//	[global]
+//	host    = "vmx01"
+//	certdir = "/etc/jet/certs"
+//
+//	[route]
+//	routesfile = "/etc/jet/routes.toml"
+//
+// A key in the command's table that belongs to another command of the same group,
+// as given by groupFlags, is skipped rather than refused.
+func applyConfig(fs *flag.FlagSet, flagValue, section string, groupFlags map[string]bool) error {
+	path, required := configPath(flagValue)
+	if path == "" {
+		return nil
+	}
+
+	var file map[string]map[string]interface{}
+	if _, err := toml.DecodeFile(path, &file); err != nil {
+		if os.IsNotExist(err) && !required {
+			return nil
+		}
+		return fmt.Errorf("jetctl: config file %s: %v", path, err)
+	}
+
+	// Catch typos in table names, which would otherwise be ignored quietly.
+	known := map[string]bool{globalSection: true}
+	for _, c := range commands {
+		known[c.section()] = true
+	}
+	for name := range file {
+		if !known[name] {
+			return fmt.Errorf("jetctl: config file %s: unknown table [%s]", path, name)
+		}
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	for _, name := range []string{section, globalSection} {
+		values := file[name]
+
+		// Sorted so that errors come out the same way every time
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if fs.Lookup(k) == nil {
+				if name == section && groupFlags[k] {
+					continue
+				}
+				return fmt.Errorf("jetctl: config file %s: [%s] %s is not a flag of this command", path, name, k)
+			}
+			if set[k] {
+				continue
+			}
+
+			v, err := flagString(values[k])
+			if err != nil {
+				return fmt.Errorf("jetctl: config file %s: [%s] %s: %v", path, name, k, err)
+			}
+			if err := fs.Set(k, v); err != nil {
+				return fmt.Errorf("jetctl: config file %s: [%s] %s: %v", path, name, k, err)
+			}
+			set[k] = true
+		}
+	}
+
+	return nil
+}
+
+// flagString turns a TOML value in to the string the flag would get on the command line.
+func flagString(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case string:
+		return t, nil
+	case int64, float64, bool:
+		return fmt.Sprint(t), nil
+	case time.Time:
+		return t.Format(time.RFC3339), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
+
+// groupFlags returns the names of the flags of every command in section. It has
+// to be called before the command's own flags are registered, because registering
+// a flag resets the option behind it to its default.
+func groupFlags(section string) map[string]bool {
+	names := make(map[string]bool)
+	for _, c := range commands {
+		if c.section() != section || c.flags == nil {
+			continue
+		}
+		fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+		c.flags(fs)
+		fs.VisitAll(func(f *flag.Flag) { names[f.Name] = true })
+	}
+	return names
+}
@@ -0,0 +1,364 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// jetctl is the one binary for the JET demos: route programming, op commands
+// and the MQTT bridge, sharing the connection flags and a config file.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/bgproutes"
+	"github.com/arsonistgopher/junos-jet-demo-apps/inventory"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetaudit"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetclient"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetlog"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetmetrics"
+	"github.com/arsonistgopher/junos-jet-demo-apps/mqttbridge"
+	"github.com/arsonistgopher/junos-jet-demo-apps/opcmd"
+)
+
+// version is set when building a release: go build -ldflags "-X main.version=1.0.0"
+var version = "dev"
+
+// globals are the flags every command takes. They can go before or after the command.
+type globals struct {
+	config  string           // Config file
+	version bool             // Print the version and exit
+	jet     jetclient.Config // Connection details for the JET session
+	inv     inventory.Flags  // Devices to run against instead of -host
+	log     jetlog.Flags     // Log level and format
+	metrics jetmetrics.Flags // Prometheus /metrics listener
+	audit   jetaudit.Flags   // RPC audit log
+}
+
+func (g *globals) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&g.config, "config", "", "Config file (default $"+configEnv+" or ~/.jet/jetctl.toml if it exists)")
+	fs.BoolVar(&g.version, "version", false, "Print the version and exit")
+	g.jet.RegisterFlags(fs)
+	g.inv.RegisterFlags(fs)
+	g.log.RegisterFlags(fs)
+	g.metrics.RegisterFlags(fs)
+	g.audit.RegisterFlags(fs)
+}
+
+// startMetrics serves /metrics and times every JET RPC, if -metrics-listen was given.
+func (g *globals) startMetrics(logger *jetlog.Logger) error {
+	if !g.metrics.Enabled() {
+		return nil
+	}
+	jetmetrics.RegisterRPC()
+	g.jet.Interceptors = append(g.jet.Interceptors, jetmetrics.UnaryClientInterceptor)
+	g.jet.StreamInterceptors = append(g.jet.StreamInterceptors, jetmetrics.StreamClientInterceptor)
+	return g.metrics.Serve(logger)
+}
+
+// command is one jetctl command. Names with a space are a group and a verb.
+type command struct {
+	name    string                                        // e.g. "route add"
+	summary string                                        // One line for the help
+	flags   func(fs *flag.FlagSet)                        // Registers the command's own flags, may be nil
+	run     func(g *globals, logger *jetlog.Logger) error // Does the work
+}
+
+// section is the config file table holding the command's flags, e.g. [route].
+func (c *command) section() string {
+	return strings.Fields(c.name)[0]
+}
+
+// The options for each subsystem, filled in by the command's flags.
+var (
+	routeOpts  bgproutes.Options
+	opOpts     opcmd.Options
+	bridgeOpts mqttbridge.Options
+)
+
+var commands = []*command{
+	{
+		name:    "route add",
+		summary: "Add the BGP-Static routes in -routesfile",
+		flags:   routeOpts.RegisterFlags,
+		run:     routeRun(bgproutes.Add),
+	},
+	{
+		name:    "route del",
+		summary: "Delete the BGP-Static routes in -routesfile, or the ones the -delete-* flags pick",
+		flags: func(fs *flag.FlagSet) {
+			routeOpts.RegisterFlags(fs)
+			routeOpts.Delete.RegisterFlags(fs)
+		},
+		run: routeRun(bgproutes.Del),
+	},
+	{
+		name:    "route mod",
+		summary: "Change the attributes of BGP-Static paths already on the router",
+		flags:   routeOpts.RegisterFlags,
+		run:     routeRun(bgproutes.Mod),
+	},
+	{
+		name:    "route replace",
+		summary: "Add the BGP-Static routes in -routesfile, overwriting paths already there",
+		flags:   routeOpts.RegisterFlags,
+		run:     routeRun(bgproutes.Replace),
+	},
+	{
+		name:    "route sync",
+		summary: "Add, modify and delete BGP-Static routes until the router matches -routesfile",
+		flags:   routeOpts.RegisterFlags,
+		run:     routeRun(bgproutes.Sync),
+	},
+	{
+		name:    "route cleanup",
+		summary: "Withdraw every BGP-Static route this -cid has programmed",
+		flags:   routeOpts.RegisterCleanupFlags,
+		run:     routeRun(bgproutes.Cleanup),
+	},
+	{
+		name:    "route purge-timeout",
+		summary: "Commit how long the router keeps routes after their client goes, unless it is set already",
+		flags:   routeOpts.RegisterPurgeFlags,
+		run:     routeRun(bgproutes.Purge),
+	},
+	{
+		name:    "route daemon",
+		summary: "Daemonise and keep the router in line with -routesfile as it changes",
+		flags: func(fs *flag.FlagSet) {
+			routeOpts.RegisterFlags(fs)
+			routeOpts.Watch.RegisterFlags(fs)
+		},
+		run: func(g *globals, logger *jetlog.Logger) error {
+			// The daemon starts its own metrics listener, in the child.
+			return routeOpts.RunDaemon(g.jet, &g.inv, &g.log, &g.metrics)
+		},
+	},
+	{
+		name:    "route get",
+		summary: "Print the BGP-Static routes on the router that match -prefix",
+		flags:   routeOpts.RegisterGetFlags,
+		run:     routeRun(bgproutes.Get),
+	},
+	{
+		name:    "route list",
+		summary: "Same as route get",
+		flags:   routeOpts.RegisterGetFlags,
+		run:     routeRun(bgproutes.Get),
+	},
+	{
+		name:    "route monitor",
+		summary: "Print changes to the routes on the router that match -prefix as they happen",
+		flags:   routeOpts.RegisterGetFlags,
+		run:     routeRun(bgproutes.Monitor),
+	},
+	{
+		name:    "op",
+		summary: "Run an operational command and print the output",
+		flags:   opOpts.RegisterFlags,
+		run: func(g *globals, logger *jetlog.Logger) error {
+			if err := g.startMetrics(logger); err != nil {
+				return err
+			}
+			return opOpts.Run(g.jet, &g.inv, logger, os.Stdout)
+		},
+	},
+	{
+		name:    "bridge run",
+		summary: "Daemonise and copy MQTT messages on -topic in to eventd",
+		flags:   bridgeOpts.RegisterFlags,
+		run: func(g *globals, logger *jetlog.Logger) error {
+			// The bridge starts its own metrics listener, in the daemon.
+			return bridgeOpts.Run(&g.log, &g.metrics)
+		},
+	},
+	{
+		name:    "version",
+		summary: "Print the version",
+		run: func(g *globals, logger *jetlog.Logger) error {
+			printVersion(os.Stdout)
+			return nil
+		},
+	},
+}
+
+func routeRun(verb bgproutes.Verb) func(g *globals, logger *jetlog.Logger) error {
+	return func(g *globals, logger *jetlog.Logger) error {
+		if err := g.startMetrics(logger); err != nil {
+			return err
+		}
+		return routeOpts.Run(verb, g.jet, &g.inv, logger)
+	}
+}
+
+func printVersion(w io.Writer) {
+	fmt.Fprintf(w, "jetctl %s (%s %s/%s)\n", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+// lookup finds the command named by the start of args and returns it with the
+// number of words used.
+func lookup(args []string) (*command, int, error) {
+	for _, c := range commands {
+		words := strings.Fields(c.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == c.name {
+			return c, len(words), nil
+		}
+	}
+
+	// A group on its own, e.g. "jetctl route", gets a list of its verbs.
+	var verbs []string
+	for _, c := range commands {
+		if words := strings.Fields(c.name); len(words) > 1 && words[0] == args[0] {
+			verbs = append(verbs, words[1])
+		}
+	}
+	if len(verbs) > 0 {
+		return nil, 0, fmt.Errorf("jetctl: %s needs one of: %s", args[0], strings.Join(verbs, ", "))
+	}
+
+	return nil, 0, fmt.Errorf("jetctl: unknown command %q, see 'jetctl help'", strings.Join(args, " "))
+}
+
+// usage prints the top level help.
+func usage(w io.Writer) {
+	fmt.Fprint(w, "jetctl drives Junos over the JET gRPC APIs.\n\nUsage:\n  jetctl [global flags] <command> [flags]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-12s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(w, "  %-12s %s\n", "help", "Help for a command")
+
+	fmt.Fprint(w, "\nGlobal flags:\n")
+	fs := flag.NewFlagSet("jetctl", flag.ContinueOnError)
+	new(globals).registerFlags(fs)
+	fs.SetOutput(w)
+	fs.PrintDefaults()
+}
+
+// commandUsage prints the help for one command.
+func commandUsage(w io.Writer, c *command) {
+	fmt.Fprintf(w, "Usage:\n  jetctl [global flags] %s [flags]\n\n%s.\n", c.name, c.summary)
+	if c.flags != nil {
+		fmt.Fprint(w, "\nFlags:\n")
+		fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+		c.flags(fs)
+		fs.SetOutput(w)
+		fs.PrintDefaults()
+	}
+	fmt.Fprint(w, "\nThe global flags are listed by 'jetctl help'.\n")
+}
+
+// help handles "jetctl help [command]".
+func help(args []string) int {
+	if len(args) == 0 {
+		usage(os.Stdout)
+		return 0
+	}
+	c, _, err := lookup(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	commandUsage(os.Stdout, c)
+	return 0
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run parses the command line and runs the command, returning the exit status.
+func run(args []string) int {
+	var g globals
+
+	// Global flags first, then the command, then the command's flags. The command's
+	// flags go in to the same set so that the global flags work after it too.
+	fs := flag.NewFlagSet("jetctl", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() { usage(os.Stderr) }
+	g.registerFlags(fs)
+
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+
+	if g.version {
+		printVersion(os.Stdout)
+		return 0
+	}
+
+	rest := fs.Args()
+	if len(rest) == 0 {
+		usage(os.Stderr)
+		return 2
+	}
+	if rest[0] == "help" {
+		return help(rest[1:])
+	}
+
+	c, n, err := lookup(rest)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	group := groupFlags(c.section())
+	if c.flags != nil {
+		c.flags(fs)
+	}
+	fs.Usage = func() { commandUsage(os.Stderr, c) }
+	if err := fs.Parse(rest[n:]); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "jetctl: unexpected argument %q\n", fs.Arg(0))
+		return 2
+	}
+
+	// Anything not given on the command line comes from the config file
+	if err := applyConfig(fs, g.config, c.section(), group); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	logger, err := g.log.New(os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	// Record every RPC, if asked
+	auditor, err := g.audit.Install(&g.jet)
+	if err != nil {
+		logger.Error("No audit log", jetlog.KeyError, err)
+		return 1
+	}
+	defer auditor.Close()
+
+	if err := c.run(&g, logger); err != nil {
+		logger.Error("Failed", jetlog.KeyError, err)
+		return 1
+	}
+
+	return 0
+}
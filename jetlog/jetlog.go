@@ -0,0 +1,315 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package jetlog is the structured, leveled logger shared by the tools in this
+// repository. A log line is a message plus key/value pairs, written as plain
+// text, logfmt or JSON so that a log pipeline can parse it.
+//
+//	logger := jetlog.New(os.Stderr, jetlog.FormatLogfmt, jetlog.LevelInfo)
+//	logger = logger.With(jetlog.KeyDevice, "vmx01")
+//	logger.Info("route added", jetlog.KeyCookie, cookie, jetlog.KeyDuration, time.Since(start))
+//
+// Use the Key constants for the common fields so every tool names them the same way.
+package jetlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Common field names.
+const (
+	KeyDevice   = "device"   // Device name or host:port
+	KeyRPC      = "rpc"      // Full gRPC method name
+	KeyTopic    = "topic"    // MQTT topic
+	KeyCookie   = "cookie"   // Path cookie
+	KeyDuration = "duration" // How long something took
+	KeyError    = "error"    // An error
+)
+
+// Level is the severity of a log line.
+type Level int
+
+// Levels, least severe first.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel turns "debug", "info", "warn" or "error" into a Level.
+func ParseLevel(s string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(s, n) {
+			return Level(i), nil
+		}
+	}
+	if strings.EqualFold(s, "warning") {
+		return LevelWarn, nil
+	}
+	return LevelInfo, fmt.Errorf("jetlog: unknown level %q", s)
+}
+
+// Output formats.
+const (
+	FormatText   = "text"
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
+)
+
+// sink is shared by a Logger and everything derived from it with With.
+type sink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+	level  Level
+}
+
+// Logger writes structured log lines. It is safe for concurrent use.
+type Logger struct {
+	sink   *sink
+	fields []interface{}
+}
+
+// New returns a Logger writing lines at or above level to w in format.
+// An unknown format falls back to text.
+func New(w io.Writer, format string, level Level) *Logger {
+	switch format {
+	case FormatText, FormatLogfmt, FormatJSON:
+	default:
+		format = FormatText
+	}
+	return &Logger{sink: &sink{w: w, format: format, level: level}}
+}
+
+var (
+	defaultMu     sync.Mutex
+	defaultLogger = New(os.Stderr, FormatText, LevelInfo)
+)
+
+// Default returns the process wide logger used by the library packages.
+func Default() *Logger {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	return defaultLogger
+}
+
+// SetDefault replaces the process wide logger.
+func SetDefault(l *Logger) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultLogger = l
+}
+
+// With returns a Logger that adds the key/value pairs to every line.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{sink: l.sink, fields: fields}
+}
+
+// Enabled reports whether lines at level would be written.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.sink.level
+}
+
+// Debug logs at debug level.
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+
+// Info logs at info level.
+func (l *Logger) Info(msg string, kv ...interface{}) { l.log(LevelInfo, msg, kv) }
+
+// Warn logs at warn level.
+func (l *Logger) Warn(msg string, kv ...interface{}) { l.log(LevelWarn, msg, kv) }
+
+// Error logs at error level.
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+// Fatal logs at error level and exits with status 1. Only main should call it.
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+	os.Exit(1)
+}
+
+// Write lets a Logger stand in as an io.Writer, for log.SetOutput and friends.
+// Each write becomes one info line.
+func (l *Logger) Write(p []byte) (int, error) {
+	l.log(LevelInfo, strings.TrimRight(string(p), "\n"), nil)
+	return len(p), nil
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	fields := l.fields
+	if len(kv) > 0 {
+		fields = append(append(make([]interface{}, 0, len(fields)+len(kv)), fields...), kv...)
+	}
+	if len(fields)%2 != 0 {
+		fields = append(fields, "MISSING")
+	}
+
+	var buf bytes.Buffer
+	now := time.Now()
+
+	switch l.sink.format {
+	case FormatJSON:
+		writeJSON(&buf, now, level, msg, fields)
+	case FormatLogfmt:
+		writeLogfmt(&buf, now, level, msg, fields)
+	default:
+		writeText(&buf, now, level, msg, fields)
+	}
+
+	l.sink.mu.Lock()
+	l.sink.w.Write(buf.Bytes())
+	l.sink.mu.Unlock()
+}
+
+// value converts a field value into something printable.
+func value(v interface{}) interface{} {
+	switch t := v.(type) {
+	case nil:
+		return nil
+	case error:
+		return t.Error()
+	case time.Duration:
+		return t.String()
+	case time.Time:
+		return t.Format(time.RFC3339Nano)
+	case fmt.Stringer:
+		return t.String()
+	default:
+		return v
+	}
+}
+
+func writeText(buf *bytes.Buffer, now time.Time, level Level, msg string, fields []interface{}) {
+	buf.WriteString(now.Format("2006/01/02 15:04:05"))
+	fmt.Fprintf(buf, " %-5s %s", strings.ToUpper(level.String()), msg)
+	for i := 0; i < len(fields); i += 2 {
+		buf.WriteByte(' ')
+		buf.WriteString(fmt.Sprint(fields[i]))
+		buf.WriteByte('=')
+		buf.WriteString(logfmtValue(value(fields[i+1])))
+	}
+	buf.WriteByte('\n')
+}
+
+func writeLogfmt(buf *bytes.Buffer, now time.Time, level Level, msg string, fields []interface{}) {
+	buf.WriteString("time=")
+	buf.WriteString(now.Format(time.RFC3339Nano))
+	buf.WriteString(" level=")
+	buf.WriteString(level.String())
+	buf.WriteString(" msg=")
+	buf.WriteString(logfmtValue(msg))
+	for i := 0; i < len(fields); i += 2 {
+		buf.WriteByte(' ')
+		buf.WriteString(fmt.Sprint(fields[i]))
+		buf.WriteByte('=')
+		buf.WriteString(logfmtValue(value(fields[i+1])))
+	}
+	buf.WriteByte('\n')
+}
+
+// logfmtValue quotes a value if it contains anything other than plain characters.
+func logfmtValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" {
+		return `""`
+	}
+	if strings.IndexFunc(s, func(r rune) bool { return r <= ' ' || r == '=' || r == '"' || r > '~' }) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func writeJSON(buf *bytes.Buffer, now time.Time, level Level, msg string, fields []interface{}) {
+	// Build the object by hand to keep the fields in order.
+	buf.WriteString(`{"time":`)
+	writeJSONValue(buf, now.Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSONValue(buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(buf, msg)
+	for i := 0; i < len(fields); i += 2 {
+		buf.WriteByte(',')
+		writeJSONValue(buf, fmt.Sprint(fields[i]))
+		buf.WriteByte(':')
+		writeJSONValue(buf, value(fields[i+1]))
+	}
+	buf.WriteString("}\n")
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+// Flags are the command line flags for configuring a Logger.
+type Flags struct {
+	Level  string // debug, info, warn or error
+	Format string // text, logfmt or json
+}
+
+// RegisterFlags registers -log-level and -log-format on fs.
+func (f *Flags) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&f.Level, "log-level", "info", "Log level: debug, info, warn or error")
+	fs.StringVar(&f.Format, "log-format", FormatText, "Log format: text, logfmt or json")
+}
+
+// New returns a Logger writing to w as the flags describe, and makes it the default.
+func (f *Flags) New(w io.Writer) (*Logger, error) {
+	level, err := ParseLevel(f.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	switch f.Format {
+	case FormatText, FormatLogfmt, FormatJSON:
+	default:
+		return nil, fmt.Errorf("jetlog: unknown format %q", f.Format)
+	}
+
+	l := New(w, f.Format, level)
+	SetDefault(l)
+
+	return l, nil
+}
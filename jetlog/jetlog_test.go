@@ -0,0 +1,185 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jetlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// timestamps matches the time in each format, which golden output can't hold.
+var timestamps = regexp.MustCompile(`(?m)^\d{4}/\d\d/\d\d \d\d:\d\d:\d\d|time=\S+|"time":"[^"]*"`)
+
+// golden returns what was logged to buf with the times replaced by TIME.
+func golden(buf *bytes.Buffer) string {
+	return timestamps.ReplaceAllStringFunc(buf.String(), func(s string) string {
+		switch {
+		case strings.HasPrefix(s, "time="):
+			return "time=TIME"
+		case strings.HasPrefix(s, `"time"`):
+			return `"time":"TIME"`
+		default:
+			return "TIME"
+		}
+	})
+}
+
+func TestLevels(t *testing.T) {
+	tests := []struct {
+		level Level
+		want  string
+	}{
+		{LevelDebug, "TIME DEBUG d\nTIME INFO  i\nTIME WARN  w n=1\nTIME ERROR e\n"},
+		{LevelInfo, "TIME INFO  i\nTIME WARN  w n=1\nTIME ERROR e\n"},
+		{LevelWarn, "TIME WARN  w n=1\nTIME ERROR e\n"},
+		{LevelError, "TIME ERROR e\n"},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		l := New(&buf, FormatText, tt.level)
+		l.Debug("d")
+		l.Info("i")
+		l.Warn("w", "n", 1)
+		l.Error("e")
+
+		if got := golden(&buf); got != tt.want {
+			t.Errorf("%v:\n%s\nwant:\n%s", tt.level, got, tt.want)
+		}
+		if l.Enabled(LevelInfo) != (tt.level <= LevelInfo) {
+			t.Errorf("%v: Enabled(info) = %v", tt.level, l.Enabled(LevelInfo))
+		}
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Level
+		err  bool
+	}{
+		{"debug", LevelDebug, false},
+		{"INFO", LevelInfo, false},
+		{"warn", LevelWarn, false},
+		{"Warning", LevelWarn, false},
+		{"error", LevelError, false},
+		{"trace", LevelInfo, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseLevel(tt.s)
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("ParseLevel(%q) = %v, %v", tt.s, got, err)
+		}
+	}
+}
+
+func TestWith(t *testing.T) {
+	var buf bytes.Buffer
+	base := New(&buf, FormatLogfmt, LevelInfo)
+	dev := base.With(KeyDevice, "mx01")
+	add := dev.With(KeyRPC, "/routing.BgpRoute/BgpRouteAdd")
+	other := dev.With(KeyCookie, 7)
+
+	add.Info("sent", KeyCookie, 5)
+	other.Info("sent")
+	dev.Info("done")
+	base.Info("bye")
+
+	want := `time=TIME level=info msg=sent device=mx01 rpc=/routing.BgpRoute/BgpRouteAdd cookie=5
+time=TIME level=info msg=sent device=mx01 cookie=7
+time=TIME level=info msg=done device=mx01
+time=TIME level=info msg=bye
+`
+	if got := golden(&buf); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLogfmtQuoting(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want string
+	}{
+		{"plain", "plain"},
+		{"two words", `"two words"`},
+		{"a=b", `"a=b"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{"", `""`},
+		{"tab\there", `"tab\there"`},
+		{"café", `"café"`},
+		{errors.New("no route"), `"no route"`},
+		{1500 * time.Millisecond, "1.5s"},
+		{LevelWarn, "warn"},
+		{42, "42"},
+		{nil, "<nil>"},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		New(&buf, FormatLogfmt, LevelInfo).Info("m", "v", tt.v)
+		if got, want := golden(&buf), "time=TIME level=info msg=m v="+tt.want+"\n"; got != want {
+			t.Errorf("%#v: %q, want %q", tt.v, got, want)
+		}
+	}
+
+	var buf bytes.Buffer
+	New(&buf, FormatLogfmt, LevelInfo).Info("route added", "lonely")
+	if got, want := golden(&buf), "time=TIME level=info msg=\"route added\" lonely=MISSING\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, FormatJSON, LevelInfo).With(KeyDevice, "mx01")
+	l.Info("he said \"hi\"\n<b>",
+		"err", errors.New(`bad "thing"`),
+		"n", 3,
+		"ok", true,
+		"none", nil,
+		KeyDuration, 2*time.Second,
+		"severity", LevelError,
+		"complex", 1+2i, // json can't encode it, so it is printed
+	)
+
+	want := `{"time":"TIME","level":"info","msg":"he said \"hi\"\n\u003cb\u003e","device":"mx01","err":"bad \"thing\"","n":3,"ok":true,"none":null,"duration":"2s","severity":"error","complex":"(1+2i)"}` + "\n"
+	if got := golden(&buf); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if !json.Valid(buf.Bytes()) {
+		t.Errorf("not valid JSON: %s", buf.String())
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	var buf bytes.Buffer
+	New(&buf, "xml", LevelInfo).Info("m", "k", "v")
+	if got, want := golden(&buf), "TIME INFO  m k=v\n"; got != want {
+		t.Errorf("got %q, want text %q", got, want)
+	}
+
+	f := Flags{Level: "info", Format: "xml"}
+	if _, err := f.New(&buf); err == nil {
+		t.Error("Flags.New accepted format xml")
+	}
+}
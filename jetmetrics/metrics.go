@@ -0,0 +1,247 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package jetmetrics holds the Prometheus metrics exported by the tools in this
+// repository and the optional HTTP listener that serves them on /metrics.
+//
+// Each tool registers only the metrics it produces:
+//
+//	jetmetrics.RegisterRPC()
+//	cfg.jet.Interceptors = append(cfg.jet.Interceptors, jetmetrics.UnaryClientInterceptor)
+//	cfg.jet.StreamInterceptors = append(cfg.jet.StreamInterceptors, jetmetrics.StreamClientInterceptor)
+//	if err := mf.Serve(logger); err != nil { ... }
+package jetmetrics
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetclient"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetlog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const namespace = "jet"
+
+// MQTT bridge metrics.
+var (
+	MQTTReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "mqtt",
+		Name:      "messages_received_total",
+		Help:      "MQTT messages received, by topic.",
+	}, []string{"topic"})
+
+	MQTTForwarded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "mqtt",
+		Name:      "events_forwarded_total",
+		Help:      "Messages passed on to eventd, by topic.",
+	}, []string{"topic"})
+
+	MQTTForwardFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "mqtt",
+		Name:      "forward_failures_total",
+		Help:      "Messages that could not be passed on to eventd, by topic.",
+	}, []string{"topic"})
+
+	MQTTLoggerExec = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "mqtt",
+		Name:      "logger_exec_seconds",
+		Help:      "Time taken to run the logger command for one message.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	MQTTReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "mqtt",
+		Name:      "reconnects_total",
+		Help:      "Times the connection to the MQTT broker was re-established.",
+	})
+
+	MQTTConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "mqtt",
+		Name:      "connected",
+		Help:      "1 while connected to the MQTT broker, 0 otherwise.",
+	})
+)
+
+// JET RPC metrics.
+var (
+	RPCDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "rpc",
+		Name:      "duration_seconds",
+		Help:      "Latency of JET RPCs, by full method name. Retries are counted separately. For streaming RPCs it is the time to the first reply.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	RPCStatus = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "rpc",
+		Name:      "status_total",
+		Help:      "JET RPC results, by full method name and status: the JET status in the reply, OK for replies without one, or the gRPC code on error.",
+	}, []string{"method", "status"})
+)
+
+// Route daemon metrics.
+var (
+	RouteSyncs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "routes",
+		Name:      "syncs_total",
+		Help:      "Times the route daemon brought the device in line with the routes file, by reason and result.",
+	}, []string{"reason", "result"})
+
+	RouteChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "routes",
+		Name:      "changes_total",
+		Help:      "Paths the route daemon added, modified or deleted, by action.",
+	}, []string{"action"})
+
+	RouteLastSync = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "routes",
+		Name:      "last_sync_success_timestamp_seconds",
+		Help:      "Unix time of the last sync that succeeded.",
+	})
+)
+
+// RegisterMQTT registers the MQTT bridge metrics with the default registry.
+func RegisterMQTT() {
+	prometheus.MustRegister(MQTTReceived, MQTTForwarded, MQTTForwardFailures, MQTTLoggerExec, MQTTReconnects, MQTTConnected)
+}
+
+// RegisterRPC registers the JET RPC metrics with the default registry.
+func RegisterRPC() {
+	prometheus.MustRegister(RPCDuration, RPCStatus)
+}
+
+// RegisterRoutes registers the route daemon metrics with the default registry.
+func RegisterRoutes() {
+	prometheus.MustRegister(RouteSyncs, RouteChanges, RouteLastSync)
+}
+
+// UnaryClientInterceptor records the latency and result of every unary JET RPC.
+// Add it to jetclient.Config.Interceptors after calling RegisterRPC.
+func UnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	observe(method, start, reply, err)
+	return err
+}
+
+// observe records one RPC that took since start and ended with reply or err.
+func observe(method string, start time.Time, reply interface{}, err error) {
+	RPCDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+
+	st := "OK"
+	if err != nil {
+		st = status.Code(err).String()
+	} else if s := jetclient.ReplyStatus(reply); s != "" {
+		st = s
+	}
+	RPCStatus.WithLabelValues(method, st).Inc()
+}
+
+// StreamClientInterceptor records streaming RPCs such as BgpRouteGet,
+// BgpRouteMonitorRegister and ExecuteOpCommand, once each, when the first reply
+// (or error) comes back: a monitor stream may never end. Add it to
+// jetclient.Config.StreamInterceptors after calling RegisterRPC.
+func StreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	start := time.Now()
+	cs, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		observe(method, start, nil, err)
+		return nil, err
+	}
+
+	return &metricsStream{ClientStream: cs, method: method, start: start}, nil
+}
+
+// metricsStream records the stream on its first reply.
+type metricsStream struct {
+	grpc.ClientStream
+	method string
+	start  time.Time
+	once   sync.Once
+}
+
+func (s *metricsStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	s.once.Do(func() {
+		// A stream with no replies at all ended fine.
+		if err == io.EOF {
+			observe(s.method, s.start, nil, nil)
+		} else {
+			observe(s.method, s.start, m, err)
+		}
+	})
+	return err
+}
+
+// Flags are the command line flags for the metrics listener.
+type Flags struct {
+	Listen string // Address for the /metrics listener. Empty disables it.
+}
+
+// RegisterFlags registers -metrics-listen on fs.
+func (f *Flags) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&f.Listen, "metrics-listen", "", "Address to serve Prometheus metrics on, e.g. :9273. Empty disables")
+}
+
+// Enabled reports whether a metrics listener was asked for.
+func (f *Flags) Enabled() bool {
+	return f.Listen != ""
+}
+
+// Serve starts serving /metrics in the background if a listen address was given.
+// Failing to bind is returned; errors after that are logged.
+func (f *Flags) Serve(logger *jetlog.Logger) error {
+	if !f.Enabled() {
+		return nil
+	}
+
+	lis, err := net.Listen("tcp", f.Listen)
+	if err != nil {
+		return fmt.Errorf("jetmetrics: could not listen on %s: %v", f.Listen, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		if err := http.Serve(lis, mux); err != nil {
+			logger.Error("Metrics listener stopped", jetlog.KeyError, err)
+		}
+	}()
+	logger.Info("Serving metrics", "addr", lis.Addr().String())
+
+	return nil
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jetmetrics
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetclient"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetlog"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetmock"
+	"github.com/arsonistgopher/junos-jet-demo-apps/opcmd"
+	mng "github.com/arsonistgopher/junos-jet-demo-apps/proto/management"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+)
+
+func TestInterceptorsAgainstMock(t *testing.T) {
+	srv := jetmock.New()
+	srv.SetOpResponse("show version", "<software-information/>")
+	if err := srv.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	RegisterRPC()
+	host, port, _ := net.SplitHostPort(srv.Addr())
+	jet := jetclient.Config{
+		Host:               host,
+		Port:               port,
+		User:               "jet",
+		Password:           "secret",
+		ClientID:           "42",
+		Retry:              jetclient.RetryPolicy{Attempts: 1},
+		Interceptors:       []grpc.UnaryClientInterceptor{UnaryClientInterceptor},
+		StreamInterceptors: []grpc.StreamClientInterceptor{StreamClientInterceptor},
+	}
+	logger := jetlog.New(ioutil.Discard, "text", jetlog.LevelError)
+
+	for _, command := range []string{"show version", "show version", "show nothing"} {
+		opcmd.Execute(jet, command, mng.OperationFormatType_OPERATION_FORMAT_XML, logger)
+	}
+
+	const login = "/authentication.Login/LoginCheck"
+	const op = "/management.ManagementRpcApi/ExecuteOpCommand"
+	tests := []struct {
+		method, status string
+		want           float64
+	}{
+		{login, "OK", 3},
+		{op, mng.ReturnCode_SUCCESS.String(), 2},
+		{op, mng.ReturnCode_FAILURE.String(), 1},
+	}
+
+	for _, tt := range tests {
+		if got := testutil.ToFloat64(RPCStatus.WithLabelValues(tt.method, tt.status)); got != tt.want {
+			t.Errorf("%s %s counted %v times, want %v", tt.method, tt.status, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jetmock
+
+import (
+	"bytes"
+	"net"
+	"sort"
+
+	routing "github.com/arsonistgopher/junos-jet-demo-apps/proto/bgp_route"
+	prpd "github.com/arsonistgopher/junos-jet-demo-apps/proto/prpd_common"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// defaultPreference is the route preference Junos gives BGP-Static routes.
+const defaultPreference = 170
+
+// ribKey identifies a single path in the RIB.
+type ribKey struct {
+	table  string
+	prefix string // Canonical form from net.IP.String()
+	length uint32
+	cookie uint64
+}
+
+// rib is a deliberately simple RIB: a map of paths. It is not safe for
+// concurrent use; the Server mutex protects it.
+type rib struct {
+	paths   map[ribKey]*routing.BgpRouteEntry
+	owners  map[ribKey]string               // Client ID that added each path
+	changes []*routing.BgpRouteMonitorEntry // Not yet passed on to monitors
+}
+
+func newRib() *rib {
+	return &rib{paths: make(map[ribKey]*routing.BgpRouteEntry), owners: make(map[ribKey]string)}
+}
+
+// tableName returns the name of a RouteTable or "" if it has none.
+func tableName(t *prpd.RouteTable) string {
+	return t.GetRttName().GetName()
+}
+
+// prefixIP decodes a RoutePrefix of either address family.
+func prefixIP(p *prpd.RoutePrefix) net.IP {
+	if a := p.GetInet(); a != nil {
+		return net.ParseIP(a.GetAddrString())
+	}
+	if a := p.GetInet6(); a != nil {
+		return net.ParseIP(a.GetAddrString())
+	}
+	return nil
+}
+
+// keyOf validates the identifying fields of a route and returns its key.
+func keyOf(table *prpd.RouteTable, prefix *prpd.RoutePrefix, length uint32, cookie uint64) (ribKey, routing.BgpRouteOperReply_BgpRouteOperStatus) {
+	name := tableName(table)
+	if name == "" {
+		return ribKey{}, routing.BgpRouteOperReply_TABLE_INVALID
+	}
+
+	ip := prefixIP(prefix)
+	if ip == nil {
+		return ribKey{}, routing.BgpRouteOperReply_PREFIX_INVALID
+	}
+
+	bits := 32
+	if ip.To4() == nil {
+		bits = 128
+	}
+	if int(length) > bits {
+		return ribKey{}, routing.BgpRouteOperReply_PREFIX_LEN_TOO_LONG
+	}
+
+	return ribKey{table: name, prefix: ip.String(), length: length, cookie: cookie}, routing.BgpRouteOperReply_SUCCESS
+}
+
+// update applies entries in order for client. When mustExist is set the path
+// has to be present already (modify); when mustNotExist is set it must not be
+// (add). It stops at the first failure and reports how many entries were
+// applied, which mirrors the operations_completed field in BgpRouteOperReply.
+// A path added keeps the client that added it, even if another modifies it.
+func (r *rib) update(client string, entries []*routing.BgpRouteEntry, mustExist, mustNotExist bool) (uint32, routing.BgpRouteOperReply_BgpRouteOperStatus) {
+	for i, e := range entries {
+		key, status := keyOf(e.GetTable(), e.GetDestPrefix(), e.GetDestPrefixLen(), e.GetPathCookie())
+		if status != routing.BgpRouteOperReply_SUCCESS {
+			return uint32(i), status
+		}
+
+		if len(e.GetProtocolNexthops()) == 0 {
+			return uint32(i), routing.BgpRouteOperReply_NEXTHOP_INVALID
+		}
+		for _, nh := range e.GetProtocolNexthops() {
+			if net.ParseIP(nh.GetAddrString()) == nil {
+				return uint32(i), routing.BgpRouteOperReply_NEXTHOP_ADDRESS_INVALID
+			}
+		}
+
+		_, exists := r.paths[key]
+		if mustExist && !exists {
+			return uint32(i), routing.BgpRouteOperReply_ROUTE_NOT_FOUND
+		}
+		if mustNotExist && exists {
+			return uint32(i), routing.BgpRouteOperReply_ROUTE_EXISTS
+		}
+
+		// The router fills in the default preference when none was given
+		stored := proto.Clone(e).(*routing.BgpRouteEntry)
+		if stored.GetRoutePreference().GetValue() == 0 {
+			stored.RoutePreference = &routing.BgpAttrib32{Value: defaultPreference}
+		}
+		r.paths[key] = stored
+		if !exists {
+			r.owners[key] = client
+		}
+		r.changed(routing.BgpRouteMonitorEntry_ROUTE_UPDATE, stored)
+	}
+
+	return uint32(len(entries)), routing.BgpRouteOperReply_SUCCESS
+}
+
+// remove deletes every path matched by each BgpRouteMatch in turn.
+// A match that finds nothing is a ROUTE_NOT_FOUND failure.
+func (r *rib) remove(matches []*routing.BgpRouteMatch, orLonger bool) (uint32, routing.BgpRouteOperReply_BgpRouteOperStatus) {
+	for i, m := range matches {
+		keys, status := r.match(m, orLonger)
+		if status != routing.BgpRouteOperReply_SUCCESS {
+			return uint32(i), status
+		}
+		if len(keys) == 0 {
+			return uint32(i), routing.BgpRouteOperReply_ROUTE_NOT_FOUND
+		}
+		for _, k := range keys {
+			r.changed(routing.BgpRouteMonitorEntry_ROUTE_REMOVE, r.paths[k])
+			delete(r.paths, k)
+			delete(r.owners, k)
+		}
+	}
+
+	return uint32(len(matches)), routing.BgpRouteOperReply_SUCCESS
+}
+
+// clear removes every path client added, as BgpRouteCleanup does. Other
+// clients' paths stay.
+func (r *rib) clear(client string) {
+	var keys []ribKey
+	for k := range r.paths {
+		if r.owners[k] == client {
+			keys = append(keys, k)
+		}
+	}
+	sortKeys(keys)
+	for _, k := range keys {
+		r.changed(routing.BgpRouteMonitorEntry_ROUTE_REMOVE, r.paths[k])
+		delete(r.paths, k)
+		delete(r.owners, k)
+	}
+}
+
+// has reports whether client has any paths.
+func (r *rib) has(client string) bool {
+	for _, c := range r.owners {
+		if c == client {
+			return true
+		}
+	}
+	return false
+}
+
+// changed queues a notification for the monitors.
+func (r *rib) changed(op routing.BgpRouteMonitorEntry_BgpRouteMonitorOperation, e *routing.BgpRouteEntry) {
+	r.changes = append(r.changes, &routing.BgpRouteMonitorEntry{Operation: op, BgpRoute: proto.Clone(e).(*routing.BgpRouteEntry)})
+}
+
+// takeChanges returns the queued notifications and empties the queue.
+func (r *rib) takeChanges() []*routing.BgpRouteMonitorEntry {
+	c := r.changes
+	r.changes = nil
+	return c
+}
+
+// match returns the keys of all paths selected by m. A zero path cookie matches
+// every path of the prefix and PROTO_UNSPECIFIED matches every protocol.
+func (r *rib) match(m *routing.BgpRouteMatch, orLonger bool) ([]ribKey, routing.BgpRouteOperReply_BgpRouteOperStatus) {
+	want, status := keyOf(m.GetTable(), m.GetDestPrefix(), m.GetDestPrefixLen(), m.GetPathCookie())
+	if status != routing.BgpRouteOperReply_SUCCESS {
+		return nil, status
+	}
+
+	ip := net.ParseIP(want.prefix)
+	bits := 32
+	if ip.To4() == nil {
+		bits = 128
+	}
+	supernet := &net.IPNet{IP: ip.Mask(net.CIDRMask(int(want.length), bits)), Mask: net.CIDRMask(int(want.length), bits)}
+
+	var keys []ribKey
+	for k, e := range r.paths {
+		if k.table != want.table {
+			continue
+		}
+		if want.cookie != 0 && k.cookie != want.cookie {
+			continue
+		}
+		if m.GetProtocol() != routing.RouteProtocol_PROTO_UNSPECIFIED && e.GetProtocol() != m.GetProtocol() {
+			continue
+		}
+		if orLonger {
+			if k.length < want.length || !supernet.Contains(net.ParseIP(k.prefix)) {
+				continue
+			}
+		} else if k.prefix != want.prefix || k.length != want.length {
+			continue
+		}
+		keys = append(keys, k)
+	}
+
+	sortKeys(keys)
+
+	return keys, routing.BgpRouteOperReply_SUCCESS
+}
+
+// get returns copies of the paths selected by m.
+func (r *rib) get(m *routing.BgpRouteMatch, orLonger bool) ([]*routing.BgpRouteEntry, routing.BgpRouteOperReply_BgpRouteOperStatus) {
+	keys, status := r.match(m, orLonger)
+	if status != routing.BgpRouteOperReply_SUCCESS {
+		return nil, status
+	}
+
+	entries := make([]*routing.BgpRouteEntry, 0, len(keys))
+	for _, k := range keys {
+		entries = append(entries, proto.Clone(r.paths[k]).(*routing.BgpRouteEntry))
+	}
+
+	return entries, routing.BgpRouteOperReply_SUCCESS
+}
+
+// all returns copies of every path in the RIB.
+func (r *rib) all() []*routing.BgpRouteEntry {
+	keys := make([]ribKey, 0, len(r.paths))
+	for k := range r.paths {
+		keys = append(keys, k)
+	}
+	sortKeys(keys)
+
+	entries := make([]*routing.BgpRouteEntry, 0, len(keys))
+	for _, k := range keys {
+		entries = append(entries, proto.Clone(r.paths[k]).(*routing.BgpRouteEntry))
+	}
+
+	return entries
+}
+
+func sortKeys(keys []ribKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.table != b.table {
+			return a.table < b.table
+		}
+		if a.prefix != b.prefix {
+			return bytes.Compare(net.ParseIP(a.prefix), net.ParseIP(b.prefix)) < 0
+		}
+		if a.length != b.length {
+			return a.length < b.length
+		}
+		return a.cookie < b.cookie
+	})
+}
@@ -0,0 +1,219 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package jetmock is an in-process stand in for the JET gRPC server on Junos.
+// It implements the authentication, bgp_route and management services from the
+// compiled IDL, keeps an in-memory RIB of BgpRouteEntry objects and answers op
+// commands from a script, so the demo tools can be exercised without a vMX.
+//
+// Typical use from a test:
+//
+//	srv := jetmock.New()
+//	srv.AddUser("jet", "secret")
+//	srv.SetOpResponse("show version", "<software-information/>")
+//	if err := srv.Start("127.0.0.1:0"); err != nil {
+//		t.Fatal(err)
+//	}
+//	defer srv.Stop()
+//
+//	host, port, _ := net.SplitHostPort(srv.Addr())
+//	session, err := jetclient.Dial(jetclient.Config{Host: host, Port: port, User: "jet", Password: "secret", ClientID: "42"})
+package jetmock
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	auth "github.com/arsonistgopher/junos-jet-demo-apps/proto/auth"
+	routing "github.com/arsonistgopher/junos-jet-demo-apps/proto/bgp_route"
+	mng "github.com/arsonistgopher/junos-jet-demo-apps/proto/management"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+)
+
+// Server is a mock JET gRPC server.
+type Server struct {
+	mu          sync.Mutex
+	users       map[string]string // Username to password. Empty accepts any login.
+	opResponses map[string]string // CLI command to response data
+	rib         *rib              // Routes programmed through the bgp_route service
+	clients     map[string]string // Peer address to the client ID it logged in with
+	initialized map[string]bool   // Client IDs that have called BgpRouteInitialize
+	committed   []string          // Text configuration committed through ExecuteCfgCommand
+
+	// Open BgpRouteMonitorRegister streams, fed by publish
+	monitors map[chan *routing.BgpRouteMonitorEntry]bool
+	drop     chan struct{} // Closed by DropMonitors to end the open streams
+
+	grpc *grpc.Server
+	lis  net.Listener
+}
+
+// New returns a mock server. The options are passed to grpc.NewServer, which is
+// how TLS credentials can be supplied.
+func New(opts ...grpc.ServerOption) *Server {
+	s := &Server{
+		users:       make(map[string]string),
+		opResponses: make(map[string]string),
+		rib:         newRib(),
+		clients:     make(map[string]string),
+		initialized: make(map[string]bool),
+		monitors:    make(map[chan *routing.BgpRouteMonitorEntry]bool),
+		drop:        make(chan struct{}),
+		grpc:        grpc.NewServer(opts...),
+	}
+
+	auth.RegisterLoginServer(s.grpc, &loginServer{s: s})
+	routing.RegisterBgpRouteServer(s.grpc, &bgpRouteServer{s: s})
+	mng.RegisterManagementRpcApiServer(s.grpc, &managementServer{s: s})
+
+	return s
+}
+
+// AddUser adds a username and password that LoginCheck will accept.
+// Until the first user is added any credentials are accepted.
+func (s *Server) AddUser(user, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[user] = password
+}
+
+// SetOpResponse scripts the data returned by ExecuteOpCommand for a CLI command.
+func (s *Server) SetOpResponse(command, data string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opResponses[command] = data
+}
+
+// Committed returns the text configuration committed through ExecuteCfgCommand, oldest first.
+func (s *Server) Committed() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.committed...)
+}
+
+// Start listens on addr and serves in a background go routine.
+// Use "127.0.0.1:0" to pick a free port and Addr to find out which.
+func (s *Server) Start(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	if err := s.setListener(lis); err != nil {
+		lis.Close()
+		return err
+	}
+
+	go s.grpc.Serve(lis)
+
+	return nil
+}
+
+// Serve accepts connections on lis until Stop is called.
+func (s *Server) Serve(lis net.Listener) error {
+	if err := s.setListener(lis); err != nil {
+		return err
+	}
+
+	return s.grpc.Serve(lis)
+}
+
+func (s *Server) setListener(lis net.Listener) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lis != nil {
+		return errors.New("jetmock: server already serving")
+	}
+	s.lis = lis
+
+	return nil
+}
+
+// Addr returns the address the server is listening on, or "" if it is not serving.
+func (s *Server) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lis == nil {
+		return ""
+	}
+	return s.lis.Addr().String()
+}
+
+// Stop closes the listener and all open connections.
+func (s *Server) Stop() {
+	s.grpc.Stop()
+}
+
+// Routes returns a snapshot of the RIB, ordered by table, prefix and path cookie.
+func (s *Server) Routes() []*routing.BgpRouteEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rib.all()
+}
+
+// publish passes the RIB changes on to every monitor. A monitor too far behind
+// to take them has its channel closed, which ends its stream. The caller holds s.mu.
+func (s *Server) publish() {
+	for _, e := range s.rib.takeChanges() {
+		for ch := range s.monitors {
+			select {
+			case ch <- e:
+			default:
+				close(ch)
+				delete(s.monitors, ch)
+			}
+		}
+	}
+}
+
+// errMonitorDropped ends the monitor streams DropMonitors breaks.
+var errMonitorDropped = errors.New("jetmock: monitor stream dropped")
+
+// DropMonitors ends every open BgpRouteMonitorRegister stream with an error, the
+// way a restart of the JET daemon would. Changes made afterwards are only seen
+// by monitors that register again.
+func (s *Server) DropMonitors() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(s.drop)
+	s.drop = make(chan struct{})
+	s.monitors = make(map[chan *routing.BgpRouteMonitorEntry]bool)
+}
+
+// Reset empties the RIB and forgets that the bgp_route service was initialized.
+// Monitors are not told; it is for starting a test afresh.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rib = newRib()
+	s.initialized = make(map[string]bool)
+}
+
+// clientOf is the client ID the connection a call came in on logged in with,
+// the way the router ties a channel to the client_id in LoginRequest. The
+// caller holds s.mu.
+func (s *Server) clientOf(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return s.clients[p.Addr.String()]
+	}
+	return ""
+}
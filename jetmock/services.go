@@ -0,0 +1,277 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package jetmock
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc/peer"
+
+	auth "github.com/arsonistgopher/junos-jet-demo-apps/proto/auth"
+	routing "github.com/arsonistgopher/junos-jet-demo-apps/proto/bgp_route"
+	mng "github.com/arsonistgopher/junos-jet-demo-apps/proto/management"
+)
+
+// loginServer implements the authentication service.
+type loginServer struct {
+	s *Server
+}
+
+func (l *loginServer) LoginCheck(ctx context.Context, req *auth.LoginRequest) (*auth.LoginReply, error) {
+	l.s.mu.Lock()
+	defer l.s.mu.Unlock()
+
+	if len(l.s.users) == 0 {
+		l.s.login(ctx, req.GetClientId())
+		return &auth.LoginReply{Result: true}, nil
+	}
+
+	password, ok := l.s.users[req.GetUserName()]
+	ok = ok && password == req.GetPassword()
+	if ok {
+		l.s.login(ctx, req.GetClientId())
+	}
+	return &auth.LoginReply{Result: ok}, nil
+}
+
+// login ties the connection ctx came in on to clientID. The caller holds s.mu.
+func (s *Server) login(ctx context.Context, clientID string) {
+	if p, ok := peer.FromContext(ctx); ok {
+		s.clients[p.Addr.String()] = clientID
+	}
+}
+
+// bgpRouteServer implements the bgp_route service on top of the mock RIB.
+// The embedded interface is nil; any RPC not implemented here panics, which
+// is loud enough to notice in a test.
+type bgpRouteServer struct {
+	routing.BgpRouteServer
+	s *Server
+}
+
+func (b *bgpRouteServer) BgpRouteInitialize(ctx context.Context, req *routing.BgpRouteInitializeRequest) (*routing.BgpRouteInitializeReply, error) {
+	b.s.mu.Lock()
+	defer b.s.mu.Unlock()
+
+	// Routes the client ID still has from an earlier session are rebound to it.
+	client := b.s.clientOf(ctx)
+	status := routing.BgpRouteInitializeReply_SUCCESS
+	if b.s.rib.has(client) {
+		status = routing.BgpRouteInitializeReply_SUCCESS_STATE_REBOUND
+	}
+	b.s.initialized[client] = true
+
+	return &routing.BgpRouteInitializeReply{Status: status}, nil
+}
+
+func (b *bgpRouteServer) BgpRouteCleanup(ctx context.Context, req *routing.BgpRouteCleanupRequest) (*routing.BgpRouteCleanupReply, error) {
+	b.s.mu.Lock()
+	defer b.s.mu.Unlock()
+
+	b.s.rib.clear(b.s.clientOf(ctx))
+	b.s.publish()
+
+	return &routing.BgpRouteCleanupReply{Status: routing.BgpRouteCleanupReply_SUCCESS}, nil
+}
+
+func (b *bgpRouteServer) BgpRouteAdd(ctx context.Context, req *routing.BgpRouteUpdateRequest) (*routing.BgpRouteOperReply, error) {
+	return b.update(ctx, req, false, true), nil
+}
+
+func (b *bgpRouteServer) BgpRouteModify(ctx context.Context, req *routing.BgpRouteUpdateRequest) (*routing.BgpRouteOperReply, error) {
+	return b.update(ctx, req, true, false), nil
+}
+
+func (b *bgpRouteServer) BgpRouteUpdate(ctx context.Context, req *routing.BgpRouteUpdateRequest) (*routing.BgpRouteOperReply, error) {
+	return b.update(ctx, req, false, false), nil
+}
+
+func (b *bgpRouteServer) update(ctx context.Context, req *routing.BgpRouteUpdateRequest, mustExist, mustNotExist bool) *routing.BgpRouteOperReply {
+	b.s.mu.Lock()
+	defer b.s.mu.Unlock()
+
+	client := b.s.clientOf(ctx)
+	if !b.s.initialized[client] {
+		return &routing.BgpRouteOperReply{Status: routing.BgpRouteOperReply_NOT_INITIALIZED}
+	}
+
+	completed, status := b.s.rib.update(client, req.GetBgpRoutes(), mustExist, mustNotExist)
+	b.s.publish()
+
+	return &routing.BgpRouteOperReply{Status: status, OperationsCompleted: completed}
+}
+
+func (b *bgpRouteServer) BgpRouteRemove(ctx context.Context, req *routing.BgpRouteRemoveRequest) (*routing.BgpRouteOperReply, error) {
+	b.s.mu.Lock()
+	defer b.s.mu.Unlock()
+
+	if !b.s.initialized[b.s.clientOf(ctx)] {
+		return &routing.BgpRouteOperReply{Status: routing.BgpRouteOperReply_NOT_INITIALIZED}, nil
+	}
+
+	completed, status := b.s.rib.remove(req.GetBgpRoutes(), req.GetOrLonger())
+	b.s.publish()
+
+	return &routing.BgpRouteOperReply{Status: status, OperationsCompleted: completed}, nil
+}
+
+func (b *bgpRouteServer) BgpRouteGet(req *routing.BgpRouteGetRequest, stream routing.BgpRoute_BgpRouteGetServer) error {
+	b.s.mu.Lock()
+	if !b.s.initialized[b.s.clientOf(stream.Context())] {
+		b.s.mu.Unlock()
+		return stream.Send(&routing.BgpRouteGetReply{Status: routing.BgpRouteGetReply_NOT_INITIALIZED})
+	}
+	entries, status := b.s.rib.get(req.GetBgpRoute(), req.GetOrLonger())
+	b.s.mu.Unlock()
+
+	switch status {
+	case routing.BgpRouteOperReply_SUCCESS:
+	case routing.BgpRouteOperReply_TABLE_INVALID:
+		return stream.Send(&routing.BgpRouteGetReply{Status: routing.BgpRouteGetReply_TABLE_INVALID})
+	default:
+		return stream.Send(&routing.BgpRouteGetReply{Status: routing.BgpRouteGetReply_REQUEST_UNSUPPORTED})
+	}
+
+	if len(entries) == 0 {
+		return stream.Send(&routing.BgpRouteGetReply{Status: routing.BgpRouteGetReply_PREFIX_NOT_FOUND})
+	}
+
+	// Honour route_count by chunking the reply over several stream messages.
+	count := int(req.GetRouteCount())
+	if count <= 0 {
+		count = len(entries)
+	}
+	for len(entries) > 0 {
+		n := count
+		if n > len(entries) {
+			n = len(entries)
+		}
+		if err := stream.Send(&routing.BgpRouteGetReply{Status: routing.BgpRouteGetReply_SUCCESS, BgpRoutes: entries[:n]}); err != nil {
+			return err
+		}
+		entries = entries[n:]
+	}
+
+	return nil
+}
+
+// monitorBacklog is how many notifications a monitor may fall behind by before
+// its stream is closed.
+const monitorBacklog = 1024
+
+func (b *bgpRouteServer) BgpRouteMonitorRegister(req *routing.BgpRouteMonitorRegRequest, stream routing.BgpRoute_BgpRouteMonitorRegisterServer) error {
+	// Take the snapshot and start listening together, so no change falls in between
+	ch := make(chan *routing.BgpRouteMonitorEntry, monitorBacklog)
+	b.s.mu.Lock()
+	entries := b.s.rib.all()
+	b.s.monitors[ch] = true
+	drop := b.s.drop
+	b.s.mu.Unlock()
+
+	defer func() {
+		b.s.mu.Lock()
+		defer b.s.mu.Unlock()
+		if b.s.monitors[ch] {
+			delete(b.s.monitors, ch)
+			close(ch)
+		}
+	}()
+
+	// Everything in the RIB first, honouring route_count, then end-of-ribs
+	count := int(req.GetRouteCount())
+	if count <= 0 {
+		count = len(entries)
+	}
+	for len(entries) > 0 {
+		n := count
+		if n > len(entries) {
+			n = len(entries)
+		}
+		reply := &routing.BgpRouteMonitorReply{}
+		for _, e := range entries[:n] {
+			reply.MonitorReply = append(reply.MonitorReply, &routing.BgpRouteMonitorEntry{Operation: routing.BgpRouteMonitorEntry_ROUTE_UPDATE, BgpRoute: e})
+		}
+		if err := stream.Send(reply); err != nil {
+			return err
+		}
+		entries = entries[n:]
+	}
+	eor := &routing.BgpRouteMonitorEntry{Operation: routing.BgpRouteMonitorEntry_END_OF_RIBS}
+	if err := stream.Send(&routing.BgpRouteMonitorReply{MonitorReply: []*routing.BgpRouteMonitorEntry{eor}}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return fmt.Errorf("jetmock: monitor fell more than %d changes behind", monitorBacklog)
+			}
+			if err := stream.Send(&routing.BgpRouteMonitorReply{MonitorReply: []*routing.BgpRouteMonitorEntry{e}}); err != nil {
+				return err
+			}
+		case <-drop:
+			return errMonitorDropped
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// managementServer implements ExecuteOpCommand from scripted responses, and
+// ExecuteCfgCommand by keeping what is committed.
+type managementServer struct {
+	mng.ManagementRpcApiServer
+	s *Server
+}
+
+func (m *managementServer) ExecuteOpCommand(req *mng.ExecuteOpCommandRequest, stream mng.ManagementRpcApi_ExecuteOpCommandServer) error {
+	m.s.mu.Lock()
+	data, ok := m.s.opResponses[req.GetCliCommand()]
+	m.s.mu.Unlock()
+
+	if !ok {
+		return stream.Send(&mng.ExecuteOpCommandResponse{
+			RequestId: req.GetRequestId(),
+			Status:    mng.ReturnCode_FAILURE,
+			Message:   fmt.Sprintf("syntax error: %q", req.GetCliCommand()),
+		})
+	}
+
+	return stream.Send(&mng.ExecuteOpCommandResponse{
+		RequestId: req.GetRequestId(),
+		Status:    mng.ReturnCode_SUCCESS,
+		Data:      data,
+	})
+}
+
+func (m *managementServer) ExecuteCfgCommand(ctx context.Context, req *mng.ExecuteCfgCommandRequest) (*mng.ExecuteCfgCommandResponse, error) {
+	cfg := req.GetTextConfig()
+	if cfg == "" {
+		return &mng.ExecuteCfgCommandResponse{RequestId: req.GetRequestId(), Status: mng.ReturnCode_FAILURE, Message: "only text configuration is supported"}, nil
+	}
+
+	// Loaded but not committed is as good as nothing
+	if req.GetCommit() != nil {
+		m.s.mu.Lock()
+		m.s.committed = append(m.s.committed, cfg)
+		m.s.mu.Unlock()
+	}
+
+	return &mng.ExecuteCfgCommandResponse{RequestId: req.GetRequestId(), Status: mng.ReturnCode_SUCCESS}, nil
+}
@@ -0,0 +1,284 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mqttbridge copies messages from a topic on the Junos MQTT broker in to
+// eventd with the 'logger' utility. It is the engine behind mqtt_bridge and
+// "jetctl bridge run".
+package mqttbridge
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetlog"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetmetrics"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/sevlyar/go-daemon"
+)
+
+// CLID is a temporary CLID
+const CLID = "junos-jet-bridge"
+
+// VERSION is a version string
+const VERSION = "0.1a"
+
+// Prototype for func call: createListener(HOST, CLID, TOPIC, PID, CHAN, ERRS, WG, LOGGER)
+// Errors that stop the listener are sent on ERRS rather than exiting from inside the Go routine.
+func createListener(HOST string, CLID string, TOPIC string, PID int, DONE chan bool, ERRS chan<- error, WG *sync.WaitGroup, logger *jetlog.Logger) {
+	logger = logger.With(jetlog.KeyTopic, TOPIC)
+	logger.Info("Connect", "broker", HOST)
+
+	WG.Add(1)
+	go func(HOST string, CLID string, TOPIC string, HEARTBEAT chan bool, WG *sync.WaitGroup) {
+		defer WG.Done()
+
+		handler := func(client mqtt.Client, msg mqtt.Message) {
+			smsg := string(msg.Payload())
+			logger.Info("Received message", "message", smsg)
+			jetmetrics.MQTTReceived.WithLabelValues(TOPIC).Inc()
+
+			// 'logger' is the application that gives us the ability to send logs in to Junos.
+			// I did look at creating the serialisation for posting directly to eventd, but figured this:
+			// a) The underlying logging system could change and 'logger' is likely to be up to date
+			// b) As a result of a) I have to make fewer changes to this, so result?
+
+			binary, lookErr := exec.LookPath("logger")
+			if lookErr != nil {
+				logger.Error("Cannot find logger", jetlog.KeyError, lookErr)
+				jetmetrics.MQTTForwardFailures.WithLabelValues(TOPIC).Inc()
+				return
+			}
+
+			daemon := fmt.Sprintf("gojetmqttbridge[%v]", PID)
+
+			// Args that we're passing to logger
+			args := []string{"-d", daemon, "-e", "MSG_RECVD", smsg}
+
+			// Obtain a cmd struct to execute the named program with the given arguments.
+			// A failure loses this one message, so log it and carry on with the next.
+			start := time.Now()
+			cmd := exec.Command(binary, args...)
+			var out bytes.Buffer
+			cmd.Stdout = &out
+			err := cmd.Run()
+			jetmetrics.MQTTLoggerExec.Observe(time.Since(start).Seconds())
+			if err != nil {
+				logger.Error("Executing command for 'logger'", jetlog.KeyError, err)
+				jetmetrics.MQTTForwardFailures.WithLabelValues(TOPIC).Inc()
+				return
+			}
+			jetmetrics.MQTTForwarded.WithLabelValues(TOPIC).Inc()
+			logger.Debug("Message sent to eventd", jetlog.KeyDuration, time.Since(start))
+		}
+
+		// Paho reconnects by itself, but the subscription has to be made again each time
+		var connects int32
+		opts := mqtt.NewClientOptions().AddBroker(HOST).SetClientID(CLID).SetAutoReconnect(true)
+		opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			jetmetrics.MQTTConnected.Set(0)
+			logger.Warn("Connection lost, reconnecting", jetlog.KeyError, err)
+		})
+		opts.SetOnConnectHandler(func(client mqtt.Client) {
+			jetmetrics.MQTTConnected.Set(1)
+			if atomic.AddInt32(&connects, 1) == 1 {
+				return
+			}
+			jetmetrics.MQTTReconnects.Inc()
+			logger.Info("Reconnected")
+			if token := client.Subscribe(TOPIC, 0, handler); token.Wait() && token.Error() != nil {
+				logger.Error("Resubscribe failed", jetlog.KeyError, token.Error())
+			}
+		})
+
+		client := mqtt.NewClient(opts)
+		if token := client.Connect(); token.Wait() && token.Error() != nil {
+			ERRS <- fmt.Errorf("connect to %s: %v", HOST, token.Error())
+			return
+		}
+
+		if token := client.Subscribe(TOPIC, 0, handler); token.Wait() && token.Error() != nil {
+			client.Disconnect(250)
+			ERRS <- fmt.Errorf("subscribe to %s: %v", TOPIC, token.Error())
+			return
+		}
+		logger.Info("Subscribed")
+
+		for {
+			select {
+			case <-DONE:
+				// Handle Unsubscribe
+				if token := client.Unsubscribe(TOPIC); token.Wait() && token.Error() != nil {
+					logger.Warn("Unsubscribe failed", jetlog.KeyError, token.Error())
+				}
+
+				// Disconnect from MQTT
+				client.Disconnect(250)
+				// Return from Go Routine, the deferred WG.Done() signals we're done
+				return
+			}
+		}
+
+	}(HOST, CLID, TOPIC, DONE, WG)
+}
+
+// Options are the command line options for the bridge. The log and metrics
+// flags are registered separately by the caller.
+type Options struct {
+	Broker string // MQTT broker, e.g. tcp://127.0.0.1:1883
+	Topic  string // Topic for subscribing to MQTT
+}
+
+// RegisterFlags registers -broker and -topic on fs.
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Broker, "broker", "tcp://127.0.0.1:1883", "MQTT broker to subscribe to")
+	fs.StringVar(&o.Topic, "topic", "junos/MQTTBridge", "Topic for subscribing to MQTT")
+}
+
+// Run daemonises and bridges messages until SIGINT or SIGTERM. The parent process
+// returns as soon as the child has started; the child is re-executed with the same
+// command line, so it sees the same flags. logf and metf are only used in the child.
+func (o *Options) Run(logf *jetlog.Flags, metf *jetmetrics.Flags) error {
+	// Check the log flags before forking, so mistakes show up on the terminal
+	if _, err := logf.New(os.Stderr); err != nil {
+		return err
+	}
+
+	cntxt := &daemon.Context{
+		PidFileName: "pid",
+		PidFilePerm: 0644,
+		LogFileName: "log",
+		LogFilePerm: 0640,
+		WorkDir:     "./",
+		Umask:       027,
+		Args:        os.Args,
+	}
+
+	d, err := cntxt.Reborn()
+	if err != nil {
+		return fmt.Errorf("mqttbridge: unable to run: %v", err)
+	}
+	if d != nil {
+		return nil
+	}
+
+	// We get to here, we know we're the new child (from a forking point of view)
+	defer cntxt.Release()
+
+	lf, err := jetlog.NewLogFile(cntxt.LogFileName, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("mqttbridge: unable to create log file: %v", err)
+	}
+	logger, _ := logf.New(lf)
+	log.SetOutput(logger)
+	logger.Debug("Starting", "broker", o.Broker)
+
+	// Optional /metrics listener, so we can alert if forwarding stops
+	jetmetrics.RegisterMQTT()
+	if err := metf.Serve(logger); err != nil {
+		return err
+	}
+
+	// rotate log every 24 hours
+	rotateLogSignal := time.Tick(24 * time.Hour)
+
+	// Create a WaitGroup for various GRs
+	var WG sync.WaitGroup
+
+	// Log rotate channel for signalling it to close
+	lrchan := make(chan bool, 1)
+
+	WG.Add(1)
+	go func(lrc chan bool) {
+		for {
+			select {
+			case <-rotateLogSignal:
+				// Keep writing to the old file rather than dying over it
+				if err := lf.Rotate(); err != nil {
+					logger.Error("Unable to rotate log", jetlog.KeyError, err)
+				}
+			case <-lrc:
+				logger.Debug("Received kill signal for log rotation GR")
+				WG.Done()
+				return
+			}
+		}
+	}(lrchan)
+
+	PID := os.Getpid()
+
+	// Create signal channel and register signals of interest
+	sigs := make(chan os.Signal, 1)
+	sigDeath := make(chan bool, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	// Listener done channel and the channel it reports fatal errors on
+	lsnchan := make(chan bool, 1)
+	lsnerrs := make(chan error, 1)
+
+	// Create Go Routine listener (Go Routine happens in func). We might want many listeners...
+	createListener(o.Broker, CLID, o.Topic, PID, lsnchan, lsnerrs, &WG, logger)
+
+	// Create signal listener loop GR
+	go func() {
+		for {
+
+			select {
+			case c := <-sigs:
+
+				if c == syscall.SIGINT || c == syscall.SIGTERM {
+					// If we move to here, we know we've got a signal we need to do something about
+					// If our GR list starts to grow, this needs to be in a slice and we should iterate through them
+					lrchan <- true
+					lsnchan <- true
+					// Signal for Other GRs to exit
+
+					WG.Wait()
+
+					// Ok, everything else exited
+					// Signal to main
+					sigDeath <- true
+					return
+				}
+			}
+		}
+	}()
+
+	logger.Info("Starting", "version", VERSION)
+
+	// All setup has been done, so wait here until we receive a "death" signal from our GR
+	// or the listener gives up
+	for {
+		select {
+		case err := <-lsnerrs:
+			logger.Error("Listener failed", jetlog.KeyTopic, o.Topic, jetlog.KeyError, err)
+			lrchan <- true
+			WG.Wait()
+			return errors.New("mqttbridge: listener failed")
+		case <-sigDeath:
+			logger.Info("Main loop sigDeath<- signalled and clear to exit")
+			// We are clear to die. Let's die with honour *bleurgh*
+			close(sigDeath)
+			return nil
+		}
+	}
+}
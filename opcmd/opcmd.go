@@ -0,0 +1,136 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package opcmd runs Junos operational commands over the JET management API.
+// It is the engine behind management_op_cmd and "jetctl op".
+package opcmd
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/inventory"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetclient"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetlog"
+	mng "github.com/arsonistgopher/junos-jet-demo-apps/proto/management"
+)
+
+// ParseFormat turns "xml", "json" or "cli" into the format to ask Junos for.
+func ParseFormat(s string) (mng.OperationFormatType, error) {
+	// Next, check for XML vs JSON vs CLI
+	switch strings.ToUpper(s) {
+	case "XML":
+		return mng.OperationFormatType_OPERATION_FORMAT_XML, nil
+	case "JSON":
+		return mng.OperationFormatType_OPERATION_FORMAT_JSON, nil
+	case "CLI":
+		return mng.OperationFormatType_OPERATION_FORMAT_CLI, nil
+	default:
+		return mng.OperationFormatType_OPERATION_FORMAT_XML, fmt.Errorf("opcmd: unrecognised format type %q", s)
+	}
+}
+
+// Execute connects to one device, runs the op command and returns its output.
+func Execute(jet jetclient.Config, command string, pbfmt mng.OperationFormatType, logger *jetlog.Logger) (string, error) {
+	// Connect and login
+	jet.Logger = logger
+	session, err := jetclient.Dial(jet)
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	logger.Info("Connect successful")
+
+	// Now we have to create the management client
+	mgmtc := session.Management()
+
+	// Next, create the command to execute over RPC
+	mngCmd := &mng.ExecuteOpCommandRequest_CliCommand{
+		CliCommand: command,
+	}
+
+	// Issue the request
+	req := &mng.ExecuteOpCommandRequest{
+		RequestId: uint64(42),
+		Command:   mngCmd,
+		OutFormat: pbfmt,
+	}
+
+	// Execute the RPC and return the opclient. Large output takes longer to
+	// come back than -timeout allows, so it gets the stream timeout.
+	ctx, cancel := session.StreamContext()
+	defer cancel()
+
+	start := time.Now()
+	opclient, err := mgmtc.ExecuteOpCommand(ctx, req)
+
+	if err != nil {
+		return "", fmt.Errorf("issue getting client for ExecuteOpCommand(): %v", err)
+	}
+
+	// Block and recv()
+	resp, err := opclient.Recv()
+
+	if err != nil {
+		return "", fmt.Errorf("issue receiving data from Junos via gRPC: %s", err)
+	}
+	logger.Debug("Command executed", jetlog.KeyRPC, "ExecuteOpCommand", "command", command, jetlog.KeyDuration, time.Since(start))
+
+	return resp.GetData(), nil
+}
+
+// Options are the command line options for running an op command. The connection,
+// inventory and logging flags are registered separately by the caller.
+type Options struct {
+	Command string // Command to send over RPC
+	Format  string // Data format required (XML / JSON / CLI)
+}
+
+// RegisterFlags registers -command and -format on fs.
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Command, "command", "show version", "Operational command")
+	fs.StringVar(&o.Format, "format", "xml", "XML, JSON or CLI")
+}
+
+// Run executes the command on one device, or on every device chosen by inv, and
+// writes the output to out. An unrecognised format falls back to XML with a warning.
+func (o *Options) Run(jet jetclient.Config, inv *inventory.Flags, logger *jetlog.Logger, out io.Writer) error {
+	pbfmt, err := ParseFormat(o.Format)
+	if err != nil {
+		logger.Warn("Unrecognised format type. Defaulting to XML", "format", o.Format)
+	}
+
+	return inv.ForEachPrinted(jet, logger, out, "Data", func(t inventory.Target, logger *jetlog.Logger) (inventory.Printer, error) {
+		data, err := Execute(t.Config, o.Command, pbfmt, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		// Print the data vanity head and data itself. With an inventory the
+		// head names the device.
+		return func(w io.Writer) error {
+			if !inv.Enabled() {
+				fmt.Fprint(w, "\n---Data---\n\n")
+			}
+			_, err := fmt.Fprint(w, data)
+			return err
+		}, nil
+	})
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package opcmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/arsonistgopher/junos-jet-demo-apps/inventory"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetclient"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetlog"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetmock"
+)
+
+func TestRunAgainstMock(t *testing.T) {
+	srv := jetmock.New()
+	srv.AddUser("jet", "secret")
+	srv.SetOpResponse("show version", "<software-information/>")
+	srv.SetOpResponse("show route summary", "Router ID: 10.0.0.1")
+	if err := srv.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+
+	host, port, _ := net.SplitHostPort(srv.Addr())
+	logger := jetlog.New(ioutil.Discard, "text", jetlog.LevelError)
+
+	tests := []struct {
+		name     string
+		opts     Options
+		password string
+		want     string
+		wantErr  bool
+	}{
+		{"xml", Options{Command: "show version", Format: "xml"}, "secret", "\n---Data---\n\n<software-information/>", false},
+		{"cli", Options{Command: "show route summary", Format: "cli"}, "secret", "\n---Data---\n\nRouter ID: 10.0.0.1", false},
+		{"unknown format falls back to xml", Options{Command: "show version", Format: "yaml"}, "secret", "\n---Data---\n\n<software-information/>", false},
+		{"wrong password", Options{Command: "show version", Format: "xml"}, "wrong", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jet := jetclient.Config{Host: host, Port: port, User: "jet", Password: tt.password, ClientID: "42", Retry: jetclient.RetryPolicy{Attempts: 1}}
+
+			var out bytes.Buffer
+			err := tt.opts.Run(jet, &inventory.Flags{}, logger, &out)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got := out.String(); got != tt.want {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, s := range []string{"xml", "JSON", "Cli"} {
+		if _, err := ParseFormat(s); err != nil {
+			t.Errorf("ParseFormat(%q): %v", s, err)
+		}
+	}
+	if _, err := ParseFormat("yaml"); err == nil {
+		t.Error("ParseFormat(yaml) didn't fail")
+	}
+}
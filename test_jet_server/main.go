@@ -0,0 +1,77 @@
+/*
+Copyright 2018 David Gee, Juniper Networks
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+	"github.com/arsonistgopher/junos-jet-demo-apps/jetmock"
+)
+
+// opCommand is a scripted op command response loaded from the -opcmds file.
+type opCommand struct {
+	Cli  string `toml:"cli"`
+	Data string `toml:"data"`
+}
+
+// TOML based struct for loading scripted op command responses.
+type opCommands struct {
+	Commands []opCommand `toml:"command"`
+}
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:32767", "Address to listen on")
+	user := flag.String("user", "", "Username to accept. Empty accepts any login")
+	passwd := flag.String("passwd", "", "Password to accept for -user")
+	opcmds := flag.String("opcmds", "", "TOML file with [[command]] cli/data pairs")
+	flag.Parse()
+
+	srv := jetmock.New()
+
+	if *user != "" {
+		srv.AddUser(*user, *passwd)
+	}
+
+	if *opcmds != "" {
+		var cmds opCommands
+		if _, err := toml.DecodeFile(*opcmds, &cmds); err != nil {
+			log.Fatal("Unable to load op commands: ", err)
+		}
+		for _, c := range cmds.Commands {
+			srv.SetOpResponse(c.Cli, c.Data)
+		}
+	}
+
+	if err := srv.Start(*listen); err != nil {
+		log.Fatal("Listen error: ", err)
+	}
+	log.Println("Mock JET server listening on", srv.Addr())
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	<-sigs
+
+	for _, r := range srv.Routes() {
+		log.Printf("RIB: %v", r)
+	}
+	srv.Stop()
+}